@@ -0,0 +1,251 @@
+// Command loadtest opens many SSH sessions against a devzat server, has them chat, and reports how long
+// messages take to be delivered and how many connections were dropped.
+//
+//	go run ./cmd/loadtest -addr localhost:2221 -users 200 -rooms 4 -rate 0.5 -duration 1m
+//
+// All the clients come from the same address, so the server's join throttle would throttle and then ban
+// them. Turn it off, along with any per-IP session limit, in the config of the server being tested:
+//
+//	throttle:
+//	  throttle_after: 0
+//	  ban_after: 0
+//	  max_sessions_per_ip: 0
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:2221", "address of the devzat server")
+	users    = flag.Int("users", 50, "number of clients to connect")
+	rooms    = flag.Int("rooms", 1, "number of rooms to spread the clients over (#main is one of them)")
+	rate     = flag.Float64("rate", 0.2, "messages per second sent by each client")
+	duration = flag.Duration("duration", 30*time.Second, "how long to send messages for")
+	ramp     = flag.Duration("ramp", 10*time.Second, "how long to take to connect all the clients")
+	settle   = flag.Duration("settle", 5*time.Second, "how long to wait for messages to arrive after sending stops")
+
+	// tokenRegex matches the tokens put in messages. The messages send the token in bold, so the typed
+	// text that the terminal echoes back still has the asterisks and can be told apart from the message.
+	tokenRegex = regexp.MustCompile(`(\*\*)?LT([0-9a-z]+)x([0-9a-z]+)`)
+
+	sent      sync.Map // token -> time sent
+	sentCount int64
+
+	latencyLock sync.Mutex
+	latencies   []time.Duration
+
+	connected, failed int64
+)
+
+type client struct {
+	id      int
+	name    string
+	room    string
+	session *ssh.Session
+	stdin   io.WriteCloser
+	done    chan struct{} // closed when the session ends
+}
+
+func main() {
+	flag.Parse()
+	if *users < 1 || *rooms < 1 || *rate <= 0 {
+		fmt.Fprintln(os.Stderr, "users and rooms must be at least 1 and rate must be positive")
+		os.Exit(2)
+	}
+
+	fmt.Println("connecting", *users, "clients to", *addr)
+	clients := make([]*client, 0, *users)
+	var clientsLock sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := connect(i)
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				fmt.Fprintln(os.Stderr, "client", i, "failed to connect:", err)
+				return
+			}
+			atomic.AddInt64(&connected, 1)
+			clientsLock.Lock()
+			clients = append(clients, c)
+			clientsLock.Unlock()
+		}(i)
+		time.Sleep(*ramp / time.Duration(*users))
+	}
+	wg.Wait()
+	fmt.Println("connected", connected, "clients in", time.Since(start).Round(time.Millisecond))
+
+	stop := make(chan struct{})
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client) {
+			defer wg.Done()
+			c.chat(stop)
+		}(c)
+	}
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	time.Sleep(*settle)
+
+	stillConnected := 0
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		default:
+			stillConnected++
+		}
+		c.session.Close()
+	}
+	report(stillConnected)
+}
+
+// connect opens a session with a new key, so each client has its own ID, and joins the client's room
+func connect(i int) (*client, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{id: i, name: "load" + strconv.Itoa(i), done: make(chan struct{})}
+	if r := i % *rooms; r == 0 {
+		c.room = "#main"
+	} else {
+		c.room = "#load" + strconv.Itoa(r)
+	}
+
+	conn, err := ssh.Dial("tcp", *addr, &ssh.ClientConfig{
+		User:            c.name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // only used against test servers
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.session, err = conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = c.session.RequestPty("xterm-256color", 40, 120, ssh.TerminalModes{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.stdin, err = c.session.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	stdout, err := c.session.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = c.session.Shell(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.read(stdout)
+	if c.room != "#main" {
+		if _, err = io.WriteString(c.stdin, "cd "+c.room+"\r"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// read records when tokens sent by any client arrive
+func (c *client) read(stdout io.Reader) {
+	defer close(c.done)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		for _, m := range tokenRegex.FindAllStringSubmatch(scanner.Text(), -1) {
+			if m[1] != "" { // our own typing being echoed
+				continue
+			}
+			if t, ok := sent.Load(m[0]); ok {
+				latencyLock.Lock()
+				latencies = append(latencies, time.Since(t.(time.Time)))
+				latencyLock.Unlock()
+			}
+		}
+	}
+}
+
+// chat sends messages with a random delay averaging 1/rate until stop is closed
+func (c *client) chat(stop chan struct{}) {
+	seq := 0
+	for {
+		wait := time.Duration(mrand.ExpFloat64() / *rate * float64(time.Second))
+		select {
+		case <-stop:
+			return
+		case <-c.done:
+			return
+		case <-time.After(wait):
+		}
+		token := "LT" + strconv.FormatInt(int64(c.id), 36) + "x" + strconv.FormatInt(int64(seq), 36)
+		seq++
+		sent.Store(token, time.Now())
+		atomic.AddInt64(&sentCount, 1)
+		if _, err := io.WriteString(c.stdin, "load test message **"+token+"**\r"); err != nil {
+			return
+		}
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func report(stillConnected int) {
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Println()
+	fmt.Println("clients:    ", *users, "requested,", connected, "connected,", failed, "failed to connect")
+	fmt.Println("dropped:    ", int(connected)-stillConnected, "disconnected before the end")
+	fmt.Println("messages:   ", sentCount, "sent,", len(latencies), "deliveries")
+	if len(latencies) == 0 {
+		return
+	}
+	fmt.Println("latency:    ",
+		"p50", percentile(latencies, 50).Round(time.Microsecond),
+		"p90", percentile(latencies, 90).Round(time.Microsecond),
+		"p99", percentile(latencies, 99).Round(time.Microsecond),
+		"max", latencies[len(latencies)-1].Round(time.Microsecond))
+}
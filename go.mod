@@ -24,6 +24,7 @@ require (
 	golang.org/x/image v0.12.0
 	google.golang.org/grpc v1.58.2
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acarl005/stripansi"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// accessMap returns the map in c that key refers to: "admins" or "allowlist"
+func accessMap(c *ConfigType, key string) *map[string]string {
+	if key == "admins" {
+		return &c.Admins
+	}
+	return &c.Allowlist
+}
+
+// setAccess adds id with a note to the admins or allowlist map, or removes it if remove is set.
+// The config file is updated first, keeping its comments, and the change takes effect immediately.
+// If the server has no config file, only the running config is changed.
+func (srv *Server) setAccess(key, id, note string, remove bool) error {
+	srv.configEdit.Lock()
+	defer srv.configEdit.Unlock()
+	if srv.configFile != "" {
+		if err := editConfigMap(srv.configFile, key, id, note, remove); err != nil {
+			return err
+		}
+	}
+	srv.updateConfig(func(c *ConfigType) {
+		// copy on write so anything reading the old map isn't affected
+		m := accessMap(c, key)
+		updated := make(map[string]string, len(*m)+1)
+		for k, v := range *m {
+			updated[k] = v
+		}
+		if remove {
+			delete(updated, id)
+		} else {
+			updated[id] = note
+		}
+		*m = updated
+	})
+	return nil
+}
+
+// editConfigMap sets or removes an entry of a top-level map in a YAML file. The file is replaced atomically.
+func editConfigMap(file, key, id, note string, remove bool) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var doc yamlv3.Node
+	if err = yamlv3.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 { // empty file
+		doc = yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{{Kind: yamlv3.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return errors.New(file + " 不是 YAML 映射")
+	}
+
+	var m *yamlv3.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			m = root.Content[i+1]
+			break
+		}
+	}
+	if m == nil {
+		if remove {
+			return nil
+		}
+		m = &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+		root.Content = append(root.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: key}, m)
+	}
+	if m.Kind == yamlv3.ScalarNode && m.Tag == "!!null" { // like "admins:" with nothing after it
+		*m = yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map", HeadComment: m.HeadComment, LineComment: m.LineComment}
+	}
+	if m.Kind != yamlv3.MappingNode {
+		return errors.New(key + " 不是 YAML 映射")
+	}
+	if m.Style == yamlv3.FlowStyle { // "{}" would stay on one line otherwise
+		m.Style = 0
+	}
+
+	found := false
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value != id {
+			continue
+		}
+		found = true
+		if remove {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+		} else {
+			m.Content[i+1].Value = note
+			m.Content[i+1].Tag = "!!str"
+			m.Content[i+1].Style = 0
+		}
+		break
+	}
+	if !found && !remove {
+		m.Content = append(m.Content,
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: id},
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: note})
+	}
+
+	buf := new(bytes.Buffer)
+	enc := yamlv3.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err = enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, buf.Bytes())
+}
+
+// writeFileAtomic writes to a temporary file and renames it over file, so readers never see a partial file
+func writeFileAtomic(file string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // fails harmlessly after the rename
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func isID(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 64
+}
+
+// resolveID finds the ID for arg, which is either an ID or the name of an online user in any room.
+// name is how the user should be described in messages.
+func (srv *Server) resolveID(arg string) (id, name string, ok bool) {
+	if isID(arg) {
+		return arg, arg[:10] + "...", true
+	}
+	if target, found := srv.Rooms.findUser(arg); found {
+		return target.id, stripansi.Strip(target.Name), true
+	}
+	return "", "", false
+}
+
+// findUserByID returns an online user with id, if there is one
+func (srv *Server) findUserByID(id string) (*User, bool) {
+	if found := srv.Rooms.findByID(id); len(found) > 0 {
+		return found[0], true
+	}
+	return nil, false
+}
+
+// accessCMD implements op, deop, allow and disallow, which edit the config map key
+func accessCMD(line string, u *User, cmd, key string, remove bool) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		if remove {
+			u.writeln(Devbot, "用法: "+cmd+" @user|<id>")
+		} else {
+			u.writeln(Devbot, "用法: "+cmd+" @user|<id> [note]")
+		}
+		return
+	}
+	id, name, ok := u.srv.resolveID(args[0])
+	if !ok {
+		u.writeln(Devbot, "未找到用户。离线用户请使用他们的 ID")
+		return
+	}
+	note := strings.TrimSpace(strings.TrimPrefix(line, args[0]))
+	if note == "" {
+		note = name
+	}
+	_, present := (*accessMap(u.srv.Config(), key))[id]
+	if remove && !present {
+		u.writeln(Devbot, name+" 不在 "+key+" 中")
+		return
+	}
+	if err := u.srv.setAccess(key, id, note, remove); err != nil {
+		u.srv.Log.Println("编辑配置时出错:", err)
+		u.writeln(Devbot, "编辑配置时出错: "+err.Error())
+		return
+	}
+	u.srv.audit(u, cmd, name, id, note)
+
+	target, online := u.srv.findUserByID(id)
+	switch cmd {
+	case "op":
+		u.writeln(Devbot, name+" 现在是管理员")
+		if online {
+			target.writeln(Devbot, "你现在是管理员")
+		}
+	case "deop":
+		u.writeln(Devbot, name+" 不再是管理员")
+		if online {
+			target.writeln(Devbot, "你不再是管理员")
+		}
+	case "allow":
+		u.writeln(Devbot, name+" 已被添加到允许列表")
+	case "disallow":
+		u.writeln(Devbot, name+" 已从允许列表中移除")
+	}
+}
+
+func opCMD(line string, u *User)       { accessCMD(line, u, "op", "admins", false) }
+func deopCMD(line string, u *User)     { accessCMD(line, u, "deop", "admins", true) }
+func allowCMD(line string, u *User)    { accessCMD(line, u, "allow", "allowlist", false) }
+func disallowCMD(line string, u *User) { accessCMD(line, u, "disallow", "allowlist", true) }
+
+func allowlistCMD(_ string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	allowlist := u.srv.Config().Allowlist
+	if len(allowlist) == 0 {
+		msg := "允许列表是空的"
+		if !u.srv.Config().Private {
+			msg += " (这个服务器不是私人服务器，所以每个人都可以加入)"
+		}
+		u.writeln(Devbot, msg)
+		return
+	}
+	ids := make([]string, 0, len(allowlist))
+	for id := range allowlist {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return allowlist[ids[i]] < allowlist[ids[j]] })
+	msg := "允许列表:  \n"
+	for i, id := range ids {
+		msg += Cyan.Cyan(strconv.Itoa(i+1)) + ". " + id + "\t" + allowlist[id] + "  \n"
+	}
+	u.writeln(Devbot, msg)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+)
+
+// AuditEntry is one line of the moderation audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	ActorID  string    `json:"actor_id"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	TargetID string    `json:"target_id,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+const maxAuditResults = 30
+
+func (srv *Server) auditFile() string {
+	return filepath.Join(srv.Config().DataDir, "audit.jsonl")
+}
+
+// audit appends an entry to the audit log. actor is nil for actions taken automatically by devbot.
+// target is the name (or network) acted on and targetID is its ID, if there is one.
+func (srv *Server) audit(actor *User, action, target, targetID, reason string) {
+	e := AuditEntry{
+		Time:     time.Now(),
+		ActorID:  "devbot",
+		Actor:    "devbot",
+		Action:   action,
+		Target:   stripansi.Strip(target),
+		TargetID: targetID,
+		Reason:   reason,
+	}
+	if actor != nil {
+		e.ActorID = actor.id
+		e.Actor = stripansi.Strip(actor.Name)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		srv.Log.Println("编码审计日志条目时出错:", err)
+		return
+	}
+	srv.auditMutex.Lock()
+	defer srv.auditMutex.Unlock()
+	f, err := os.OpenFile(srv.auditFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		srv.Log.Println("打开审计日志时出错:", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		srv.Log.Println("写入审计日志时出错:", err)
+	}
+}
+
+// readAudit returns all entries in the audit log for which keep returns true, oldest first.
+func (srv *Server) readAudit(keep func(e *AuditEntry) bool) ([]AuditEntry, error) {
+	srv.auditMutex.Lock()
+	defer srv.auditMutex.Unlock()
+	f, err := os.Open(srv.auditFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMsgLen*4)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // skip corrupt lines, the log is append-only so there's nothing to fix
+		}
+		if keep(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseSince parses either a duration before now (like 24h) or a date (like 2006-01-02)
+func parseSince(s string) (time.Time, bool) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func auditCMD(line string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	var who, action string
+	var since time.Time
+	for _, arg := range strings.Fields(line) {
+		if strings.HasPrefix(arg, "@") {
+			who = arg[1:]
+		} else if t, ok := parseSince(arg); ok {
+			since = t
+		} else {
+			action = arg
+		}
+	}
+	entries, err := u.srv.readAudit(func(e *AuditEntry) bool {
+		if who != "" && e.Actor != who && e.Target != who && e.ActorID != who && e.TargetID != who {
+			return false
+		}
+		if action != "" && e.Action != action {
+			return false
+		}
+		return !e.Time.Before(since)
+	})
+	if err != nil {
+		u.writeln(Devbot, "读取审计日志时出错: "+err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		u.writeln(Devbot, "没有匹配的审计记录")
+		return
+	}
+	msg := "审计日志"
+	if len(entries) > maxAuditResults {
+		msg += " (最近 " + strconv.Itoa(maxAuditResults) + " 条，共 " + strconv.Itoa(len(entries)) + " 条)"
+		entries = entries[len(entries)-maxAuditResults:]
+	}
+	msg += ":  \n"
+	for _, e := range entries {
+		t := e.Time
+		if u.Timezone.Location != nil {
+			t = t.In(u.Timezone.Location)
+		}
+		msg += t.Format("2006-01-02 15:04") + " " + Cyan.Cyan(e.Actor) + " " + e.Action
+		if e.Target != "" {
+			msg += " " + e.Target
+		}
+		if e.Reason != "" {
+			msg += " (" + e.Reason + ")"
+		}
+		msg += "  \n"
+	}
+	u.writeln(Devbot, msg)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	goaway "github.com/TwiN/go-away"
+)
+
+// Filter policies, set server-wide or per room
+const (
+	PolicyCensor = "censor" // replace bad words with asterisks
+	PolicyBlock  = "block"  // don't send the message and warn the sender
+	PolicyOff    = "off"
+)
+
+// FilterConfig is stored in filters.json in the data directory and is edited with the filter command.
+type FilterConfig struct {
+	// Policy is the server-wide policy. If empty, it is censor if Config.Censor is set and off otherwise.
+	Policy string `json:"policy,omitempty"`
+	// Rooms maps room names to policies that override Policy
+	Rooms map[string]string `json:"rooms,omitempty"`
+	// Deny and Allow add words to or remove words from the default list
+	Deny     []string `json:"deny,omitempty"`
+	Allow    []string `json:"allow,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// okayIshWords are base 64 encoded okay-ish swears
+var okayIshWords = []string{"ZnVjaw==", "Y3JhcA==", "c2hpdA==", "YXJzZQ==", "YXNz", "YnV0dA==", "cGlzcw=="}
+
+func (srv *Server) filtersFile() string {
+	return filepath.Join(srv.Config().DataDir, "filters.json")
+}
+
+func validPolicy(p string) bool {
+	return p == PolicyCensor || p == PolicyBlock || p == PolicyOff
+}
+
+// policyFor returns the filter policy for a room. filtersMutex must be held.
+func (srv *Server) policyFor(r *Room) string {
+	if r != nil {
+		if p, ok := srv.Filters.Rooms[r.name]; ok {
+			return p
+		}
+	}
+	if srv.Filters.Policy != "" {
+		return srv.Filters.Policy
+	}
+	if srv.Config().Censor {
+		return PolicyCensor
+	}
+	return PolicyOff
+}
+
+// applyFilters builds the profanity detector and compiles the patterns in f, and makes f the active filter config.
+// Nothing is changed if there is an error.
+func (srv *Server) applyFilters(f FilterConfig) error {
+	if f.Policy != "" && !validPolicy(f.Policy) {
+		return errors.New("无效的策略: " + f.Policy)
+	}
+	for room, p := range f.Rooms {
+		if !validPolicy(p) {
+			return errors.New("无效的策略 " + p + " (房间 " + room + ")")
+		}
+	}
+	patterns := make([]*regexp.Regexp, 0, len(f.Patterns))
+	for _, p := range f.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, re)
+	}
+
+	allowed := make(map[string]bool, len(f.Allow)+len(okayIshWords))
+	for _, w := range okayIshWords {
+		b, _ := base64.StdEncoding.DecodeString(w)
+		allowed[string(b)] = true
+	}
+	for _, w := range f.Allow {
+		allowed[strings.ToLower(w)] = true
+	}
+	without := func(words []string) []string {
+		result := make([]string, 0, len(words))
+		for _, w := range words {
+			if !allowed[w] {
+				result = append(result, w)
+			}
+		}
+		return result
+	}
+	profanities := without(goaway.DefaultProfanities)
+	for _, w := range f.Deny {
+		profanities = append(profanities, strings.ToLower(w))
+	}
+	falsePositives := append([]string{}, goaway.DefaultFalsePositives...)
+	for _, w := range f.Allow { // so an allowed word isn't censored for containing a profanity
+		falsePositives = append(falsePositives, strings.ToLower(w))
+	}
+	d := goaway.NewProfanityDetector().WithSanitizeSpaces(false).
+		WithCustomDictionary(profanities, falsePositives, without(goaway.DefaultFalseNegatives))
+
+	srv.filtersMutex.Lock()
+	srv.Filters = f
+	srv.filterPatterns = patterns
+	srv.detector = d
+	srv.filtersMutex.Unlock()
+	return nil
+}
+
+// loadFilters reads filters.json from the data directory. A missing file means the defaults are used.
+// filtersEdit must be held unless the server isn't running yet.
+func (srv *Server) loadFilters() error {
+	f := FilterConfig{}
+	data, err := os.ReadFile(srv.filtersFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+	}
+	return srv.applyFilters(f)
+}
+
+func (srv *Server) saveFilters() error {
+	srv.filtersMutex.RLock()
+	data, err := json.MarshalIndent(srv.Filters, "", "   ")
+	srv.filtersMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(srv.filtersFile(), data, 0644)
+}
+
+// censorText replaces bad words and pattern matches with asterisks. filtersMutex must be held.
+func (srv *Server) censorText(text string) string {
+	text = srv.detector.Censor(text)
+	for _, re := range srv.filterPatterns {
+		text = re.ReplaceAllStringFunc(text, func(s string) string {
+			return strings.Repeat("*", len([]rune(s)))
+		})
+	}
+	return text
+}
+
+// rmBadWords censors text using the server-wide policy. It is used for names, which can't be blocked.
+func (srv *Server) rmBadWords(text string) string {
+	srv.filtersMutex.RLock()
+	defer srv.filtersMutex.RUnlock()
+	if srv.policyFor(nil) == PolicyOff {
+		return text
+	}
+	return srv.censorText(text)
+}
+
+// filterMessage applies the policy of room r to a message. It returns the message to send and
+// whether it should be blocked instead.
+func (srv *Server) filterMessage(r *Room, text string) (string, bool) {
+	srv.filtersMutex.RLock()
+	defer srv.filtersMutex.RUnlock()
+	switch srv.policyFor(r) {
+	case PolicyCensor:
+		return srv.censorText(text), false
+	case PolicyBlock:
+		if srv.detector.IsProfane(text) {
+			return text, true
+		}
+		for _, re := range srv.filterPatterns {
+			if re.MatchString(text) {
+				return text, true
+			}
+		}
+	}
+	return text, false
+}
+
+func filterCMD(line string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		u.writeln(Devbot, "用法: filter list|reload|add|remove|policy")
+		return
+	}
+	// held until the change is applied so an edit made at the same time isn't lost
+	u.srv.filtersEdit.Lock()
+	defer u.srv.filtersEdit.Unlock()
+	u.srv.filtersMutex.RLock()
+	f := u.srv.Filters
+	f.Rooms = make(map[string]string, len(u.srv.Filters.Rooms))
+	for k, v := range u.srv.Filters.Rooms {
+		f.Rooms[k] = v
+	}
+	f.Deny = append([]string(nil), u.srv.Filters.Deny...)
+	f.Allow = append([]string(nil), u.srv.Filters.Allow...)
+	f.Patterns = append([]string(nil), u.srv.Filters.Patterns...)
+	u.srv.filtersMutex.RUnlock()
+
+	switch args[0] {
+	case "list":
+		u.srv.filtersMutex.RLock()
+		msg := "默认策略: " + u.srv.policyFor(nil) + "  \n"
+		rooms := make([]string, 0, len(f.Rooms))
+		for room := range f.Rooms {
+			rooms = append(rooms, room)
+		}
+		u.srv.filtersMutex.RUnlock()
+		sort.Strings(rooms)
+		for _, room := range rooms {
+			msg += room + ": " + f.Rooms[room] + "  \n"
+		}
+		msg += "deny: " + strings.Join(f.Deny, ", ") + "  \n" +
+			"allow: " + strings.Join(f.Allow, ", ") + "  \n" +
+			"patterns: " + strings.Join(f.Patterns, "  ") + "  \n"
+		u.writeln(Devbot, msg)
+		return
+	case "reload":
+		if err := u.srv.loadFilters(); err != nil {
+			u.writeln(Devbot, "加载过滤器时出错: "+err.Error())
+			return
+		}
+		u.writeln(Devbot, "过滤器已重新加载")
+		return
+	case "add", "remove":
+		if len(args) < 3 {
+			u.writeln(Devbot, "用法: filter "+args[0]+" deny|allow|pattern <word>")
+			return
+		}
+		word := strings.Join(args[2:], " ")
+		var list *[]string
+		switch args[1] {
+		case "deny":
+			list = &f.Deny
+			word = strings.ToLower(word)
+		case "allow":
+			list = &f.Allow
+			word = strings.ToLower(word)
+		case "pattern":
+			list = &f.Patterns
+		default:
+			u.writeln(Devbot, "列表必须是 deny、allow 或 pattern")
+			return
+		}
+		if args[0] == "add" {
+			*list = append(*list, word)
+		} else {
+			found := false
+			for i := range *list {
+				if (*list)[i] == word {
+					*list = append((*list)[:i], (*list)[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				u.writeln(Devbot, "列表中没有 "+word)
+				return
+			}
+		}
+	case "policy":
+		if len(args) < 2 {
+			u.writeln(Devbot, "用法: filter policy [#room] censor|block|off|default")
+			return
+		}
+		room, policy := "", args[1]
+		if strings.HasPrefix(args[1], "#") && len(args) > 2 {
+			room, policy = args[1], args[2]
+		}
+		if policy != "default" && !validPolicy(policy) {
+			u.writeln(Devbot, "策略必须是 censor、block、off 或 default")
+			return
+		}
+		switch {
+		case room == "" && policy == "default":
+			f.Policy = ""
+		case room == "":
+			f.Policy = policy
+		case policy == "default":
+			delete(f.Rooms, room)
+		default:
+			f.Rooms[room] = policy
+		}
+	default:
+		u.writeln(Devbot, "用法: filter list|reload|add|remove|policy")
+		return
+	}
+
+	if err := u.srv.applyFilters(f); err != nil {
+		u.writeln(Devbot, "错误: "+err.Error())
+		return
+	}
+	if err := u.srv.saveFilters(); err != nil {
+		u.writeln(Devbot, "保存过滤器时出错: "+err.Error())
+		u.srv.Log.Println(err)
+	}
+	u.srv.audit(u, "filter", "", "", line)
+	u.writeln(Devbot, "过滤器已更新")
+}
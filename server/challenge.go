@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengeConfig is an optional gate for IDs that have never joined before. New users have to type a
+// phrase or answer a question before they join, and are then on probation for a while.
+type ChallengeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Phrases and Questions are the pool challenges are picked from. If both are empty, built-in phrases are used.
+	Phrases   []string            `yaml:"phrases,omitempty"`
+	Questions []ChallengeQuestion `yaml:"questions,omitempty"`
+	Attempts  int                 `yaml:"attempts"`
+	// Probation is how long users who passed the challenge are on probation for
+	Probation time.Duration `yaml:"probation"`
+	// ProbationMessages is how many lines users on probation can send per minute
+	ProbationMessages int `yaml:"probation_messages"`
+}
+
+type ChallengeQuestion struct {
+	Question string   `yaml:"question"`
+	Answers  []string `yaml:"answers"`
+}
+
+const challengeTimeout = 2 * time.Minute
+
+var (
+	defaultChallengePhrases = []string{"我不是机器人", "hello devzat", "ssh is fun", "你好世界"}
+
+	mdLinkRegex  = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	imgTagRegex  = regexp.MustCompile(`(?i)<img[^>]*>`)
+	bareURLRegex = regexp.MustCompile(`(?i)\b(?:https?://|ftp://|www\.)\S+`)
+)
+
+func validateChallenge(c ChallengeConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Attempts < 1 {
+		return errors.New("challenge.attempts 必须至少为 1")
+	}
+	if c.Probation < 0 || c.ProbationMessages < 0 {
+		return errors.New("challenge.probation 和 challenge.probation_messages 不能是负数")
+	}
+	for _, q := range c.Questions {
+		if q.Question == "" || len(q.Answers) == 0 {
+			return errors.New("每个 challenge 问题都需要 question 和 answers")
+		}
+	}
+	return nil
+}
+
+// seenBefore reports whether id has joined before, which is when preferences get saved
+func (srv *Server) seenBefore(id string) bool {
+	_, err := os.Stat(filepath.Join(srv.Config().DataDir, "user-prefs", id+".json"))
+	return err == nil
+}
+
+// needsChallenge reports whether u has to pass a challenge before joining
+func needsChallenge(u *User) bool {
+	if !u.srv.Config().Challenge.Enabled || auth(u) {
+		return false
+	}
+	if _, ok := u.srv.Config().Allowlist[u.id]; ok {
+		return false
+	}
+	return !u.srv.seenBefore(u.id)
+}
+
+// pickChallenge returns a prompt to show and the answers that are accepted
+func pickChallenge(c ChallengeConfig) (prompt string, answers []string) {
+	phrases := c.Phrases
+	if len(phrases) == 0 && len(c.Questions) == 0 {
+		phrases = defaultChallengePhrases
+	}
+	i := rand.Intn(len(phrases) + len(c.Questions))
+	if i < len(phrases) {
+		return "请输入以下短语以证明您不是机器人: " + phrases[i], []string{phrases[i]}
+	}
+	q := c.Questions[i-len(phrases)]
+	return "请回答以下问题以证明您不是机器人: " + q.Question, q.Answers
+}
+
+func challengeAnswerOK(answer string, answers []string) bool {
+	answer = strings.Join(strings.Fields(answer), " ")
+	for _, a := range answers {
+		if strings.EqualFold(answer, strings.Join(strings.Fields(a), " ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// runChallenge asks u to complete a challenge and puts them on probation if they do.
+// It returns false if they fail or don't answer in time.
+func runChallenge(u *User) bool {
+	c := u.srv.Config().Challenge
+	prompt, answers := pickChallenge(c)
+	u.writeln(Devbot, "欢迎! 这是您第一次加入。"+prompt)
+	u.term.SetPrompt("> ")
+
+	passed := make(chan bool, 1)
+	go func() {
+		for i := 0; i < c.Attempts; i++ {
+			line, err := u.term.ReadLine()
+			if err != nil {
+				break
+			}
+			if challengeAnswerOK(line, answers) {
+				passed <- true
+				return
+			}
+			if i < c.Attempts-1 {
+				u.writeln(Devbot, "不对，请再试一次")
+			}
+		}
+		passed <- false
+	}()
+	select {
+	case ok := <-passed:
+		if !ok {
+			u.srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (挑战失败)")
+			u.writeln(Devbot, "挑战失败")
+			return false
+		}
+	case <-time.After(challengeTimeout):
+		u.srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (挑战超时)")
+		u.session.Close()
+		return false
+	}
+
+	if c.Probation > 0 {
+		u.ProbationUntil = time.Now().Add(c.Probation)
+		u.writeln(Devbot, "谢谢! 在接下来的 "+printPrettyDuration(c.Probation)+" 内，您每分钟最多可以发送 "+
+			strconv.Itoa(c.ProbationMessages)+" 条消息，并且链接和图像会被隐藏")
+	}
+	if err := u.savePrefs(); err != nil { // so the ID counts as seen even if they leave right away
+		u.srv.Log.Println("无法保存用户:", err)
+	}
+	return true
+}
+
+func (u *User) onProbation() bool {
+	return !u.ProbationUntil.IsZero() && time.Now().Before(u.ProbationUntil)
+}
+
+// probationAllows counts a line sent by a user on probation and reports whether it is within their rate limit
+func (u *User) probationAllows() bool {
+	if !u.onProbation() || u.srv.Config().Challenge.ProbationMessages == 0 {
+		return true
+	}
+	if len(u.probationSent) > 0 && time.Since(u.probationSent[0]) > time.Minute {
+		i := 0
+		for i < len(u.probationSent) && time.Since(u.probationSent[i]) > time.Minute {
+			i++
+		}
+		u.probationSent = u.probationSent[i:]
+	}
+	if len(u.probationSent) >= u.srv.Config().Challenge.ProbationMessages {
+		return false
+	}
+	u.probationSent = append(u.probationSent, time.Now())
+	return true
+}
+
+// stripLinks replaces links and images with their text, and removes bare URLs
+func stripLinks(text string) string {
+	text = mdLinkRegex.ReplaceAllString(text, "$1")
+	text = imgTagRegex.ReplaceAllString(text, "")
+	return bareURLRegex.ReplaceAllString(text, "[链接已隐藏]")
+}
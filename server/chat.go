@@ -0,0 +1,1159 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"image"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acarl005/stripansi"
+	"github.com/gliderlabs/ssh"
+	terminal "github.com/quackduck/term"
+)
+
+var Devbot = Green.Paint("devbot")
+
+const maxMsgLen = 5120
+
+// Ban is an entry in the bans list. A zero ExpiresAt means the ban is permanent.
+// Bans saved by older versions only have Addr and ID set.
+type Ban struct {
+	Addr      string
+	ID        string
+	Reason    string `json:",omitempty"`
+	BannerID  string `json:",omitempty"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// expired reports whether the ban had a duration and it has passed
+func (b Ban) expired() bool {
+	return !b.ExpiresAt.IsZero() && time.Now().After(b.ExpiresAt)
+}
+
+type Room struct {
+	name       string
+	srv        *Server
+	users      []*User
+	usersMutex sync.RWMutex
+
+	recent      []roomMessage // the last few messages sent by users, used to give reports context
+	recentMutex sync.Mutex
+}
+
+// roomMessage is a message sent by a user, numbered so that it can be referred to (for example by report)
+type roomMessage struct {
+	id       int
+	time     time.Time
+	sender   string
+	senderID string
+	text     string
+}
+
+const maxRecentMessages = 50
+
+// remember records a message sent by u in r's recent messages and returns its ID
+func (r *Room) remember(u *User, text string) int {
+	id := int(atomic.AddInt64(&r.srv.lastMessageID, 1))
+	r.recentMutex.Lock()
+	defer r.recentMutex.Unlock()
+	if len(r.recent) >= maxRecentMessages {
+		r.recent = r.recent[1:]
+	}
+	r.recent = append(r.recent, roomMessage{id, time.Now(), stripansi.Strip(u.Name), u.id, text})
+	return id
+}
+
+// recentMessages returns a copy of the last n messages sent by users in r
+func (r *Room) recentMessages(n int) []roomMessage {
+	r.recentMutex.Lock()
+	defer r.recentMutex.Unlock()
+	if n > len(r.recent) {
+		n = len(r.recent)
+	}
+	return append([]roomMessage(nil), r.recent[len(r.recent)-n:]...)
+}
+
+// User represents a user connected to the SSH server.
+// Exported fields represent ones saved to disk. (see also: User.savePrefs())
+type User struct {
+	Name            string
+	Prompt          string
+	formattedPrompt string
+	Pronouns        []string
+	Bio             string
+	session         ssh.Session
+	term            *terminal.Terminal
+	srv             *Server
+
+	inRoom    atomic.Pointer[Room] // changed by the registry, read with room
+	left      bool                 // set once u leaves the registry. Guarded by Registry.lock.
+	messaging *User                // currently messaging this User in a DM
+
+	Bell          bool
+	PingEverytime bool
+	ImagesAsLinks bool
+	isBridge      bool
+	IsMuted       bool
+	MuteShadow    bool // muted without being told: their messages are echoed only to them
+	FormatTime24  bool
+
+	MutedUntil time.Time // zero means muted until unmuted
+	MutedRoom  string    // if set, the mute only applies in this room
+	MuteReason string
+	muteMutex  sync.Mutex // guards the mute fields, which admins change from their own sessions
+
+	ProbationUntil time.Time   // new users who passed the challenge are rate-limited and can't post links until then
+	probationSent  []time.Time // when lines were sent in the last minute, while on probation
+
+	Color   string
+	ColorBG string
+	id      string
+	addr    string
+
+	releaseSession func() // undoes counting this user's session against the connection limits
+	closeOnce      sync.Once
+	outbox         *outbox                // queued output, nil until the user has joined
+	readOnly       bool                   // set for users on a read-only reputation list
+	format         func(chatEvent) []byte // set for sessions without a terminal, which are sent events instead of text
+
+	outputMutex   sync.Mutex // guards winWidth and lastTimestamp, which are used by everyone writing to this user
+	winWidth      int
+	lastTimestamp time.Time
+	joinTime      time.Time
+	lastInteract  time.Time
+	Timezone      tz
+}
+
+type tz struct {
+	*time.Location
+}
+
+func (t *tz) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == "" { // empty string means timezone agnostic format
+		t.Location = nil
+		return nil
+	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return err
+	}
+	t.Location = loc
+	return nil
+}
+
+func (t *tz) MarshalJSON() ([]byte, error) {
+	if t.Location == nil {
+		return json.Marshal("")
+	}
+	return json.Marshal(t.Location.String())
+}
+
+type backlogMessage struct {
+	timestamp  time.Time
+	senderName string
+	text       string
+}
+
+// newSSHServer makes a chat server for addr. If keyAuth is false, clients don't need a key.
+func (srv *Server) newSSHServer(addr string, keyAuth bool) *ssh.Server {
+	sshServer := &ssh.Server{Addr: addr, Handler: srv.handleSession}
+	if keyAuth { // peers authenticate with their host keys
+		sshServer.SubsystemHandlers = map[string]ssh.SubsystemHandler{federationSubsystem: srv.handleFederation}
+	}
+	opts := []ssh.Option{ssh.HostKeyFile(srv.Config().KeyFile), ssh.WrapConn(srv.filterConn)} // drops denied networks and sets up keepalives
+	if keyAuth {
+		opts = append(opts, ssh.PublicKeyAuth(func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return true // allow all keys, this lets us hash pubkeys later
+		}))
+	}
+	for _, opt := range opts {
+		if err := sshServer.SetOption(opt); err != nil {
+			srv.Log.Println("设置 SSH 服务器选项时出错:", err)
+		}
+	}
+	return sshServer
+}
+
+func (srv *Server) handleSession(s ssh.Session) {
+	if !srv.trackSession() {
+		s.Close()
+		return
+	}
+	defer srv.sessions.Done()
+	go keepSessionAlive(s)
+	defer srv.protectFromPanic()
+	cmd := s.Command()
+	if _, _, isPty := s.Pty(); !isPty && len(cmd) == 0 { // a bot or script
+		cmd = []string{"json"}
+	}
+	if len(cmd) > 0 {
+		if !srv.runExec(s, cmd) {
+			s.Exit(1) //nolint:errcheck // the client might be gone
+		}
+		return
+	}
+	u := srv.newUser(s, nil)
+	if u == nil {
+		s.Close()
+		return
+	}
+	u.repl()
+}
+
+func (r *Room) broadcast(senderName, msg string) {
+	r.broadcastEvent(senderName, msg, nil)
+}
+
+// announce is like broadcast, but users without a terminal are sent ev instead of msg. If msg is empty,
+// only they are told.
+func (r *Room) announce(senderName, msg string, ev chatEvent) {
+	r.broadcastEvent(senderName, msg, &ev)
+}
+
+func (r *Room) broadcastEvent(senderName, msg string, ev *chatEvent) {
+	if msg == "" && ev == nil {
+		return
+	}
+	if msg != "" {
+		if b := r.srv.slack.Load(); b != nil {
+			if senderName != "" {
+				b.relay("[" + r.name + "] *" + senderName + "*: " + msg)
+			} else {
+				b.relay("[" + r.name + "] " + msg)
+			}
+		}
+		if b := r.srv.discord.Load(); b != nil {
+			b.relay(DiscordMsg{
+				senderName: senderName,
+				msg:        msg,
+				channel:    r.name,
+			})
+		}
+	}
+	r.deliver(senderName, msg, ev)
+}
+
+// findMention finds mentions and colors them
+func (r *Room) findMention(msg string) string {
+	if len(msg) == 0 {
+		return msg
+	}
+	maxLen := 0
+	indexMax := -1
+
+	if msg[0] == '@' {
+		users := r.snapshot()
+		for i := range users {
+			rawName := stripansi.Strip(users[i].Name)
+			if strings.HasPrefix(msg, "@"+rawName) {
+				if len(rawName) > maxLen {
+					maxLen = len(rawName)
+					indexMax = i
+				}
+			}
+		}
+		if indexMax != -1 { // found a mention
+			return users[indexMax].Name + r.findMention(msg[maxLen+1:])
+		}
+	}
+
+	posAt := strings.IndexByte(msg, '@')
+	if posAt < 0 { // no mention
+		return msg
+	}
+	if posAt == 0 { // if the message starts with "@" but it isn't a valid mention, we don't want to create an infinite loop
+		return "@" + r.findMention(msg[1:])
+	}
+
+	if msg[posAt-1] == '\\' { // if the "@" is escaped
+		return msg[0:posAt-1] + "@" + r.findMention(msg[posAt+1:])
+	}
+
+	return msg[0:posAt] + r.findMention(msg[posAt:])
+}
+
+func (r *Room) broadcastNoBridges(senderName, msg string) {
+	r.deliver(senderName, msg, nil)
+}
+
+// deliver writes msg to everyone in r, or ev to users without a terminal if it isn't nil
+func (r *Room) deliver(senderName, msg string, ev *chatEvent) {
+	if msg == "" && ev == nil {
+		return
+	}
+	if msg != "" {
+		msg = r.findMention(strings.ReplaceAll(msg, "@everyone", Green.Paint("everyone\a")))
+	}
+	for _, us := range r.snapshot() {
+		if ev != nil && us.format != nil {
+			e := *ev
+			e.Room = r.name
+			us.sendEvent(e)
+		} else if msg != "" {
+			us.writeln(senderName, msg) // only queues the output, so slow clients don't hold up the room
+		}
+	}
+	if srv := r.srv; r == srv.MainRoom && msg != "" {
+		srv.backlogMutex.Lock()
+		if len(srv.Backlog) > 0 {
+			srv.Backlog = srv.Backlog[1:]
+			srv.Backlog = append(srv.Backlog, backlogMessage{time.Now(), senderName, msg + "\n"})
+		}
+		srv.backlogMutex.Unlock()
+	}
+}
+
+func autocompleteCallback(u *User, line string, pos int, key rune) (string, int, bool) {
+	if key == '\t' {
+		// Autocomplete a username
+
+		// Split the input string to look for @<name>
+		words := strings.Fields(line)
+
+		toAdd := userMentionAutocomplete(u, words)
+		if toAdd != "" {
+			return line + toAdd, pos + len(toAdd), true
+		}
+		toAdd = roomAutocomplete(u, words)
+		if toAdd != "" {
+			return line + toAdd, pos + len(toAdd), true
+		}
+	}
+	return "", pos, false
+}
+
+func userMentionAutocomplete(u *User, words []string) string {
+	if len(words) < 1 {
+		return ""
+	}
+	// remove @, =, or =@ from the start of the last word
+	lastWord := words[len(words)-1]
+	if len(lastWord) > 1 && lastWord[0] == '=' && lastWord[1] == '@' {
+		lastWord = lastWord[2:]
+	} else if lastWord[0] == '@' || lastWord[0] == '=' {
+		lastWord = lastWord[1:]
+	} else { // No prefix match
+		return ""
+	}
+	// check the last word and see if it's trying to refer to a user
+	for _, us := range u.room().snapshot() {
+		strippedName := stripansi.Strip(us.Name)
+		toAdd := strings.TrimPrefix(strippedName, lastWord)
+		if toAdd != strippedName { // there was a match, and some text got trimmed!
+			return toAdd + " "
+		}
+	}
+	return ""
+}
+
+func roomAutocomplete(u *User, words []string) string {
+	// trying to refer to a room?
+	if len(words) > 0 && words[len(words)-1][0] == '#' {
+		// don't slice the # off, since the room name includes it
+		for _, r := range u.srv.Rooms.all() {
+			name := r.name
+			toAdd := strings.TrimPrefix(name, words[len(words)-1])
+			if toAdd != name { // there was a match, and some text got trimmed!
+				return toAdd + " "
+			}
+		}
+	}
+	return ""
+}
+
+// newUser sets up a user for a session and puts them in #main, returning nil if they can't join. If format
+// is not nil, the session has no terminal and gets events formatted by it instead.
+func (srv *Server) newUser(s ssh.Session, format func(chatEvent) []byte) *User {
+	u := srv.admitUser(s, format)
+	if u == nil {
+		return nil
+	}
+
+	if !srv.Config().Private && format == nil { // sensitive info might be shared on a private server
+		var lastStamp time.Time
+		srv.backlogMutex.Lock()
+		backlog := append([]backlogMessage(nil), srv.Backlog...)
+		srv.backlogMutex.Unlock()
+		for i := range backlog {
+			if backlog[i].text == "" { // skip empty entries
+				continue
+			}
+			if i == 0 || backlog[i].timestamp.Sub(lastStamp) > time.Minute {
+				lastStamp = backlog[i].timestamp
+				u.rWriteln(fmtTime(u, lastStamp))
+			}
+			u.writeln(backlog[i].senderName, backlog[i].text)
+		}
+		if time.Since(lastStamp) > time.Minute && u.Timezone.Location != nil {
+			u.rWriteln(fmtTime(u, time.Now()))
+		}
+	}
+
+	u.startOutbox()
+	srv.Rooms.join(u, srv.MainRoom)
+	srv.federateRoster(srv.MainRoom)
+	others := srv.MainRoom.userCount() - 1
+	go srv.sendCurrentUsersTwitterMessage()
+
+	u.term.SetBracketedPasteMode(true) // experimental paste bracketing support
+	u.term.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		return autocompleteCallback(u, line, pos, key)
+	}
+
+	switch {
+	case format != nil: // they get their own join event instead
+	case others == 0:
+		u.writeln("", Blue.Paint("欢迎来到聊天室.目前没有更多用户"))
+	case others == 1:
+		u.writeln("", Yellow.Paint("欢迎来到聊天室.还有一个用户"))
+	default:
+		u.writeln("", Green.Paint("欢迎来到聊天室.有", strconv.Itoa(others), "用户"))
+	}
+	srv.MainRoom.announce("", Green.Paint(" --> ")+u.Name+" 已加入聊天", chatEvent{Type: "join", Name: stripansi.Strip(u.Name)})
+	if room, ok := srv.restoredRoom(u.id); ok {
+		u.writeln(Devbot, "欢迎回来！服务器重启前您在 "+room+"，已将您带回该房间")
+		u.changeRoom(srv.Rooms.getOrCreate(room))
+	}
+	return u
+}
+
+// admitUser makes a user for a session and runs the checks everyone goes through before joining: bans,
+// reputation lists, lockdown, the allowlist, join limits and the new-user challenge. Their prefs are loaded,
+// but they aren't in a room yet. It returns nil if they can't join.
+func (srv *Server) admitUser(s ssh.Session, format func(chatEvent) []byte) *User {
+	var term *terminal.Terminal
+	if format != nil { // prompts read EOF, and terminal output is dropped in favor of events
+		term = terminal.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(""), io.Discard}, "")
+	} else {
+		term = terminal.NewTerminal(s, "> ")
+	}
+	_ = term.SetSize(10000, 10000) // disable any formatting done by term
+	pty, winChan, isPty := s.Pty()
+	w := pty.Window.Width
+	if !isPty && format == nil { // only support pty joins
+		term.Write([]byte("Devzat 不允许non-pty联接。你想在这里拉什么?"))
+		return nil
+	}
+	if w <= 0 { // strange terminals
+		w = 80
+	}
+
+	host, _, _ := net.SplitHostPort(s.RemoteAddr().String()) // definitely should not give an err
+
+	toHash := ""
+
+	pubkey := s.PublicKey()
+	if pubkey != nil {
+		toHash = string(pubkey.Marshal())
+	} else { // If we can't get the public key fall back to the IP.
+		toHash = host
+	}
+
+	u := &User{
+		Name:          s.User(),
+		Pronouns:      []string{"unset"},
+		session:       s,
+		term:          term,
+		ColorBG:       "bg-off",
+		Bell:          true,
+		Bio:           "(none set)",
+		id:            shasum(toHash),
+		addr:          host,
+		winWidth:      w,
+		lastTimestamp: time.Now(),
+		lastInteract:  time.Now(),
+		joinTime:      time.Now(),
+		srv:           srv,
+		format:        format}
+	u.inRoom.Store(srv.MainRoom)
+
+	go func() {
+		if winChan == nil { // no PTY
+			return
+		}
+		for win := range winChan {
+			if win.Width > 0 {
+				u.outputMutex.Lock()
+				u.winWidth = win.Width
+				u.outputMutex.Unlock()
+			}
+		}
+	}()
+
+	srv.Log.Println("连接 " + u.Name + " [" + u.id + "]")
+
+	if srv.isBanned(u.addr, u.id) {
+		srv.Log.Println("拒绝 " + u.Name + " [" + host + "] (禁止)")
+		u.writeln(Devbot, "**您被禁止了**. 如果您认为这是一个错误，请联系服务器管理员。包括以下信息: [ID "+u.id+"]")
+		s.Close()
+		return nil
+	}
+
+	switch action, list := srv.reputationAction(u.addr); action {
+	case RepReject:
+		srv.Log.Println("拒绝 " + u.Name + " [" + host + "] (信誉列表 " + list + ")")
+		u.writeln(Devbot, "**您的网络不允许连接到此服务器**. 如果您认为这是一个错误，请联系服务器管理员。包括以下信息: [ID "+u.id+"]")
+		return nil
+	case RepKeyAuth:
+		if pubkey == nil {
+			srv.Log.Println("拒绝 " + u.Name + " [" + host + "] (信誉列表 " + list + ", 没有密钥)")
+			u.writeln(Devbot, "来自您的网络的用户必须使用 SSH 密钥登录。请使用端口 "+strconv.Itoa(srv.Config().Port)+" 和您的密钥重新连接")
+			return nil
+		}
+	case RepReadOnly:
+		srv.Log.Println(u.Name + " [" + host + "] 只读 (信誉列表 " + list + ")")
+		u.readOnly = true
+	}
+
+	if reason := joinBlocked(u); reason != "" {
+		srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (" + reason + ")")
+		u.writeln(Devbot, reason)
+		return nil
+	}
+
+	if c := srv.Config(); c.Private {
+		_, isOnAllowlist := c.Allowlist[u.id]
+		_, isAdmin := c.Admins[u.id]
+		if !(isAdmin || isOnAllowlist) && !askForInvite(u) {
+			srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (不在允许列表中)")
+			u.writeln(Devbot, "您不在此私人服务器的允许列表中。如果这是错误的，请发送您的 ID("+u.id+") 给管理员王果冻，以便他添加您。")
+			s.Close()
+			return nil
+		}
+	}
+
+	throttle := srv.Config().Throttle
+	joins := srv.Conns.recordJoin(u.addr, u.id)
+	if throttle.BanAfter > 0 && joins > throttle.BanAfter {
+		srv.audit(nil, "ban", u.Name, u.id, "加入过于频繁")
+		u.banFor("", "加入过于频繁", "devbot", 0)
+		srv.MainRoom.broadcast(Devbot, u.Name+" 已被自动封禁. ID: "+u.id)
+		return nil
+	}
+	if throttle.ThrottleAfter > 0 && joins > throttle.ThrottleAfter {
+		if throttle.Action == "reject" {
+			srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (加入过于频繁)")
+			u.writeln(Devbot, "您加入得太频繁了，请一分钟后再试")
+			return nil
+		}
+		u.writeln(Devbot, "您加入得太频繁了，请稍候...")
+		time.Sleep(throttle.Delay)
+	}
+
+	clearCMD("", u) // always clear the screen on connect
+	holidaysCheck(u)
+
+	if rand.Float64() <= 0.4 { // 40% chance of being a random color
+		u.changeColor("random") //nolint:errcheck // we know "random" is a valid color
+	} else {
+		u.changeColor(Styles[rand.Intn(len(Styles))].name) //nolint:errcheck // we know this is a valid color
+	}
+	if rand.Float64() <= 0.1 { // 10% chance of a random bg color
+		u.changeColor("bg-random") //nolint:errcheck // we know "bg-random" is a valid color
+	}
+
+	u.Prompt = "\\u:\\S"
+	timeoutChan := make(chan bool)
+	timedOut := false
+	go func() { // timeout to minimize inactive connections
+		err := u.loadPrefs()
+		if err != nil && !timedOut {
+			srv.Log.Println("无法加载用户:", err)
+			return
+		}
+		if timedOut {
+			return
+		}
+		if err = u.pickUsernameQuietly(stripansi.Strip(u.Name)); err != nil && !timedOut {
+			srv.Log.Println(err)
+			s.Close()
+			s = nil // marker so we know to exit
+		}
+		timeoutChan <- true
+	}()
+
+	select {
+	case <-time.After(time.Minute):
+		srv.Log.Println("用户超时", stripansi.Strip(u.Name), "with ID", u.id)
+		timedOut = true
+		s.Close()
+		return nil
+	case <-timeoutChan:
+		if s == nil {
+			return nil
+		}
+	}
+
+	if needsChallenge(u) {
+		if format != nil {
+			srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (没有终端，无法完成挑战)")
+			u.writeln(Devbot, "新用户需要先用终端登录一次以完成挑战")
+			return nil
+		}
+		if !runChallenge(u) {
+			return nil
+		}
+	}
+
+	isAdmin := auth(u)
+	if reason := srv.Conns.acquire(u.id, u.addr, isAdmin, srv.Config().Throttle); reason != "" {
+		srv.Log.Println("拒绝 " + u.Name + " [" + u.id + "] (" + reason + ")")
+		u.writeln(Devbot, reason)
+		return nil
+	}
+	u.releaseSession = func() { srv.Conns.release(u.id, u.addr, isAdmin) }
+	return u
+}
+
+// Removes a User and prints a chat message
+func (u *User) close(msg string) {
+	if u.isBridge {
+		u.srv.Rooms.leave(u)
+		return
+	}
+	// close can be called from several goroutines at once, e.g. by a ban and the user's own repl. The others
+	// wait here until the leave message has been sent, so a session's handler doesn't return before then.
+	u.closeOnce.Do(func() {
+		room := u.srv.Rooms.leave(u)
+		if u.session != nil {
+			if u.releaseSession != nil {
+				u.releaseSession()
+			}
+			if u.outbox != nil { // let them see why they left, unless their connection is stuck
+				u.outbox.flush(outboxFlushTimeout)
+				u.outbox.shutdown()
+			}
+			if u.format != nil { // scripts can tell the session ended normally
+				u.session.Exit(0) //nolint:errcheck // the client might be gone
+			} else {
+				u.session.Close()
+			}
+			err := u.savePrefs()
+			if err != nil {
+				u.srv.Log.Println(err) // not much else we can do
+			}
+		}
+		if room == nil {
+			return
+		}
+		u.srv.federateRoster(room)
+		ev := chatEvent{Type: "leave", Name: stripansi.Strip(u.Name), Text: stripansi.Strip(msg)}
+		if msg == "" { // only users without a terminal are told
+			room.announce("", "", ev)
+			return
+		}
+		if time.Since(u.joinTime) > time.Minute/2 {
+			msg += ". 他们在线 " + printPrettyDuration(time.Since(u.joinTime))
+		}
+		room.announce("", Red.Paint(" <-- ")+msg, ev)
+	})
+}
+
+func (u *User) ban(banner string) { u.banFor(banner, "", "", 0) }
+
+// banFor bans u, recording the reason and the ID of whoever banned them.
+// A dur of 0 bans forever, otherwise the ban expires after dur, even across restarts.
+// banner is broadcast as the leave message.
+func (u *User) banFor(banner, reason, bannerID string, dur time.Duration) {
+	if u.addr == "" && u.id == "" {
+		return
+	}
+	b := Ban{Addr: u.addr, ID: u.id, Reason: reason, BannerID: bannerID, CreatedAt: time.Now()}
+	if dur > 0 {
+		b.ExpiresAt = b.CreatedAt.Add(dur)
+	}
+	u.srv.addBan(b)
+	uid := u.id
+	u.close(banner)
+	for _, us := range u.srv.Rooms.findByID(uid) { // close all other users that have this id
+		us.close("")
+	}
+}
+
+// mutedIn reports whether u is muted in r and whether the mute is a shadow mute, lifting it if it has expired.
+func (u *User) mutedIn(r *Room) (muted, shadow bool) {
+	u.muteMutex.Lock()
+	if !u.IsMuted {
+		u.muteMutex.Unlock()
+		return false, false
+	}
+	if !u.MutedUntil.IsZero() && time.Now().After(u.MutedUntil) {
+		u.muteMutex.Unlock()
+		u.unmute()
+		return false, false
+	}
+	defer u.muteMutex.Unlock()
+	return u.MutedRoom == "" || u.MutedRoom == r.name, u.MuteShadow
+}
+
+// mute mutes u for dur (0 means until unmuted). If room is not empty, u is only muted in that room.
+// Unless shadow is set, u is told they were muted.
+func (u *User) mute(dur time.Duration, shadow bool, room string, reason string) {
+	u.muteMutex.Lock()
+	u.IsMuted = true
+	u.MuteShadow = shadow
+	u.MutedRoom = room
+	u.MuteReason = reason
+	u.MutedUntil = time.Time{}
+	if dur > 0 {
+		u.MutedUntil = time.Now().Add(dur)
+	}
+	u.muteMutex.Unlock()
+	u.savePrefs() //nolint:errcheck // best effort, prefs are saved again when they leave
+	if !shadow {
+		u.writeln(Devbot, "你已被静音"+u.muteInfo())
+	}
+}
+
+// unmute lifts u's mute, returning whether it was a shadow mute
+func (u *User) unmute() (wasShadow bool) {
+	u.muteMutex.Lock()
+	wasShadow = u.MuteShadow
+	u.IsMuted = false
+	u.MuteShadow = false
+	u.MutedRoom = ""
+	u.MuteReason = ""
+	u.MutedUntil = time.Time{}
+	u.muteMutex.Unlock()
+	u.savePrefs() //nolint:errcheck // best effort
+	return wasShadow
+}
+
+// muteInfo describes the scope, remaining time and reason of u's mute
+func (u *User) muteInfo() string {
+	u.muteMutex.Lock()
+	defer u.muteMutex.Unlock()
+	s := ""
+	if u.MutedRoom != "" {
+		s += " 在 " + u.MutedRoom + " 中"
+	}
+	if !u.MutedUntil.IsZero() {
+		s += " (剩余 " + printPrettyDuration(time.Until(u.MutedUntil)) + ")"
+	}
+	if u.MuteReason != "" {
+		s += ": " + u.MuteReason
+	}
+	return s
+}
+
+func (u *User) writeln(senderName string, msg string) {
+	if u.format != nil {
+		u.sendEvent(u.eventFor(senderName, msg))
+		return
+	}
+	if strings.Contains(msg, u.Name) { // is a ping
+		msg += "\a"
+	}
+	msg = strings.ReplaceAll(msg, `\n`, "\n")
+	msg = strings.ReplaceAll(msg, `\`+"\n", `\n`) // let people escape newlines
+	thisUserIsDMSender := strings.HasSuffix(senderName, " <- ")
+	width := u.width()
+	var pending []string
+	prefix := ""
+	if senderName != "" {
+		if thisUserIsDMSender || strings.HasSuffix(senderName, " -> ") { // TODO: kinda hacky DM detection
+			prefix = senderName
+			msg, pending = u.srv.mdRender(msg, lenString(senderName), width, !u.ImagesAsLinks)
+			msg = senderName + strings.TrimSpace(msg)
+			if !thisUserIsDMSender {
+				msg += "\a"
+			}
+		} else {
+			prefix = senderName + ": "
+			msg, pending = u.srv.mdRender(msg, lenString(senderName)+2, width, !u.ImagesAsLinks)
+			msg = senderName + ": " + strings.TrimSpace(msg)
+		}
+	} else {
+		msg, pending = u.srv.mdRender(msg, 0, width, !u.ImagesAsLinks) // No sender
+		msg = strings.TrimSpace(msg)
+	}
+	u.outputMutex.Lock()
+	stamp := time.Since(u.lastTimestamp) > time.Minute
+	if stamp {
+		u.lastTimestamp = time.Now()
+	}
+	u.outputMutex.Unlock()
+	if stamp {
+		u.rWriteln(fmtTime(u, time.Now()))
+	}
+	if u.PingEverytime && senderName != u.Name && !thisUserIsDMSender {
+		msg += "\a"
+	}
+	if !u.Bell {
+		msg = strings.ReplaceAll(msg, "\a", "")
+	}
+	u.write([]byte(msg + "\n"))
+	for _, url := range pending {
+		url := url
+		u.srv.images.fetch(url, func(img image.Image, err error) { u.writeImage(prefix, url, img, err) })
+	}
+}
+
+// writeImage follows up a message that was sent with a placeholder for an image that was still loading
+func (u *User) writeImage(prefix, url string, img image.Image, err error) {
+	if err != nil {
+		u.write([]byte(prefix + url + " (" + err.Error() + ")\n"))
+		return
+	}
+	u.write([]byte(prefix + url + "\n" + imgRender(img, u.width()/2) + "\n"))
+}
+
+// Write to the right of the User's window
+func (u *User) rWriteln(msg string) {
+	if width := u.width(); width-lenString(msg) > 0 {
+		u.write([]byte(strings.Repeat(" ", width-lenString(msg)) + msg + "\n"))
+	} else {
+		u.write([]byte(msg + "\n"))
+	}
+}
+
+func (u *User) width() int {
+	u.outputMutex.Lock()
+	defer u.outputMutex.Unlock()
+	return u.winWidth
+}
+
+// pickUsernameQuietly changes the User's username, broadcasting a name change notification if needed.
+// An error is returned if the username entered had a bad word or reading input failed.
+func (u *User) pickUsername(possibleName string) error {
+	oldName := u.Name
+	err := u.pickUsernameQuietly(possibleName)
+	if err != nil {
+		return err
+	}
+	if stripansi.Strip(u.Name) == stripansi.Strip(oldName) {
+		return nil
+	}
+	msg := ""
+	if stripansi.Strip(u.Name) != possibleName { // is it not what the User entered? Otherwise the nick command already showed it.
+		msg = oldName + " 现在名称为 " + u.Name
+	}
+	room := u.room()
+	room.announce(Devbot, msg, chatEvent{Type: "nick", Name: stripansi.Strip(u.Name), OldName: stripansi.Strip(oldName)})
+	u.srv.federateRoster(room)
+	return nil
+}
+
+// pickUsernameQuietly is like pickUsername but does not broadcast a name change notification.
+func (u *User) pickUsernameQuietly(possibleName string) error {
+	possibleName = cleanName(possibleName)
+	var err error
+	for {
+		if possibleName == "" || strings.HasPrefix(possibleName, "#") || possibleName == "devbot" || strings.HasPrefix(possibleName, "@") {
+			u.writeln("", "您的用户名无效。请选择其他用户名:")
+		} else if otherUser, dup := userDuplicate(u.room(), possibleName); dup {
+			if otherUser == u {
+				break // allow selecting the same name as before the user tried to change it
+			}
+			u.writeln("", "您的用户名已被使用。请选择其他用户名:")
+		} else { // valid name
+			break
+		}
+
+		u.term.SetPrompt("> ")
+		possibleName, err = u.term.ReadLine()
+		if err != nil {
+			return err
+		}
+		possibleName = cleanName(possibleName)
+	}
+
+	possibleName = u.srv.rmBadWords(possibleName)
+
+	u.Name, _ = applyColorToData(possibleName, u.Color, u.ColorBG) //nolint:errcheck // we haven't changed the color so we know it's valid
+	u.formatPrompt()
+	return nil
+}
+
+func (u *User) displayPronouns() string {
+	result := ""
+	for i := 0; i < len(u.Pronouns); i++ {
+		str, _ := applyColorToData(u.Pronouns[i], u.Color, u.ColorBG)
+		result += "/" + str
+	}
+	if result == "" {
+		return result
+	}
+	return result[1:]
+}
+
+func (u *User) savePrefs() error {
+	u.muteMutex.Lock()
+	data, err := json.Marshal(u)
+	u.muteMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	// save the name without colors. u.Name isn't changed while marshalling since others may be reading it.
+	prefs := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &prefs); err != nil {
+		return err
+	}
+	if prefs["Name"], err = json.Marshal(stripansi.Strip(u.Name)); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(prefs); err != nil {
+		return err
+	}
+	saveTo := filepath.Join(u.srv.Config().DataDir, "user-prefs")
+	err = os.MkdirAll(saveTo, 0755)
+	if err != nil {
+		return err
+	}
+	saveTo = filepath.Join(saveTo, u.id+".json")
+	err = os.WriteFile(saveTo, data, 0644)
+	return err
+}
+
+func (u *User) loadPrefs() error {
+	save := filepath.Join(u.srv.Config().DataDir, "user-prefs", u.id+".json")
+
+	data, err := os.ReadFile(save)
+	if err != nil {
+		if os.IsNotExist(err) { // new user, nothing saved yet
+			return nil
+		}
+		return err
+	}
+
+	oldName := u.Name
+
+	err = json.Unmarshal(data, u) // won't overwrite private fields
+	if err != nil {
+		return err
+	}
+
+	newName := u.Name
+	u.Name = oldName
+
+	err = u.pickUsernameQuietly(newName)
+	if err != nil {
+		return err
+	}
+	err = u.changeColor(u.Color)
+	if err != nil {
+		return err
+	}
+	err = u.changeColor(u.ColorBG)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// room returns the room u is in. It can change at any time, so callers that need it to stay the same
+// should call room once.
+func (u *User) room() *Room {
+	return u.inRoom.Load()
+}
+
+func (u *User) changeRoom(r *Room) {
+	old := u.srv.Rooms.move(u, r)
+	if old == nil { // already in r, or they left
+		return
+	}
+	u.srv.federateRoster(old)
+	old.announce("", u.Name+" 正在加入 "+Blue.Paint(r.name), chatEvent{Type: "leave", Name: stripansi.Strip(u.Name), Text: "正在加入 " + r.name}) // tell the old room
+	if other, dup := userDuplicate(r, u.Name); dup && other != u {
+		u.pickUsername("") //nolint:errcheck // if reading input failed the next repl will err out
+	}
+	r.announce("", Green.Paint(" --> ")+u.Name+" 已加入 "+Blue.Paint(r.name), chatEvent{Type: "join", Name: stripansi.Strip(u.Name)})
+	u.srv.federateRoster(r)
+}
+
+func (u *User) formatPrompt() {
+	u.formattedPrompt = ""
+	last_escaped := false
+	for _, c := range u.Prompt {
+		if c == '\\' {
+			last_escaped = true
+		} else if last_escaped {
+			last_escaped = false
+			switch c {
+			case 'u':
+				u.formattedPrompt += u.Name
+			case 'w':
+				u.formattedPrompt += copyColor(u.room().name, u.Name)
+			case 'W':
+				if name := u.room().name; name == "#main" {
+					u.formattedPrompt += copyColor("~", u.Name)
+				} else {
+					u.formattedPrompt += copyColor("~/"+name[1:], u.Name)
+				}
+			case 't', 'T':
+				u.formattedPrompt += fmtTime(u, time.Now())
+			case 'h', 'H':
+				u.formattedPrompt += copyColor("devzat", u.Name)
+			case 'S':
+				u.formattedPrompt += " "
+			case '$':
+				if auth(u) {
+					u.formattedPrompt += "#"
+				} else {
+					u.formattedPrompt += "$"
+				}
+			default:
+				u.formattedPrompt += string(c)
+			}
+		} else {
+			u.formattedPrompt += string(c)
+		}
+	}
+	u.showPrompt()
+}
+
+func (u *User) showPrompt() {
+	u.term.SetPrompt(u.formattedPrompt)
+}
+
+func (u *User) repl() {
+	for {
+		u.lastInteract = time.Now()
+		line, err := u.term.ReadLine()
+		if err == io.EOF {
+			u.close(u.Name + " 已离开聊天")
+			return
+		}
+
+		line += "\n"
+		hasNewlines := false
+		//oldPrompt := u.Name + ": "
+		for err == terminal.ErrPasteIndicator {
+			hasNewlines = true
+			//u.term.SetPrompt(strings.Repeat(" ", lenString(u.Name)+2))
+			u.term.SetPrompt("")
+			additionalLine := ""
+			additionalLine, err = u.term.ReadLine()
+			additionalLine = strings.ReplaceAll(additionalLine, `\n`, `\\n`)
+			//additionalLine = strings.ReplaceAll(additionalLine, "\t", strings.Repeat(" ", 8))
+			line += additionalLine + "\n"
+		}
+		if err != nil {
+			u.srv.Log.Println(u.Name, err)
+			u.close(u.Name + " 由于错误已离开聊天: " + err.Error())
+			return
+		}
+		if len(line) > maxMsgLen { // limit msg len as early as possible.
+			line = line[0:maxMsgLen]
+		}
+		line = strings.TrimSpace(line)
+
+		u.showPrompt()
+
+		if hasNewlines {
+			calculateLinesTaken(u, u.Name+": "+line, u.width())
+		} else {
+			u.write([]byte(strings.Repeat("\033[A\033[2K", int(math.Ceil(float64(lenString(u.Name+line)+2)/(float64(u.width()))))))) // basically, ceil(length of line divided by term width)
+		}
+
+		if line == "" {
+			continue
+		}
+		if !u.handleLine(line, runCommands) {
+			return
+		}
+	}
+}
+
+// handleLine applies the spam and probation limits to a line u sent and runs it with run, which is runCommands
+// or sendMessage. It returns false if u was disconnected.
+func (u *User) handleLine(line string, run func(line string, u *User)) bool {
+	u.srv.antispamMutex.Lock()
+	u.srv.AntispamMessages[u.id]++
+	sent := u.srv.AntispamMessages[u.id]
+	u.srv.antispamMutex.Unlock()
+	time.AfterFunc(15*time.Second, func() {
+		u.srv.antispamMutex.Lock()
+		u.srv.AntispamMessages[u.id]--
+		u.srv.antispamMutex.Unlock()
+	})
+	if sent >= 30 {
+		u.room().broadcast(Devbot, u.Name+", 停止发送垃圾信息，否则您可能会被封禁.")
+	}
+	if sent >= 50 {
+		if !u.srv.isBanned(u.addr, u.id) {
+			u.srv.audit(nil, "ban", u.Name, u.id, "发送垃圾信息")
+			u.srv.addBan(Ban{Addr: u.addr, ID: u.id, Reason: "发送垃圾信息", BannerID: "devbot", CreatedAt: time.Now()})
+		}
+		u.writeln(Devbot, "触发反垃圾邮件")
+		u.close(Red.Paint(u.Name + " 已被禁止发送垃圾邮件"))
+		return false
+	}
+	if !u.probationAllows() {
+		u.writeln(Devbot, "新用户每分钟最多可以发送 "+strconv.Itoa(u.srv.Config().Challenge.ProbationMessages)+" 条消息")
+		return true
+	}
+	run(line, u)
+	return true
+}
+
+// may contain a bug ("may" because it could be the terminal's fault)
+func calculateLinesTaken(u *User, s string, width int) {
+	s = stripansi.Strip(s)
+	//fmt.Println("`"+s+"`", "width", width)
+	pos := 0
+	//lines := 1
+	u.write([]byte("\033[A\033[2K"))
+	currLine := ""
+	for _, c := range s {
+		pos++
+		currLine += string(c)
+		if c == '\t' {
+			pos += 8
+		}
+		if c == '\n' || pos > width {
+			pos = 1
+			//lines++
+			u.write([]byte("\033[A\033[2K"))
+		}
+		//fmt.Println(string(c), "`"+currLine+"`", "pos", pos, "lines", lines)
+	}
+	//return lines
+}
+
+// bansContains reports if the addr or id is found in the bans list. Expired bans are ignored.
+// Bans with a CIDR range as the address match any addr inside that range.
+func bansContains(b []Ban, addr string, id string) bool {
+	for i := 0; i < len(b); i++ {
+		if b[i].expired() {
+			continue
+		}
+		if addrMatches(b[i].Addr, addr) || (b[i].ID != "" && b[i].ID == id) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned is like bansContains but checks the server's bans list
+func (srv *Server) isBanned(addr string, id string) bool {
+	srv.bansMutex.RLock()
+	defer srv.bansMutex.RUnlock()
+	return bansContains(srv.Bans, addr, id)
+}
+
+// addBan appends b to the server's bans list and saves it
+func (srv *Server) addBan(b Ban) {
+	srv.bansMutex.Lock()
+	srv.Bans = append(srv.Bans, b)
+	srv.bansMutex.Unlock()
+	srv.saveBans()
+}
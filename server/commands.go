@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"fmt"
@@ -7,12 +7,12 @@ import (
 	_ "image/png"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/alecthomas/chroma"
@@ -58,11 +58,25 @@ var (
 		{"admins", adminsCMD, "", "Print the ID (hashed key) for all admins"},
 		{"eg-code", exampleCodeCMD, "[big]", "Example syntax-highlighted code"},
 		{"lsbans", listBansCMD, "", "List banned IDs"},
-		{"ban", banCMD, "`user` [`reason`] [`dur`]", "Ban <user> and optionally, with a reason or duration (admin)"},
-		{"unban", unbanCMD, "IP|ID [dur]", "Unban a person (admin)"},
-		{"mute", muteCMD, "`user`", "Mute <user> (admin)"},
+		{"ban", banCMD, "`user`|IP|CIDR [`reason`] [`dur`]", "Ban <user> or a network and optionally, with a reason or duration (admin)"},
+		{"unban", unbanCMD, "IP|ID|CIDR", "Unban a person or network (admin)"},
+		{"mute", muteCMD, "[-s] [#`room`] `user` [`dur`] [`reason`]", "Mute <user>, optionally only in a room, for a duration or silently with -s (admin)"},
 		{"unmute", unmuteCMD, "`user`", "Unmute <user> (admin)"},
 		{"kick", kickCMD, "`user`", "Kick <user> (admin)"},
+		{"report", reportCMD, "[@`user`|#`msg id`] [`reason`]", "Report a user or message to the admins, or list message IDs. Admins can also use report show|resolve `n`"}, // won't actually run, here just to show in docs
+		{"reports", reportsCMD, "", "List open reports (admin)"},
+		{"filter", filterCMD, "list|reload|add|remove|policy", "Edit word filters and per-room censorship policy (admin)"}, // won't actually run, here just to show in docs
+		{"op", opCMD, "@`user`|`id` [`note`]", "Make <user> an admin (admin)"},
+		{"deop", deopCMD, "@`user`|`id`", "Remove <user> from the admins (admin)"},
+		{"allow", allowCMD, "@`user`|`id` [`note`]", "Add <user> to the allowlist of a private server (admin)"},
+		{"disallow", disallowCMD, "@`user`|`id`", "Remove <user> from the allowlist (admin)"},
+		{"allowlist", allowlistCMD, "", "List the IDs on the allowlist (admin)"},
+		{"invite", inviteCMD, "create [`uses`] [`expiry`] [member|admin]|list|revoke `code`", "Manage invite codes for a private server (admin)"},
+		{"lockdown", lockdownCMD, "[-p] [`reason`]|off|status", "Reject new connections, and with -p only let admins and allowlisted users post (admin)"},
+		{"maintenance", maintenanceCMD, "`time`|off [`reason`]", "Count down to maintenance, then block joins until it is lifted (admin)"},
+		{"reload", reloadCMD, "", "Reload the config from disk (admin)"},
+		{"audit", auditCMD, "[@`user`] [`action`] [`since`]", "Query the moderation audit log (admin)"},
+		{"images", imagesCMD, "on|off", "Render images in messages (on) or show them as links (off)"},
 		{"art", asciiArtCMD, "", "Show some panda art"},
 		{"pwd", pwdCMD, "", "Show your current room"},
 		//		{"sixel", sixelCMD, "<png url>", "Render an image in high quality"},
@@ -92,6 +106,11 @@ const (
 	MaxBioLen      = 300
 )
 
+// validRoomName reports whether name can be used as a room name as is
+func validRoomName(name string) bool {
+	return len(name) > 1 && len(name) <= MaxRoomNameLen && strings.HasPrefix(name, "#") && !strings.ContainsAny(name, " \t\n")
+}
+
 func init() {
 	MainCMDs = append(MainCMDs, CMD{"cmds", commandsCMD, "", "Show this message"}) // avoid initialization loop
 }
@@ -101,18 +120,20 @@ func init() {
 // It also accepts a boolean indicating if the line of input is from slack, in
 // which case some commands will not be run (such as ./tz and ./exit)
 func runCommands(line string, u *User) {
-	line = rmBadWords(line)
-
-	if u.IsMuted {
-		u.writeln(u.Name, line)
-		return
-	}
-
 	if line == "" {
 		return
 	}
-	defer protectFromPanic()
+	defer u.srv.protectFromPanic()
 	currCmd := strings.Fields(line)[0]
+	if currCmd == "filter" { // before filtering so filtered words can be edited, and not broadcast so they aren't shown
+		filterCMD(strings.TrimSpace(strings.TrimPrefix(line, "filter")), u)
+		return
+	}
+	room := u.room() // the message goes here even if a command moves u at the same time
+	line, onlyToSelf, ok := u.screenLine(room, line, readOnlyAllowed(currCmd, u))
+	if !ok {
+		return
+	}
 	if u.messaging != nil && currCmd != "=" && currCmd != "cd" && currCmd != "exit" && currCmd != "pwd" { // the commands allowed in a private dm room
 		dmRoomCMD(line, u)
 		return
@@ -139,44 +160,108 @@ func runCommands(line string, u *User) {
 	case "mute":
 		muteCMD(strings.TrimSpace(strings.TrimPrefix(line, "mute")), u)
 		return
+	case "report": // reports are private
+		reportCMD(strings.TrimSpace(strings.TrimPrefix(line, "report")), u)
+		return
 	}
 
-	if u.isBridge {
-		u.room.broadcastNoBridges(u.Name, line)
+	if onlyToSelf { // commands still work, but only the user sees them
+		u.writeln(u.Name, line)
 	} else {
-		u.room.broadcast(u.Name, line)
+		u.post(room, line)
 	}
 
-	devbotChat(u.room, line)
-
 	args := strings.TrimSpace(strings.TrimPrefix(line, currCmd))
 
 	if runPluginCMDs(u, currCmd, args) {
 		return
 	}
 
-	if cmd, ok := getCMD(currCmd); ok {
+	if cmd, ok := u.srv.getCMD(currCmd); ok {
 		if cmd.argsInfo != "" || args == "" {
 			cmd.run(args, u)
 		}
 	}
 }
 
+// sendMessage sends line to u's room as a message, even if it looks like a command
+func sendMessage(line string, u *User) {
+	if line == "" {
+		return
+	}
+	defer u.srv.protectFromPanic()
+	room := u.room()
+	line, _, ok := u.screenLine(room, line, false)
+	if !ok {
+		return
+	}
+	if u.messaging != nil {
+		dmRoomCMD(line, u)
+		return
+	}
+	line = getMiddlewareResult(u, line)
+	sendMessageToPlugins(line, u)
+	u.post(room, line)
+}
+
+// screenLine applies the word filter, posting restrictions and probation to a line u sent to room. If u
+// can't post there, the line is only run if canRun is set, and then onlyToSelf is set too. ok is false if
+// the line shouldn't be run, after u has been told why.
+func (u *User) screenLine(room *Room, line string, canRun bool) (screened string, onlyToSelf, ok bool) {
+	line, filtered := u.srv.filterMessage(room, line)
+	if filtered {
+		u.writeln(Devbot, "你的消息包含不允许的词语，没有发送")
+		return "", false, false
+	}
+	cantPost := postBlocked(u)
+	muted, shadow := u.mutedIn(room)
+	if (cantPost != "" || muted) && !canRun {
+		switch {
+		case cantPost != "":
+			u.writeln(Devbot, cantPost)
+		case shadow:
+			u.writeln(u.Name, line) // make it look like the message was sent
+		default:
+			u.writeln(Devbot, "你已被静音"+u.muteInfo())
+		}
+		return "", false, false
+	}
+	if u.onProbation() {
+		line = stripLinks(line)
+	}
+	return line, cantPost != "" || muted, true
+}
+
+// post shows line from u to everyone in room
+func (u *User) post(room *Room, line string) {
+	room.remember(u, line)
+	if u.isBridge {
+		room.broadcastNoBridges(u.Name, line)
+	} else {
+		room.broadcast(u.Name, line)
+		u.srv.federate(room, u, line)
+	}
+	devbotChat(room, line)
+}
+
 func dmCMD(rest string, u *User) {
 	restSplit := strings.Fields(rest)
 	if len(restSplit) < 2 {
 		u.writeln(Devbot, "你得有个信息，伙计")
 		return
 	}
-	peer, ok := findUserByName(u.room, restSplit[0])
+	msg := strings.TrimSpace(strings.TrimPrefix(rest, restSplit[0]))
+	peer, ok := findUserByName(u.room(), restSplit[0])
+	if !ok && u.srv.dmRemote(u, restSplit[0], msg) {
+		return
+	}
 	if !ok {
 		u.writeln(Devbot, "没有这个人哈哈，你想私信谁？（您可能在错误的房间里)")
 		return
 	}
-	msg := strings.TrimSpace(strings.TrimPrefix(rest, restSplit[0]))
 	u.writeln(peer.Name+" <- ", msg)
 	if u == peer {
-		devbotRespond(u.room, []string{"你一定是真的寂寞，私信自己.",
+		devbotRespond(u.room(), []string{"你一定是真的寂寞，私信自己.",
 			"别担心，我不会评头论足 :wink:",
 			"真的?",
 			"真是个白痴"}, 30)
@@ -191,55 +276,55 @@ func hangCMD(rest string, u *User) {
 			u.writeln(u.Name, "hang "+rest)
 			u.writeln(Devbot, "(该词不会显示)")
 		}
-		hangGame = &hangman{rest, 15, " "} // default value of guesses so empty space is given away
-		u.room.broadcast(Devbot, u.Name+" 开始了新的刽子手游戏！ 用 hang 猜字母 <letter>")
-		u.room.broadcast(Devbot, "```\n"+hangPrint(hangGame)+"\nTries: "+strconv.Itoa(hangGame.triesLeft)+"\n```")
+		u.srv.hangGame = &hangman{rest, 15, " "} // default value of guesses so empty space is given away
+		u.room().broadcast(Devbot, u.Name+" 开始了新的刽子手游戏！ 用 hang 猜字母 <letter>")
+		u.room().broadcast(Devbot, "```\n"+hangPrint(u.srv.hangGame)+"\nTries: "+strconv.Itoa(u.srv.hangGame.triesLeft)+"\n```")
 		return
 	}
 	if !u.isBridge {
-		u.room.broadcast(u.Name, "hang "+rest)
+		u.room().broadcast(u.Name, "hang "+rest)
 	}
-	if strings.Trim(hangGame.word, hangGame.guesses) == "" {
-		u.room.broadcast(Devbot, "游戏已结束。使用 hang 开始新游戏 <word>")
+	if strings.Trim(u.srv.hangGame.word, u.srv.hangGame.guesses) == "" {
+		u.room().broadcast(Devbot, "游戏已结束。使用 hang 开始新游戏 <word>")
 		return
 	}
 	if len(rest) == 0 {
-		u.room.broadcast(Devbot, "使用 hang 开始新游戏<word>，或使用 hang 开始猜测 <letter>")
+		u.room().broadcast(Devbot, "使用 hang 开始新游戏<word>，或使用 hang 开始猜测 <letter>")
 		return
 	}
-	if hangGame.triesLeft == 0 {
-		u.room.broadcast(Devbot, "不要再尝试了！这个词是 "+hangGame.word)
+	if u.srv.hangGame.triesLeft == 0 {
+		u.room().broadcast(Devbot, "不要再尝试了！这个词是 "+u.srv.hangGame.word)
 		return
 	}
-	if strings.Contains(hangGame.guesses, rest) {
-		u.room.broadcast(Devbot, "您已经猜到了 "+rest)
+	if strings.Contains(u.srv.hangGame.guesses, rest) {
+		u.room().broadcast(Devbot, "您已经猜到了 "+rest)
 		return
 	}
-	hangGame.guesses += rest
-	if !(strings.Contains(hangGame.word, rest)) {
-		hangGame.triesLeft--
+	u.srv.hangGame.guesses += rest
+	if !(strings.Contains(u.srv.hangGame.word, rest)) {
+		u.srv.hangGame.triesLeft--
 	}
-	display := hangPrint(hangGame)
-	u.room.broadcast(Devbot, "```\n"+display+"\nTries: "+strconv.Itoa(hangGame.triesLeft)+"\n```")
-	if strings.Trim(hangGame.word, hangGame.guesses) == "" {
-		u.room.broadcast(Devbot, "没问题！这个词是 "+hangGame.word)
-	} else if hangGame.triesLeft == 0 {
-		u.room.broadcast(Devbot, "不要再尝试了！这个词是 "+hangGame.word)
+	display := hangPrint(u.srv.hangGame)
+	u.room().broadcast(Devbot, "```\n"+display+"\nTries: "+strconv.Itoa(u.srv.hangGame.triesLeft)+"\n```")
+	if strings.Trim(u.srv.hangGame.word, u.srv.hangGame.guesses) == "" {
+		u.room().broadcast(Devbot, "没问题！这个词是 "+u.srv.hangGame.word)
+	} else if u.srv.hangGame.triesLeft == 0 {
+		u.room().broadcast(Devbot, "不要再尝试了！这个词是 "+u.srv.hangGame.word)
 	}
 }
 
 func clearCMD(_ string, u *User) {
-	u.term.Write([]byte("\033[H\033[2J"))
+	u.write([]byte("\033[H\033[2J"))
 }
 
 func usersCMD(_ string, u *User) {
-	u.room.broadcast("", printUsersInRoom(u.room))
+	u.reply("", printUsersInRoom(u.room()))
 }
 
 func dmRoomCMD(line string, u *User) {
 	u.writeln(u.messaging.Name+" <- ", line)
 	if u == u.messaging {
-		devbotRespond(u.room, []string{"你一定是真的寂寞，私信自己.",
+		devbotRespond(u.room(), []string{"你一定是真的寂寞，私信自己.",
 			"别担心，我不会评判 :wink:",
 			"真的?",
 			"真是个白痴"}, 30)
@@ -258,7 +343,7 @@ func devmonkCMD(_ string, u *User) {
 	start := time.Now()
 	line, err := u.term.ReadLine()
 	if err == term.ErrPasteIndicator { // TODO: doesn't work for some reason?
-		u.room.broadcast(Devbot, "SMH 你知道吗？ "+u.Name+" 试图在打字游戏中作弊?")
+		u.room().broadcast(Devbot, "SMH 你知道吗？ "+u.Name+" 试图在打字游戏中作弊?")
 		return
 	}
 	dur := time.Since(start)
@@ -287,7 +372,7 @@ func devmonkCMD(_ string, u *User) {
 		}
 	}
 
-	u.room.broadcast(Devbot, "好 "+u.Name+", 你输入了 "+dur.Truncate(time.Second/10).String()+" 所以你的速度是 "+
+	u.room().broadcast(Devbot, "好 "+u.Name+", 你输入了 "+dur.Truncate(time.Second/10).String()+" 所以你的速度是 "+
 		strconv.FormatFloat(
 			float64(len(strings.Fields(text)))/dur.Minutes(), 'f', 1, 64,
 		)+" wpm"+" with accuracy "+strconv.FormatFloat(accuracy, 'f', 1, 64)+"%",
@@ -296,37 +381,37 @@ func devmonkCMD(_ string, u *User) {
 
 func ticCMD(rest string, u *User) {
 	if rest == "" {
-		u.room.broadcast(Devbot, "开始新的井字游戏！第一个玩家始终是 X.")
-		u.room.broadcast(Devbot, "使用 tic 玩游戏 <cell num>")
-		currentPlayer = tictactoe.X
-		tttGame = new(tictactoe.Board)
-		u.room.broadcast(Devbot, "```\n"+" 1 │ 2 │ 3\n───┼───┼───\n 4 │ 5 │ 6\n───┼───┼───\n 7 │ 8 │ 9\n"+"\n```")
+		u.room().broadcast(Devbot, "开始新的井字游戏！第一个玩家始终是 X.")
+		u.room().broadcast(Devbot, "使用 tic 玩游戏 <cell num>")
+		u.srv.currentPlayer = tictactoe.X
+		u.srv.tttGame = new(tictactoe.Board)
+		u.room().broadcast(Devbot, "```\n"+" 1 │ 2 │ 3\n───┼───┼───\n 4 │ 5 │ 6\n───┼───┼───\n 7 │ 8 │ 9\n"+"\n```")
 		return
 	}
 	m, err := strconv.Atoi(rest)
 	if err != nil {
-		u.room.broadcast(Devbot, "确保你用的是数字，乐")
+		u.room().broadcast(Devbot, "确保你用的是数字，乐")
 		return
 	}
 	if m < 1 || m > 9 {
-		u.room.broadcast(Devbot, "移动是 1 到 9 之间的数字!")
+		u.room().broadcast(Devbot, "移动是 1 到 9 之间的数字!")
 		return
 	}
-	err = tttGame.Apply(tictactoe.Move(m-1), currentPlayer)
+	err = u.srv.tttGame.Apply(tictactoe.Move(m-1), u.srv.currentPlayer)
 	if err != nil {
-		u.room.broadcast(Devbot, err.Error())
+		u.room().broadcast(Devbot, err.Error())
 		return
 	}
-	u.room.broadcast(Devbot, "```\n"+tttPrint(tttGame.Cells)+"\n```")
-	if currentPlayer == tictactoe.X {
-		currentPlayer = tictactoe.O
+	u.room().broadcast(Devbot, "```\n"+tttPrint(u.srv.tttGame.Cells)+"\n```")
+	if u.srv.currentPlayer == tictactoe.X {
+		u.srv.currentPlayer = tictactoe.O
 	} else {
-		currentPlayer = tictactoe.X
+		u.srv.currentPlayer = tictactoe.X
 	}
-	if !(tttGame.Condition() == tictactoe.NotEnd) {
-		u.room.broadcast(Devbot, tttGame.Condition().String())
-		currentPlayer = tictactoe.X
-		tttGame = new(tictactoe.Board)
+	if !(u.srv.tttGame.Condition() == tictactoe.NotEnd) {
+		u.room().broadcast(Devbot, u.srv.tttGame.Condition().String())
+		u.srv.currentPlayer = tictactoe.X
+		u.srv.tttGame = new(tictactoe.Board)
 	}
 }
 
@@ -339,25 +424,25 @@ func bellCMD(rest string, u *User) {
 	case "off":
 		u.Bell = false
 		u.PingEverytime = false
-		u.room.broadcast("", "bell off (never)")
+		u.reply("", "bell off (never)")
 	case "on":
 		u.Bell = true
 		u.PingEverytime = false
-		u.room.broadcast("", "bell on (pings)")
+		u.reply("", "bell on (pings)")
 	case "all":
 		u.Bell = true
 		u.PingEverytime = true
-		u.room.broadcast("", "bell all (every message)")
+		u.reply("", "bell all (every message)")
 	case "", "status":
 		if u.PingEverytime {
-			u.room.broadcast("", "bell all (every message)")
+			u.reply("", "bell all (every message)")
 		} else if u.Bell {
-			u.room.broadcast("", "bell on (pings)")
+			u.reply("", "bell on (pings)")
 		} else { // bell is off
-			u.room.broadcast("", "bell off (never)")
+			u.reply("", "bell off (never)")
 		}
 	default:
-		u.room.broadcast(Devbot, "您的选项包括 off、on 和 all")
+		u.reply(Devbot, "您的选项包括 off、on 和 all")
 	}
 }
 
@@ -371,44 +456,39 @@ func cdCMD(rest string, u *User) {
 		}
 	}
 	if rest == ".." { // cd back into the main room
-		u.room.broadcast(u.Name, "cd "+rest)
-		if u.room != MainRoom {
-			u.changeRoom(MainRoom)
+		u.reply(u.Name, "cd "+rest)
+		if u.room() != u.srv.MainRoom {
+			u.changeRoom(u.srv.MainRoom)
 		}
 		return
 	}
 	if strings.HasPrefix(rest, "#") {
-		u.room.broadcast(u.Name, "cd "+rest)
+		u.reply(u.Name, "cd "+rest)
 		if len(rest) > MaxRoomNameLen {
 			rest = rest[0:MaxRoomNameLen]
-			u.room.broadcast(Devbot, "房间名称的长度是有限的，所以我将其缩短为 "+rest+".")
-		}
-		if v, ok := Rooms[rest]; ok {
-			u.changeRoom(v)
-		} else {
-			Rooms[rest] = &Room{rest, make([]*User, 0, 10), sync.RWMutex{}}
-			u.changeRoom(Rooms[rest])
+			u.reply(Devbot, "房间名称的长度是有限的，所以我将其缩短为 "+rest+".")
 		}
+		u.changeRoom(u.srv.Rooms.getOrCreate(rest))
 		return
 	}
 	if rest == "" {
-		u.room.broadcast(u.Name, "cd "+rest)
+		u.reply(u.Name, "cd "+rest)
 		type kv struct {
-			roomName   string
+			room       *Room
 			numOfUsers int
 		}
 		var ss []kv
-		for k, v := range Rooms {
-			ss = append(ss, kv{k, len(v.users)})
+		for _, r := range u.srv.Rooms.all() {
+			ss = append(ss, kv{r, r.userCount()})
 		}
 		sort.Slice(ss, func(i, j int) bool {
 			return ss[i].numOfUsers > ss[j].numOfUsers
 		})
 		roomsInfo := ""
 		for _, kv := range ss {
-			roomsInfo += Blue.Paint(kv.roomName) + ": " + printUsersInRoom(Rooms[kv.roomName]) + "  \n"
+			roomsInfo += Blue.Paint(kv.room.name) + ": " + printUsersInRoom(kv.room) + "  \n"
 		}
-		u.room.broadcast("", "聊天室和用户  \n"+strings.TrimSpace(roomsInfo))
+		u.reply("", "聊天室和用户  \n"+strings.TrimSpace(roomsInfo))
 		return
 	}
 	name := strings.Fields(rest)[0]
@@ -416,7 +496,7 @@ func cdCMD(rest string, u *User) {
 		u.writeln(Devbot, "你认为人们的名字是空的?")
 		return
 	}
-	peer, ok := findUserByName(u.room, name)
+	peer, ok := findUserByName(u.room(), name)
 	if !ok {
 		u.writeln(Devbot, "没有这个人哈哈，你想私信谁？（您可能在错误的房间里)")
 		return
@@ -429,7 +509,7 @@ func tzCMD(tzArg string, u *User) {
 	defer u.formatPrompt()
 	if tzArg == "" {
 		u.Timezone.Location = nil
-		u.room.broadcast(Devbot, "启用的相对时间!")
+		u.reply(Devbot, "启用的相对时间!")
 		return
 	}
 	tzArgList := strings.Fields(tzArg)
@@ -447,11 +527,11 @@ func tzCMD(tzArg string, u *User) {
 	var err error
 	u.Timezone.Location, err = time.LoadLocation(tz)
 	if err != nil {
-		u.room.broadcast(Devbot, "你在那里有奇怪的时区，使用格式 大陆/城市，通常的美国时区（PST、PDT、EST、EDT...）或勾选 nodatime.org/TimeZones！")
+		u.reply(Devbot, "你在那里有奇怪的时区，使用格式 大陆/城市，通常的美国时区（PST、PDT、EST、EDT...）或勾选 nodatime.org/TimeZones！")
 		return
 	}
 	u.FormatTime24 = len(tzArgList) == 2 && tzArgList[1] == "24h"
-	u.room.broadcast(Devbot, "更改了您的时区!")
+	u.reply(Devbot, "更改了您的时区!")
 }
 
 func bioCMD(line string, u *User) {
@@ -476,21 +556,21 @@ func bioCMD(line string, u *User) {
 			}
 		}
 	}
-	target, ok := findUserByName(u.room, line)
+	target, ok := findUserByName(u.room(), line)
 	if !ok {
-		u.room.broadcast(Devbot, "谁???")
+		u.room().broadcast(Devbot, "谁???")
 		return
 	}
-	u.room.broadcast("", target.Bio)
+	u.room().broadcast("", target.Bio)
 }
 
 func idCMD(line string, u *User) {
-	victim, ok := findUserByName(u.room, line)
+	victim, ok := findUserByName(u.room(), line)
 	if !ok {
-		u.room.broadcast("", "未找到用户")
+		u.room().broadcast("", "未找到用户")
 		return
 	}
-	u.room.broadcast("", victim.id)
+	u.room().broadcast("", victim.id)
 }
 
 func nickCMD(line string, u *User) {
@@ -507,34 +587,68 @@ func promptCMD(line string, u *User) {
 
 func listBansCMD(_ string, u *User) {
 	msg := "Bans by ID:  \n"
-	for i := 0; i < len(Bans); i++ {
-		msg += Cyan.Cyan(strconv.Itoa(i+1)) + ". " + Bans[i].ID + "  \n"
+	u.srv.bansMutex.RLock()
+	i := 1
+	for _, b := range u.srv.Bans {
+		if b.expired() {
+			continue
+		}
+		if b.ID != "" {
+			msg += Cyan.Cyan(strconv.Itoa(i)) + ". " + b.ID
+		} else { // network ban
+			msg += Cyan.Cyan(strconv.Itoa(i)) + ". " + b.Addr
+		}
+		if b.Reason != "" {
+			msg += "\t原因: " + b.Reason
+		}
+		if b.ExpiresAt.IsZero() {
+			msg += "\t永久"
+		} else {
+			msg += "\t剩余 " + printPrettyDuration(time.Until(b.ExpiresAt))
+		}
+		msg += "  \n"
+		i++
 	}
-	u.room.broadcast(Devbot, msg)
+	u.srv.bansMutex.RUnlock()
+	u.room().broadcast(Devbot, msg)
 }
 
 func unbanCMD(toUnban string, u *User) {
 	if !auth(u) {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	toUnban = strings.TrimSpace(toUnban)
+	if toUnban == "" {
+		u.room().broadcast(Devbot, "用法: unban IP|ID|CIDR")
 		return
 	}
 
-	if unbanIDorIP(toUnban) {
-		u.room.broadcast(Devbot, "被解禁者: "+toUnban)
-		saveBans()
+	if isCIDR(toUnban) { // stored in canonical form, with single addresses stored as a bare IP like banNetwork does
+		n, _ := parseNetwork(toUnban)
+		toUnban = n.String()
+		if ones, bits := n.Mask.Size(); ones == bits {
+			toUnban = n.IP.String()
+		}
+	}
+	if u.srv.unbanIDorIP(toUnban) {
+		u.srv.audit(u, "unban", toUnban, "", "")
+		u.room().broadcast(Devbot, "被解禁者: "+toUnban)
+		u.srv.saveBans()
 	} else {
-		u.room.broadcast(Devbot, "我找不到那个人")
+		u.room().broadcast(Devbot, "我找不到那个人")
 	}
 }
 
 // unbanIDorIP unbans an ID or an IP, but does NOT save bans to the bans file.
 // It returns whether the person was found, and so, whether the bans slice was modified.
-func unbanIDorIP(toUnban string) bool {
-	for i := 0; i < len(Bans); i++ {
-		if Bans[i].ID == toUnban || Bans[i].Addr == toUnban { // allow unbanning by either ID or IP
+func (srv *Server) unbanIDorIP(toUnban string) bool {
+	srv.bansMutex.Lock()
+	defer srv.bansMutex.Unlock()
+	for i := 0; i < len(srv.Bans); i++ {
+		if (srv.Bans[i].ID != "" && srv.Bans[i].ID == toUnban) || (srv.Bans[i].Addr != "" && srv.Bans[i].Addr == toUnban) { // allow unbanning by either ID or IP
 			// remove this ban
-			Bans = append(Bans[:i], Bans[i+1:]...)
-			saveBans()
+			srv.Bans = append(srv.Bans[:i], srv.Bans[i+1:]...)
 			return true
 		}
 	}
@@ -544,113 +658,192 @@ func unbanIDorIP(toUnban string) bool {
 func banCMD(line string, u *User) {
 	split := strings.Split(line, " ")
 	if len(split) == 0 {
-		u.room.broadcast(Devbot, "您要禁止哪个用户?")
+		u.room().broadcast(Devbot, "您要禁止哪个用户?")
 		return
 	}
 	var victim *User
 	var ok bool
 	banner := u.Name
-	banReason := "" // Initial ban reason is an empty string
+	bannerID := u.id
+	banReason, dur := banReasonAndDuration(line, split)
+	durInfo := ""
+	if dur > 0 {
+		durInfo = " 为 " + dur.String()
+	}
 
 	if split[0] == "devbot" {
-		u.room.broadcast(Devbot, "你真的觉得你可以封禁我吗，渺小的人类?")
+		u.room().broadcast(Devbot, "你真的觉得你可以封禁我吗，渺小的人类?")
 		victim = u // mwahahahaha - devbot
 		banner = Devbot
+		bannerID = "devbot"
 	} else if !auth(u) {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
-	} else if victim, ok = findUserByName(u.room, split[0]); !ok {
-		u.room.broadcast("", "未找到用户")
+	} else if victim, ok = findUserByName(u.room(), split[0]); !ok {
+		if n, err := parseNetwork(split[0]); err == nil { // ban an IP or a whole subnet
+			kicked := u.srv.banNetwork(n, banReason, bannerID, dur)
+			u.srv.audit(u, "ban", n.String(), "", banReason)
+			u.room().broadcast(Devbot, n.String()+" 已被 "+banner+durInfo+" "+banReason+" (踢出了 "+strconv.Itoa(kicked)+" 个用户)")
+			return
+		}
+		u.room().broadcast("", "未找到用户")
 		return
 	}
+	if victim != u {
+		u.srv.audit(u, "ban", victim.Name, victim.id, banReason)
+	}
+	victim.banFor(victim.Name+" 已被 "+banner+durInfo+" "+banReason, banReason, bannerID, dur)
+}
 
-	if len(split) > 1 {
-		dur, err := time.ParseDuration(split[len(split)-1])
-		if err != nil {
-			split[len(split)-1] = "" // there's no duration so don't trim anything from the reason
-		}
-		if len(split) > 2 {
-			banReason = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, split[0]), split[len(split)-1]))
-		}
-		if err == nil { // there was a duration
-			victim.ban(victim.Name + " 已被 " + banner + " 为 " + dur.String() + " " + banReason)
-			go func(id string) {
-				time.Sleep(dur)
-				unbanIDorIP(id)
-			}(victim.id) // evaluate id now, call unban with that value later
-			return
+// banReasonAndDuration parses the optional reason and trailing duration that follow the first word of a ban command.
+func banReasonAndDuration(line string, split []string) (string, time.Duration) {
+	if len(split) < 2 {
+		return "", 0
+	}
+	last := split[len(split)-1]
+	dur, err := time.ParseDuration(last)
+	if err != nil || dur < 0 {
+		last = "" // there's no duration so don't trim anything from the reason
+		dur = 0
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, split[0]), last)), dur
+}
+
+// banNetwork bans every address in n and closes all users connected from it.
+// It returns the number of users closed.
+func (srv *Server) banNetwork(n *net.IPNet, reason, bannerID string, dur time.Duration) int {
+	b := Ban{Addr: n.String(), Reason: reason, BannerID: bannerID, CreatedAt: time.Now()}
+	if ones, bits := n.Mask.Size(); ones == bits { // a single address, store it like a user's address so exact matches work
+		b.Addr = n.IP.String()
+	}
+	if dur > 0 {
+		b.ExpiresAt = b.CreatedAt.Add(dur)
+	}
+	srv.addBan(b)
+	kicked := 0
+	for _, us := range srv.Rooms.users() {
+		if addrMatches(b.Addr, us.addr) {
+			us.close("")
+			kicked++
 		}
 	}
-	victim.ban(victim.Name + " 已被 " + banner + " " + banReason)
+	return kicked
 }
 
 func kickCMD(line string, u *User) {
-	victim, ok := findUserByName(u.room, line)
+	victim, ok := findUserByName(u.room(), line)
 	if !ok {
 		if line == "devbot" {
-			u.room.broadcast(Devbot, "您将为此付出代价")
+			u.room().broadcast(Devbot, "您将为此付出代价")
 			u.close(u.Name + Red.Paint(" 已被踢出 ") + Devbot)
 		} else {
-			u.room.broadcast("", "未找到用户")
+			u.room().broadcast("", "未找到用户")
 		}
 		return
 	}
 	if !auth(u) && victim.id != u.id {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
+	if victim.id != u.id { // only admins can act on others, and users kicking themselves isn't moderation
+		u.srv.audit(u, "kick", victim.Name, victim.id, "")
+	}
 	victim.close(victim.Name + Red.Paint(" 已被踢出 ") + u.Name)
 }
 
 func muteCMD(line string, u *User) {
-	victim, ok := findUserByName(u.room, line)
+	args := strings.Fields(line)
+	shadow := false
+	room := ""
+	for len(args) > 0 && (args[0] == "-s" || strings.HasPrefix(args[0], "#")) {
+		if args[0] == "-s" {
+			shadow = true
+		} else {
+			room = args[0]
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		u.room().broadcast(Devbot, "您要静音哪个用户?")
+		return
+	}
+	if room != "" {
+		if !validRoomName(room) {
+			u.room().broadcast(Devbot, "无效的房间名称: "+room)
+			return
+		}
+		if _, ok := u.srv.Rooms.get(room); !ok {
+			u.room().broadcast(Devbot, "房间不存在: "+room)
+			return
+		}
+	}
+	victim, ok := findUserByName(u.room(), args[0])
 	if !ok {
-		u.room.broadcast("", "未找到用户")
+		u.room().broadcast("", "未找到用户")
 		return
 	}
 	if !auth(u) && victim.id != u.id {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
-	victim.IsMuted = true
+	var dur time.Duration
+	if len(args) > 1 {
+		if d, err := time.ParseDuration(args[1]); err == nil && d > 0 {
+			dur = d
+			args = args[1:]
+		}
+	}
+	reason := strings.Join(args[1:], " ")
+	if victim.id != u.id {
+		u.srv.audit(u, "mute", victim.Name, victim.id, reason)
+	}
+	victim.mute(dur, shadow, room, reason)
+	if victim != u {
+		u.writeln(Devbot, victim.Name+" 已被静音"+victim.muteInfo())
+	}
 }
 
 func unmuteCMD(line string, u *User) {
-	victim, ok := findUserByName(u.room, line)
+	victim, ok := findUserByName(u.room(), line)
 	if !ok {
-		u.room.broadcast("", "未找到用户")
+		u.room().broadcast("", "未找到用户")
 		return
 	}
 	if !auth(u) && victim.id != u.id {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
-	victim.IsMuted = false
+	if victim.id != u.id {
+		u.srv.audit(u, "unmute", victim.Name, victim.id, "")
+	}
+	if !victim.unmute() {
+		victim.writeln(Devbot, "你已被解除静音")
+	}
 }
 
 func colorCMD(rest string, u *User) {
 	if rest == "which" {
-		u.room.broadcast(Devbot, u.Color+" "+u.ColorBG)
+		u.room().broadcast(Devbot, u.Color+" "+u.ColorBG)
 	} else if err := u.changeColor(rest); err != nil {
-		u.room.broadcast(Devbot, err.Error())
+		u.room().broadcast(Devbot, err.Error())
 	}
 }
 
 func adminsCMD(_ string, u *User) {
 	msg := "管理员 ID:  \n"
 	i := 1
-	for id, info := range Config.Admins {
+	for id, info := range u.srv.Config().Admins {
 		if len(id) > 10 {
 			id = id[:10] + "..."
 		}
 		msg += Cyan.Cyan(strconv.Itoa(i)) + ". " + id + "\t" + info + "  \n"
 		i++
 	}
-	u.room.broadcast(Devbot, msg)
+	u.room().broadcast(Devbot, msg)
 }
 
 func helpCMD(_ string, u *User) {
-	u.room.broadcast("", `
+	u.reply("", `
 ————————————————————————————————————————————————————————————————————————————————————————————
 >>>  欢迎来到 王果冻的聊天室!    聊天室通过 SSH 聊天： ssh apache.vyantaosheweining.top -p 8080
 ————————————————————————————————————————————————————————————————————————————————————————————
@@ -709,29 +902,29 @@ func helpCMD(_ string, u *User) {
 
 func catCMD(line string, u *User) {
 	if line == "" {
-		u.room.broadcast("", "usage: cat [-benstuv] [file ...]")
+		u.room().broadcast("", "usage: cat [-benstuv] [file ...]")
 	} else if line == "README.md" {
 		helpCMD(line, u)
 	} else {
-		u.room.broadcast("", "cat: "+line+": 权限被拒绝")
+		u.room().broadcast("", "cat: "+line+": 权限被拒绝")
 	}
 }
 
 func rmCMD(line string, u *User) {
 	if line == "" {
-		u.room.broadcast("", `usage: rm [-f | -i] [-dPRrvW] file ...
+		u.room().broadcast("", `usage: rm [-f | -i] [-dPRrvW] file ...
 unlink file`)
 	} else {
-		u.room.broadcast("", "rm: "+line+": 权限被拒绝, 笨蛋")
+		u.room().broadcast("", "rm: "+line+": 权限被拒绝, 笨蛋")
 	}
 }
 
 func exampleCodeCMD(line string, u *User) {
 	if line == "big" {
-		u.room.broadcast(Devbot, "```go\npackage main\n\nimport \"fmt\"\n\nfunc sum(nums ...int) {\n    fmt.Print(nums, \" \")\n    total := 0\n    for _, num := range nums {\n        total += num\n    }\n    fmt.Println(total)\n}\n\nfunc main() {\n\n    sum(1, 2)\n    sum(1, 2, 3)\n\n    nums := []int{1, 2, 3, 4}\n    sum(nums...)\n}\n```")
+		u.room().broadcast(Devbot, "```go\npackage main\n\nimport \"fmt\"\n\nfunc sum(nums ...int) {\n    fmt.Print(nums, \" \")\n    total := 0\n    for _, num := range nums {\n        total += num\n    }\n    fmt.Println(total)\n}\n\nfunc main() {\n\n    sum(1, 2)\n    sum(1, 2, 3)\n\n    nums := []int{1, 2, 3, 4}\n    sum(nums...)\n}\n```")
 		return
 	}
-	u.room.broadcast(Devbot, "\n```go\npackage main\nimport \"fmt\"\nfunc main() {\n   fmt.Println(\"Example!\")\n}\n```")
+	u.room().broadcast(Devbot, "\n```go\npackage main\nimport \"fmt\"\nfunc main() {\n   fmt.Println(\"Example!\")\n}\n```")
 }
 
 func init() { // add Matt Gleich's blackbird theme from https://github.com/blackbirdtheme/vscode/blob/master/themes/blackbird-midnight-color-theme.json#L175
@@ -750,62 +943,62 @@ func init() { // add Matt Gleich's blackbird theme from https://github.com/black
 
 func themeCMD(line string, u *User) {
 	// TODO: make this work with glamour
-	u.room.broadcast(Devbot, "主题当前不起作用，因为 Devzat 正在切换到使用 glamour 进行渲染.")
+	u.room().broadcast(Devbot, "主题当前不起作用，因为 Devzat 正在切换到使用 glamour 进行渲染.")
 	if line == "list" {
-		u.room.broadcast(Devbot, "可用主题: "+strings.Join(chromastyles.Names(), ", "))
+		u.room().broadcast(Devbot, "可用主题: "+strings.Join(chromastyles.Names(), ", "))
 		return
 	}
 	for _, name := range chromastyles.Names() {
 		if name == line {
 			//markdown.CurrentTheme = chromastyles.Get(name)
-			u.room.broadcast(Devbot, "主题设置为 "+name)
+			u.room().broadcast(Devbot, "主题设置为 "+name)
 			return
 		}
 	}
-	u.room.broadcast(Devbot, "那是什么主题？使用主题列表查看可用内容.")
+	u.room().broadcast(Devbot, "那是什么主题？使用主题列表查看可用内容.")
 }
 
 func asciiArtCMD(_ string, u *User) {
-	u.room.broadcast("", Art)
+	u.room().broadcast("", u.srv.art)
 }
 
 func pwdCMD(_ string, u *User) {
 	if u.messaging != nil {
 		u.writeln("", u.messaging.Name)
 	} else {
-		u.room.broadcast("", u.room.name)
+		u.reply("", u.room().name)
 	}
 }
 
 func shrugCMD(line string, u *User) {
-	u.room.broadcast(u.Name, line+` ¯\\_(ツ)_/¯`)
+	u.room().broadcast(u.Name, line+` ¯\\_(ツ)_/¯`)
 }
 
 func pronounsCMD(line string, u *User) {
 	args := strings.Fields(line)
 
 	if line == "" {
-		u.room.broadcast(Devbot, "通过提供 em 或查询用户的代词来设置代词!")
+		u.room().broadcast(Devbot, "通过提供 em 或查询用户的代词来设置代词!")
 		return
 	}
 
 	if len(args) == 1 && strings.HasPrefix(args[0], "@") {
-		victim, ok := findUserByName(u.room, args[0][1:])
+		victim, ok := findUserByName(u.room(), args[0][1:])
 		if !ok {
-			u.room.broadcast(Devbot, "那是谁?")
+			u.room().broadcast(Devbot, "那是谁?")
 			return
 		}
-		u.room.broadcast(Devbot, victim.Name+"'的代词是 "+victim.displayPronouns())
+		u.room().broadcast(Devbot, victim.Name+"'的代词是 "+victim.displayPronouns())
 		return
 	}
 
 	u.Pronouns = strings.Fields(strings.ReplaceAll(strings.ToLower(line), "\n", ""))
 	//u.changeColor(u.Color) // refresh pronouns
-	u.room.broadcast(Devbot, u.Name+" 现在过去了 "+u.displayPronouns())
+	u.room().broadcast(Devbot, u.Name+" 现在过去了 "+u.displayPronouns())
 }
 
 func emojisCMD(_ string, u *User) {
-	u.room.broadcast(Devbot, `完整列表请参见 https://github.com/ikatyang/emoji-cheat-sheet/  
+	u.room().broadcast(Devbot, `完整列表请参见 https://github.com/ikatyang/emoji-cheat-sheet/  
 下面是几个例子 (type :emoji_text: to use):  
 :doughnut: doughnut  
 :yum: yum  
@@ -823,17 +1016,17 @@ func emojisCMD(_ string, u *User) {
 }
 
 func commandsRestCMD(_ string, u *User) {
-	u.room.broadcast("", "其余的  \n"+autogenCommands(RestCMDs))
+	u.reply("", "其余的  \n"+autogenCommands(u.srv.restCMDs()))
 }
 
 func manCMD(rest string, u *User) {
 	if rest == "" {
-		u.room.broadcast(Devbot, "您需要什么命令的帮助?")
+		u.reply(Devbot, "您需要什么命令的帮助?")
 		return
 	}
 
 	if rest == "prompt" {
-		u.room.broadcast(Devbot, `prompt <prompt> 设置您的提示
+		u.reply(Devbot, `prompt <prompt> 设置您的提示
 
 你可以在其中使用一些 bash PS1 标签。
 支持的标签包括：
@@ -849,79 +1042,79 @@ func manCMD(rest string, u *User) {
 		return
 	}
 
-	if cmd, ok := getCMD(rest); ok {
-		u.room.broadcast(Devbot, "用法: "+cmd.name+" "+cmd.argsInfo+"  \n"+cmd.info)
+	if cmd, ok := u.srv.getCMD(rest); ok {
+		u.reply(Devbot, "用法: "+cmd.name+" "+cmd.argsInfo+"  \n"+cmd.info)
 		return
 	}
 	// Plugin commands
-	if c, ok := PluginCMDs[rest]; ok {
-		u.room.broadcast(Devbot, "用法: "+rest+" "+c.argsInfo+"  \n"+c.info)
+	if c, ok := u.srv.getPluginCMD(rest); ok {
+		u.reply(Devbot, "用法: "+rest+" "+c.argsInfo+"  \n"+c.info)
 		return
 	}
 
-	u.room.broadcast("", "通过删除用户不登录的系统上不需要的包和内容，该系统已最小化.\n\n要恢复这些内容，包括手册页，您可以运行 'unminimize' 命令。您仍然需要确保已安装 'man-db' 软件包.")
+	u.reply("", "通过删除用户不登录的系统上不需要的包和内容，该系统已最小化.\n\n要恢复这些内容，包括手册页，您可以运行 'unminimize' 命令。您仍然需要确保已安装 'man-db' 软件包.")
 }
 
 func lsCMD(rest string, u *User) {
 	if len(rest) > 0 && rest[0] == '#' {
-		if r, ok := Rooms[rest]; ok {
+		if r, ok := u.srv.Rooms.get(rest); ok {
 			usersList := ""
-			for _, us := range r.users {
+			for _, us := range r.snapshot() {
 				usersList += us.Name + Blue.Paint("/ ")
 			}
-			u.room.broadcast("", usersList)
+			u.room().broadcast("", usersList)
 			return
 		}
 	}
 	if rest == "-i" { // show ids
 		s := ""
-		for _, us := range u.room.users {
+		for _, us := range u.room().snapshot() {
 			s += us.id + " " + us.Name + "  \n"
 		}
-		u.room.broadcast("", s)
+		u.room().broadcast("", s)
 		return
 	}
 	if rest != "" {
-		u.room.broadcast("", "ls: "+rest+" 权限被拒绝")
+		u.room().broadcast("", "ls: "+rest+" 权限被拒绝")
 		return
 	}
 	roomList := ""
-	for _, r := range Rooms {
+	for _, r := range u.srv.Rooms.all() {
 		roomList += Blue.Paint(r.name + "/ ")
 	}
 	usersList := ""
-	for _, us := range u.room.users {
+	for _, us := range u.room().snapshot() {
 		usersList += us.Name + Blue.Paint("/ ")
 	}
 	usersList += Devbot + Blue.Paint("/ ")
-	u.room.broadcast("", "README.md "+usersList+roomList)
+	u.room().broadcast("", "README.md "+usersList+roomList)
 }
 
 func commandsCMD(_ string, u *User) {
-	u.room.broadcast("", "Commands  \n"+autogenCommands(MainCMDs))
+	u.reply("", "Commands  \n"+autogenCommands(u.srv.mainCMDs()))
 }
 
 func unameCMD(rest string, u *User) {
 	if unameCommit == "" || unameTime == "" {
-		u.room.broadcast("", "没有可用的 uname 输出。构建 Devzat `"+color.HiYellowString(`go build -ldflags "-X 'main.unameCommit=$(git rev-parse HEAD)' -X 'main.unameTime=$(date)'"`)+"` to enable.")
+		u.room().broadcast("", "没有可用的 uname 输出。构建 Devzat `"+color.HiYellowString(`go build -ldflags "-X 'devzat/server.unameCommit=$(git rev-parse HEAD)' -X 'devzat/server.unameTime=$(date)'"`)+"` to enable.")
 		return
 	}
-	u.room.broadcast("", "Devzat ("+unameCommit+") "+unameTime)
+	u.room().broadcast("", "Devzat ("+unameCommit+") "+unameTime)
 }
 
 func uptimeCMD(rest string, u *User) {
-	uptime := time.Since(StartupTime)
-	u.room.broadcast("", fmt.Sprintf("up %v days, %02d:%02d:%02d", int(uptime.Hours()/24), int(math.Mod(uptime.Hours(), 24)), int(math.Mod(uptime.Minutes(), 60)), int(math.Mod(uptime.Seconds(), 60))))
+	uptime := time.Since(u.srv.StartupTime)
+	u.room().broadcast("", fmt.Sprintf("up %v days, %02d:%02d:%02d", int(uptime.Hours()/24), int(math.Mod(uptime.Hours(), 24)), int(math.Mod(uptime.Minutes(), 60)), int(math.Mod(uptime.Seconds(), 60))))
 }
 
 func neofetchCMD(_ string, u *User) {
-	content, err := os.ReadFile(Config.DataDir + "/neofetch.txt")
+	content, err := os.ReadFile(u.srv.Config().DataDir + "/neofetch.txt")
 	if err != nil {
-		u.room.broadcast("", "Error reading "+Config.DataDir+"/neofetch.txt: "+err.Error())
+		u.room().broadcast("", "Error reading "+u.srv.Config().DataDir+"/neofetch.txt: "+err.Error())
 		return
 	}
 	contentSplit := strings.Split(string(content), "\n")
-	uptime := time.Since(StartupTime)
+	uptime := time.Since(u.srv.StartupTime)
 	uptimeStr := fmt.Sprintf("%v days, %v hours, %v minutes", int(uptime.Hours()/24), int(math.Mod(uptime.Hours(), 24)), int(math.Mod(uptime.Minutes(), 60)))
 	memstats := runtime.MemStats{}
 	runtime.ReadMemStats(&memstats)
@@ -937,7 +1130,7 @@ func neofetchCMD(_ string, u *User) {
 		{"", strings.Repeat("-", len(userHost))},
 		{"OS", "Devzat"},
 		{"Uptime", uptimeStr},
-		{"Packages", fmt.Sprint(len(PluginCMDs)+len(MainCMDs)+len(RestCMDs)) + " commands"},
+		{"Packages", fmt.Sprint(u.srv.pluginCMDCount()+len(u.srv.mainCMDs())+len(u.srv.restCMDs())) + " commands"},
 		{"Shell", "devzat"},
 		{"Memory", fmt.Sprintf("%v MiB alloc / %v MiB sys, %v GC cycles", memstats.Alloc/1024/1024, memstats.Sys/1024/1024, memstats.NumGC)},
 		{"", ""},
@@ -957,7 +1150,7 @@ func neofetchCMD(_ string, u *User) {
 		}
 		result += "  \n"
 	}
-	u.room.broadcast("", result)
+	u.room().broadcast("", result)
 }
 
 func eightBallCMD(_ string, u *User) {
@@ -971,21 +1164,16 @@ func eightBallCMD(_ string, u *User) {
 	}
 	go func() {
 		time.Sleep(time.Second * time.Duration(rand.Intn(10)))
-		u.room.broadcast("8ball", responses[rand.Intn(len(responses))]+u.Name)
+		u.room().broadcast("8ball", responses[rand.Intn(len(responses))]+u.Name)
 	}()
 }
 
 func rmdirCMD(rest string, u *User) {
 	if rest == "#main" {
-		u.room.broadcast("", "rmdir: failed to remove '"+rest+"': Operation not permitted")
-	} else if room, ok := Rooms[rest]; ok {
-		if len(room.users) == 0 {
-			delete(Rooms, rest)
-			u.room.broadcast("", "rmdir: removing directory, '"+rest+"'")
-		} else {
-			u.room.broadcast("", "rmdir: failed to remove '"+rest+"': Room not empty")
-		}
+		u.room().broadcast("", "rmdir: failed to remove '"+rest+"': Operation not permitted")
+	} else if err := u.srv.Rooms.removeRoom(rest); err != nil {
+		u.room().broadcast("", "rmdir: failed to remove '"+rest+"': "+err.Error())
 	} else {
-		u.room.broadcast("", "rmdir: failed to remove '"+rest+"': No such room")
+		u.room().broadcast("", "rmdir: removing directory, '"+rest+"'")
 	}
 }
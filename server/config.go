@@ -0,0 +1,373 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ConfigType struct {
+	Port        int               `yaml:"port"`
+	AltPort     int               `yaml:"alt_port"`
+	ProfilePort int               `yaml:"profile_port"`
+	Scrollback  int               `yaml:"scrollback"`
+	DataDir     string            `yaml:"data_dir"`
+	KeyFile     string            `yaml:"key_file"`
+	Admins      map[string]string `yaml:"admins"`
+	Censor      bool              `yaml:"censor,omitempty"`
+	Private     bool              `yaml:"private,omitempty"`
+	Allowlist   map[string]string `yaml:"allowlist,omitempty"`
+	// NetDenylist and NetAllowlist are CIDR ranges or IPs checked before the SSH handshake.
+	// If NetAllowlist is not empty, only those networks can connect.
+	NetDenylist  []string `yaml:"net_denylist,omitempty"`
+	NetAllowlist []string `yaml:"net_allowlist,omitempty"`
+
+	Images   ImageConfig    `yaml:"images"`
+	Throttle ThrottleConfig `yaml:"throttle"`
+	// Reputation lists are checked when users join. By default, Tor exit nodes are rejected.
+	Reputation []ReputationList `yaml:"reputation"`
+	Challenge  ChallengeConfig  `yaml:"challenge"`
+	Outbox     OutboxConfig     `yaml:"outbox"`
+	// Federation shares rooms with other Devzat servers
+	Federation FederationConfig `yaml:"federation,omitempty"`
+
+	IntegrationConfig string `yaml:"integration_config"`
+
+	// denyNets and allowNets are parsed from NetDenylist and NetAllowlist
+	denyNets  []*net.IPNet
+	allowNets []*net.IPNet
+}
+
+// IntegrationsType stores information needed by integrations.
+// Code that uses this should check if fields are nil.
+type IntegrationsType struct {
+	// Twitter stores the information needed for the Twitter integration.
+	// Check if it is enabled by checking if Twitter is nil.
+	Twitter *TwitterInfo `yaml:"twitter"`
+	// Slack stores the information needed for the Slack integration.
+	// Check if it is enabled by checking if Slack is nil.
+	Slack *SlackInfo `yaml:"slack"`
+	// Discord stores the information needed for the Discord integration.
+	// Check if it is enabled by checking if Discord is nil.
+	Discord *DiscordInfo `yaml:"discord"`
+
+	RPC *RPCInfo `yaml:"rpc"`
+}
+
+type TwitterInfo struct {
+	ConsumerKey       string `yaml:"consumer_key"`
+	ConsumerSecret    string `yaml:"consumer_secret"`
+	AccessToken       string `yaml:"access_token"`
+	AccessTokenSecret string `yaml:"access_token_secret"`
+}
+
+type SlackInfo struct {
+	// Token is the Slack API token
+	Token string `yaml:"token"`
+	// ChannelID is the Slack channel to post to
+	ChannelID string `yaml:"channel_id"`
+	// Prefix is the prefix to prepend to messages from Slack when rendered for SSH users
+	Prefix string `yaml:"prefix"`
+}
+
+type DiscordInfo struct {
+	// Token is the Discord API token
+	Token string `yaml:"token"`
+	// ChannelID is the ID of the channel to post to
+	ChannelID string `yaml:"channel_id"`
+	// Prefix is the prefix to prepend to messages from Discord when rendered for SSH users
+	Prefix string `yaml:"prefix"`
+	// Compact mode disables avatars to save vertical space
+	CompactMode bool `yaml:"compact_mode"`
+}
+
+type RPCInfo struct {
+	Port int    `yaml:"port"`
+	Key  string `yaml:"key"`
+}
+
+func defaultConfig() ConfigType {
+	return ConfigType{
+		Port:        2221,
+		AltPort:     8080,
+		ProfilePort: 5555,
+		Scrollback:  16,
+		DataDir:     "devzat-data",
+		KeyFile:     "devzat-sshkey",
+		Images: ImageConfig{
+			MaxBytes:  30 * 1024 * 1024, // 30 megabytes
+			MaxWidth:  4032 * 2,
+			MaxHeight: 3024 * 2,
+
+			MemoryCache: 64 * 1024 * 1024,
+			DiskCache:   256 * 1024 * 1024,
+		},
+		Throttle: ThrottleConfig{
+			ThrottleAfter: 4,
+			Action:        "delay",
+			Delay:         5 * time.Second,
+			BanAfter:      6,
+		},
+		Reputation: []ReputationList{
+			{Name: "tor", Source: "https://www.dan.me.uk/torlist/?exit", Refresh: time.Hour, Action: RepReject},
+		},
+		Challenge: ChallengeConfig{
+			Attempts:          3,
+			Probation:         24 * time.Hour,
+			ProbationMessages: 10,
+		},
+		Outbox: OutboxConfig{
+			Size:     128,
+			Overflow: OverflowDropOldest,
+		},
+
+		IntegrationConfig: "",
+	}
+}
+
+// readConfig reads and validates a config file and the integration config it refers to without applying them
+func readConfig(file string) (ConfigType, IntegrationsType, error) {
+	c := defaultConfig()
+	integrations := IntegrationsType{}
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return c, integrations, err
+	}
+	if err = yaml.UnmarshalStrict(d, &c); err != nil {
+		return c, integrations, err
+	}
+	if os.Getenv("PORT") != "" {
+		if c.Port, err = strconv.Atoi(os.Getenv("PORT")); err != nil {
+			return c, integrations, err
+		}
+	}
+	if c.Scrollback < 0 {
+		return c, integrations, errors.New("scrollback 不能是负数")
+	}
+	if c.Images.MemoryCache < 0 || c.Images.DiskCache < 0 {
+		return c, integrations, errors.New("images.memory_cache 和 images.disk_cache 不能是负数")
+	}
+	if a := c.Throttle.Action; a != "delay" && a != "reject" {
+		return c, integrations, errors.New("throttle.action 必须是 delay 或 reject")
+	}
+	if err = validateReputation(c.Reputation); err != nil {
+		return c, integrations, err
+	}
+	if err = validateOutbox(c.Outbox); err != nil {
+		return c, integrations, err
+	}
+	if err = validateChallenge(c.Challenge); err != nil {
+		return c, integrations, err
+	}
+	if err = validateFederation(c.Federation); err != nil {
+		return c, integrations, err
+	}
+	if _, err = parseNetworks(c.NetDenylist); err != nil {
+		return c, integrations, err
+	}
+	if _, err = parseNetworks(c.NetAllowlist); err != nil {
+		return c, integrations, err
+	}
+	if c.IntegrationConfig != "" {
+		integrations, err = readIntegrations(c.IntegrationConfig)
+	}
+	return c, integrations, err
+}
+
+func readIntegrations(file string) (IntegrationsType, error) {
+	integrations := IntegrationsType{}
+	d, err := os.ReadFile(file)
+	if err != nil {
+		return integrations, err
+	}
+	if err = yaml.UnmarshalStrict(d, &integrations); err != nil {
+		return integrations, err
+	}
+
+	if integrations.Slack != nil {
+		if integrations.Slack.Prefix == "" {
+			integrations.Slack.Prefix = "Slack"
+		}
+		if sl := integrations.Slack; sl.Token == "" || sl.ChannelID == "" {
+			return integrations, errors.New("缺少 Slack 令牌或频道 ID")
+		}
+	}
+	if integrations.Discord != nil {
+		if integrations.Discord.Prefix == "" {
+			integrations.Discord.Prefix = "Discord"
+		}
+		if sl := integrations.Discord; sl.Token == "" || sl.ChannelID == "" {
+			return integrations, errors.New("缺少 Discord 令牌或频道 ID")
+		}
+	}
+	if integrations.Twitter != nil {
+		if tw := integrations.Twitter; tw.AccessToken == "" ||
+			tw.AccessTokenSecret == "" ||
+			tw.ConsumerKey == "" ||
+			tw.ConsumerSecret == "" {
+			return integrations, errors.New("Twitter 认证不完整")
+		}
+	}
+
+	if os.Getenv("DEVZAT_OFFLINE_SLACK") != "" {
+		fmt.Println("Disabling Slack")
+		integrations.Slack = nil
+	}
+	if os.Getenv("DEVZAT_OFFLINE_DISCORD") != "" {
+		fmt.Println("Disabling Discord")
+		integrations.Discord = nil
+	}
+	if os.Getenv("DEVZAT_OFFLINE_TWITTER") != "" {
+		fmt.Println("Disabling Twitter")
+		integrations.Twitter = nil
+	}
+	if os.Getenv("DEVZAT_OFFLINE_RPC") != "" {
+		fmt.Println("Disabling RPC")
+		integrations.RPC = nil
+	}
+	// Check for global offline for backwards compatibility
+	if os.Getenv("DEVZAT_OFFLINE") != "" {
+		fmt.Println("Offline mode")
+		integrations.Slack = nil
+		integrations.Discord = nil
+		integrations.Twitter = nil
+		integrations.RPC = nil
+	}
+	return integrations, nil
+}
+
+// reloadConfig re-reads the config and applies it to the running server. Nothing is changed if
+// the new config is invalid. Settings that can only change on restart keep their old values and
+// are returned so the admin can be told.
+func (srv *Server) reloadConfig() (needRestart []string, err error) {
+	srv.configEdit.Lock() // so an edit can't be made after the file is read and then lost when this is applied
+	defer srv.configEdit.Unlock()
+	c, integrations, err := readConfig(srv.configFile)
+	if err != nil {
+		return nil, err
+	}
+	srv.filtersEdit.Lock()
+	err = srv.loadFilters() // filters.json is reloaded along with the config
+	srv.filtersEdit.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	srv.configMutex.Lock()
+	defer srv.configMutex.Unlock()
+	old, oldIntegrations := srv.Config(), srv.Integrations()
+	keep := func(name string, changed bool) bool {
+		if changed {
+			needRestart = append(needRestart, name)
+		}
+		return changed
+	}
+	if keep("port", c.Port != old.Port) {
+		c.Port = old.Port
+	}
+	if keep("alt_port", c.AltPort != old.AltPort) {
+		c.AltPort = old.AltPort
+	}
+	if keep("profile_port", c.ProfilePort != old.ProfilePort) {
+		c.ProfilePort = old.ProfilePort
+	}
+	if keep("data_dir", c.DataDir != old.DataDir) {
+		c.DataDir = old.DataDir
+	}
+	if keep("key_file", c.KeyFile != old.KeyFile) {
+		c.KeyFile = old.KeyFile
+	}
+	if keep("federation", !reflect.DeepEqual(c.Federation, old.Federation)) {
+		c.Federation = old.Federation
+	}
+	if keep("rpc", !reflect.DeepEqual(integrations.RPC, oldIntegrations.RPC)) {
+		integrations.RPC = oldIntegrations.RPC
+	}
+
+	c.denyNets, _ = parseNetworks(c.NetDenylist) // already validated
+	c.allowNets, _ = parseNetworks(c.NetAllowlist)
+	// the maps and slices in c are new, so replacing the config never changes anything a reader is using
+	srv.config.Store(&c)
+	if c.Scrollback != old.Scrollback {
+		srv.resizeBacklog(c.Scrollback)
+	}
+	if !reflect.DeepEqual(c.Images, old.Images) { // rendered messages might show images that are now blocked
+		srv.renders.clear()
+	}
+	if !reflect.DeepEqual(c.Reputation, old.Reputation) {
+		srv.startReputation(c.Reputation)
+	}
+
+	srv.integrations.Store(&integrations)
+	srv.startBridges(&integrations, oldIntegrations)
+	return needRestart, nil
+}
+
+// startBridges replaces the bridges whose config differs between integrations and old, stopping the old ones
+func (srv *Server) startBridges(integrations, old *IntegrationsType) {
+	if !reflect.DeepEqual(integrations.Slack, old.Slack) {
+		if b := srv.slack.Swap(nil); b != nil {
+			b.stop()
+		}
+		srv.slack.Store(srv.newSlackBridge(integrations.Slack))
+	}
+	if !reflect.DeepEqual(integrations.Discord, old.Discord) {
+		if b := srv.discord.Swap(nil); b != nil {
+			b.stop()
+		}
+		srv.discord.Store(srv.newDiscordBridge(integrations.Discord))
+	}
+	if !reflect.DeepEqual(integrations.Twitter, old.Twitter) {
+		srv.twitterClient.Store(srv.newTwitterClient(integrations.Twitter))
+	}
+}
+
+// resizeBacklog changes the number of messages kept for new users, keeping the newest ones
+func (srv *Server) resizeBacklog(n int) {
+	srv.backlogMutex.Lock()
+	defer srv.backlogMutex.Unlock()
+	if n <= len(srv.Backlog) {
+		srv.Backlog = append([]backlogMessage(nil), srv.Backlog[len(srv.Backlog)-n:]...)
+		return
+	}
+	srv.Backlog = append(make([]backlogMessage, n-len(srv.Backlog)), srv.Backlog...)
+}
+
+// Reload re-reads the config file and applies it, logging how it went. Admins are told if it failed.
+func (srv *Server) Reload() {
+	srv.reloadAndReport(nil)
+}
+
+// reloadAndReport reloads the config and tells u, or the log and online admins if u is nil, how it went
+func (srv *Server) reloadAndReport(u *User) {
+	needRestart, err := srv.reloadConfig()
+	msg := "配置已重新加载"
+	if err != nil {
+		msg = "重新加载配置时出错，没有更改任何设置: " + err.Error()
+	} else if len(needRestart) > 0 {
+		msg += "。这些设置需要重启才能生效: " + strings.Join(needRestart, ", ")
+	}
+	if u == nil {
+		srv.Log.Println(msg)
+		if err != nil {
+			srv.notifyAdmins(msg)
+		}
+		return
+	}
+	u.writeln(Devbot, msg)
+}
+
+func reloadCMD(_ string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	u.srv.audit(u, "reload", "", "", "")
+	u.srv.reloadAndReport(u)
+}
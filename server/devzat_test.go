@@ -0,0 +1,1263 @@
+// This module is meant to be some standard Go unit tests for Devzat. Run
+// `go test ./...` from the repository root to run them.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/acarl005/stripansi"
+	"github.com/gliderlabs/ssh"
+	terminal "github.com/quackduck/term"
+)
+
+type dummyRW struct{}
+
+func (rw dummyRW) Read(p []byte) (n int, err error)  { return 0, nil }
+func (rw dummyRW) Write(p []byte) (n int, err error) { return 0, nil }
+
+type dummySession struct{}
+
+func (s dummySession) User() string                            { return "" }
+func (s dummySession) RemoteAddr() net.Addr                    { return nil }
+func (s dummySession) LocalAddr() net.Addr                     { return nil }
+func (s dummySession) Environ() []string                       { return make([]string, 0) }
+func (s dummySession) Exit(code int) error                     { return nil }
+func (s dummySession) Command() []string                       { return make([]string, 0) }
+func (s dummySession) RawCommand() string                      { return "" }
+func (s dummySession) Subsystem() string                       { return "" }
+func (s dummySession) PublicKey() ssh.PublicKey                { return nil }
+func (s dummySession) Context() ssh.Context                    { return nil }
+func (s dummySession) Permissions() ssh.Permissions            { return ssh.Permissions{} }
+func (s dummySession) Pty() (ssh.Pty, <-chan ssh.Window, bool) { return ssh.Pty{}, nil, true }
+func (s dummySession) Signals(c chan<- ssh.Signal)             {}
+func (s dummySession) Break(c chan<- bool)                     {}
+func (s dummySession) Close() error                            { return nil }
+func (s dummySession) CloseWrite() error                       { return nil }
+func (s dummySession) Read(data []byte) (int, error)           { return 0, nil }
+func (s dummySession) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+func (s dummySession) Stderr() io.ReadWriter          { return nil }
+func (s dummySession) Write(data []byte) (int, error) { return 0, nil }
+
+// newTestServer makes a server that isn't listening, keeping its data in a temporary directory
+func newTestServer(t testing.TB) *Server {
+	c := defaultConfig()
+	c.DataDir = t.TempDir()
+	c.Reputation = nil
+	srv, err := NewServer(c, IntegrationsType{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.logFile.Close() })
+	return srv
+}
+
+// testUser is a user in #main whose events are recorded instead of being sent anywhere
+type testUser struct {
+	*User
+	lock   sync.Mutex
+	events []chatEvent
+}
+
+func joinTestUser(srv *Server, name, id string) *testUser {
+	tu := &testUser{}
+	tu.User = &User{Name: name, id: id, ColorBG: "bg-off", winWidth: 80, session: dummySession{}, srv: srv,
+		term: terminal.NewTerminal(dummyRW{}, ""), joinTime: time.Now(), lastTimestamp: time.Now(), lastInteract: time.Now()}
+	tu.format = func(ev chatEvent) []byte {
+		tu.lock.Lock()
+		tu.events = append(tu.events, ev)
+		tu.lock.Unlock()
+		return nil
+	}
+	srv.Rooms.join(tu.User, srv.MainRoom)
+	return tu
+}
+
+// saw reports whether the user has been sent text, then forgets what they were sent
+func (tu *testUser) saw(text string) bool {
+	tu.lock.Lock()
+	defer tu.lock.Unlock()
+	found := false
+	for _, ev := range tu.events {
+		if strings.Contains(ev.From+": "+ev.Text, text) {
+			found = true
+		}
+	}
+	tu.events = nil
+	return found
+}
+
+func makeDummyRoom() *Room {
+	drw := dummyRW{}
+	dummyTerm := terminal.NewTerminal(drw, "")
+	ret := &Room{name: "DummyRoom", users: []*User{}, usersMutex: sync.RWMutex{}}
+
+	tim := &User{Name: "tim", term: dummyTerm, ColorBG: "bg-off", session: dummySession{}}
+	_ = tim.changeColor("red")
+	tom := &User{Name: "tom", term: dummyTerm, ColorBG: "bg-off", session: dummySession{}}
+	_ = tom.changeColor("blue")
+	timtom := &User{Name: "timtom", term: dummyTerm, ColorBG: "bg-off", session: dummySession{}}
+	_ = timtom.changeColor("sky")
+	timt := &User{Name: "timt", term: dummyTerm, ColorBG: "bg-off", session: dummySession{}}
+	_ = timt.changeColor("coral")
+
+	ret.users = append(ret.users, tim, tom, timtom, timt)
+	for _, u := range ret.users {
+		u.inRoom.Store(ret)
+	}
+	return ret
+}
+
+/* ------------------ Testing correctness of findMention ------------------- */
+
+func performTestFindMention(t *testing.T, r *Room, raw string, expected string) {
+	colored := r.findMention(raw)
+	t.Log(colored)
+	if colored != expected {
+		t.Log(expected)
+		t.Fail()
+	}
+}
+
+func TestFindMention(t *testing.T) {
+	r := makeDummyRoom()
+	inputMsg := "@tim @tom @timtom @timt Hi!"
+	// Warning, the order the elements have been put in the dummy room affects the result of the test
+	expectedMsg := r.users[0].Name + " " + r.users[1].Name + " " + r.users[2].Name + " " + r.users[3].Name + " Hi!"
+	performTestFindMention(t, r, inputMsg, expectedMsg)
+	inputMsg = "@tim @fakemention"
+	expectedMsg = r.users[0].Name + " @fakemention"
+	performTestFindMention(t, r, inputMsg, expectedMsg)
+	inputMsg = "  @tim  "
+	expectedMsg = "  " + r.users[0].Name + "  "
+	performTestFindMention(t, r, inputMsg, expectedMsg)
+	performTestFindMention(t, r, "", "")
+	performTestFindMention(t, r, "@tom", r.users[1].Name)
+	performTestFindMention(t, r, "no mention", "no mention")
+	performTestFindMention(t, r, "@tim \\@tim", r.users[0].Name+" @tim")
+	performTestFindMention(t, r, "@", "@")
+	performTestFindMention(t, r, "\\@", "@")
+}
+
+/* ---------------------- Testing speed of findMention ---------------------- */
+
+var (
+	noMention      = strings.Repeat("这是一条没有提及的消息.", 100)
+	compactMention = "@timt @timt @tom @timt."
+	longMention    = strings.Repeat(" @timt", 100)
+	escapedMention = strings.Repeat(" \\@timt", 100)
+)
+
+func oldMention(r *Room, msg string) string {
+	for i := range r.users {
+		msg = strings.ReplaceAll(msg, "@"+stripansi.Strip(r.users[i].Name), r.users[i].Name)
+		msg = strings.ReplaceAll(msg, `\`+r.users[i].Name, "@"+stripansi.Strip(r.users[i].Name)) // allow escaping
+	}
+	return msg
+}
+
+func BenchmarkFindMentionNoMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = r.findMention(noMention)
+	}
+}
+
+func BenchmarkFindMentionCompactMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = r.findMention(compactMention)
+	}
+}
+
+func BenchmarkFindMentionLongMessage(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = r.findMention(longMention)
+	}
+}
+
+func BenchmarkFindMentionEscapedMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = r.findMention(escapedMention)
+	}
+}
+
+func BenchmarkOldMentionNoMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = oldMention(r, noMention)
+	}
+}
+
+func BenchmarkOldMentionCompactMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = oldMention(r, compactMention)
+	}
+}
+
+func BenchmarkOldMentionLongMessage(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = oldMention(r, longMention)
+	}
+}
+
+func BenchmarkOldMentionEscapedMention(b *testing.B) {
+	r := makeDummyRoom()
+	for i := 0; i < b.N; i++ {
+		_ = oldMention(r, escapedMention)
+	}
+}
+
+/* --------------------- Testing correctness of banning --------------------- */
+
+func performTestBan(t *testing.T, id0 string, id1 string, id2 string, id3 string, usersBanned int) {
+	srv := newTestServer(t)
+	r := makeDummyRoom()
+	r.srv = srv
+	for _, u := range r.users {
+		u.srv = srv
+	}
+	srv.Rooms = newRegistry(r)
+	r.users[0].id = id0
+	r.users[1].id = id1
+	r.users[2].id = id2
+	r.users[3].id = id3
+	r.users[0].ban("Tim是个坏蛋")
+	if len(r.users) != 4-usersBanned {
+		t.Log("Error,", usersBanned, "用户应该被踢出，", 4-len(r.users), "已被踢出.")
+		t.Fail()
+	}
+}
+
+func TestBan(t *testing.T) {
+	t.Parallel()
+	// Testing a single user being banned
+	performTestBan(t, "0", "1", "2", "3", 1)
+	// Testing the two consecutive users sharing the same ID
+	performTestBan(t, "bad", "bad", "900d", "900d", 2)
+	// Testing all user having the same id
+	performTestBan(t, "same", "same", "same", "same", 4)
+	// Testing interlaced users sharing the same ID
+	performTestBan(t, "bad", "900d", "bad", "900d", 2)
+}
+
+func TestBanExpiry(t *testing.T) {
+	var bans []Ban
+	// bans saved by older versions only have Addr and ID
+	err := json.Unmarshal([]byte(`[{"Addr": "1.2.3.4", "ID": "old"}]`), &bans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bansContains(bans, "", "old") || !bansContains(bans, "1.2.3.4", "") {
+		t.Error("旧格式的封禁应该是永久的")
+	}
+	bans = append(bans,
+		Ban{ID: "expired", ExpiresAt: time.Now().Add(-time.Minute)},
+		Ban{ID: "timed", ExpiresAt: time.Now().Add(time.Hour)},
+	)
+	if bansContains(bans, "", "expired") {
+		t.Error("过期的封禁不应匹配")
+	}
+	if !bansContains(bans, "", "timed") {
+		t.Error("未过期的封禁应该匹配")
+	}
+}
+
+func TestCIDRBan(t *testing.T) {
+	bans := []Ban{{Addr: "10.1.2.0/24"}, {Addr: "2001:db8::/64"}, {Addr: "192.168.0.7"}}
+	for addr, banned := range map[string]bool{
+		"10.1.2.3":          true,
+		"10.1.3.3":          false,
+		"2001:db8::1":       true,
+		"2001:db8:0:1::1":   false,
+		"192.168.0.7":       true,
+		"192.168.0.8":       false,
+		"not an ip address": false,
+	} {
+		if bansContains(bans, addr, "") != banned {
+			t.Error(addr, "应该被封禁:", banned)
+		}
+	}
+	if _, err := parseNetworks([]string{"10.0.0.0/8", "::1", "1.2.3.4"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("无效的网络应该返回错误")
+	}
+}
+
+func TestUnban(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Admins = map[string]string{"adminid": "admin"} })
+	admin := joinTestUser(srv, "admin", "adminid")
+	for _, n := range []string{"10.1.2.0/24", "192.168.0.7/32", "2001:db8::1/128", "172.16.0.1"} {
+		network, _ := parseNetwork(n)
+		srv.banNetwork(network, "", "adminid", 0)
+	}
+	srv.addBan(Ban{ID: "userid", Addr: "9.9.9.9"})
+
+	unbanCMD("", admin.User)
+	if !admin.saw("用法: unban") || len(srv.Bans) != 5 {
+		t.Error("没有参数时不应该解禁任何人:", srv.Bans)
+	}
+	for _, toUnban := range []string{"172.16.0.1", "192.168.0.7/32", "2001:db8::1/128", "10.1.2.0/24", "userid"} {
+		unbanCMD(toUnban, admin.User)
+		if !admin.saw("被解禁者") {
+			t.Error("应该可以解禁", toUnban)
+		}
+	}
+	if len(srv.Bans) != 0 {
+		t.Error("所有封禁都应该被解除:", srv.Bans)
+	}
+	unbanCMD("10.1.2.0/24", admin.User)
+	if !admin.saw("我找不到那个人") {
+		t.Error("已经解禁的网络不应该被找到")
+	}
+}
+
+func TestReputation(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	rejectFile := filepath.Join(dir, "reject.txt")
+	readOnlyFile := filepath.Join(dir, "readonly.txt")
+	if err := os.WriteFile(rejectFile, []byte("# exits\n1.2.3.4\n10.9.0.0/16 # a range\n\nnot an ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(readOnlyFile, []byte("1.2.3.4\n5.6.7.8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) {
+		c.Reputation = []ReputationList{
+			{Name: "readonly", Source: readOnlyFile, Action: RepReadOnly},
+			{Name: "reject", Source: rejectFile, Action: RepReject},
+		}
+	})
+	for _, l := range srv.Config().Reputation {
+		if err := srv.loadReputationList(l, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for addr, action := range map[string]string{
+		"1.2.3.4":   RepReject, // the strictest list wins
+		"10.9.8.7":  RepReject,
+		"5.6.7.8":   RepReadOnly,
+		"9.9.9.9":   "",
+		"localhost": "",
+	} {
+		if got, _ := srv.reputationAction(addr); got != action {
+			t.Errorf("%s: 应该是 %q, 而不是 %q", addr, action, got)
+		}
+	}
+	if srv.loadReputationList(ReputationList{Name: "reject", Source: filepath.Join(dir, "missing.txt")}, nil) == nil {
+		t.Error("加载不存在的列表应该返回错误")
+	}
+	if got, _ := srv.reputationAction("1.2.3.4"); got != RepReject {
+		t.Error("加载失败时应该保留旧列表")
+	}
+	stopped := make(chan struct{})
+	close(stopped)
+	if err := srv.loadReputationList(ReputationList{Name: "reject", Source: readOnlyFile}, stopped); err != nil {
+		t.Error(err)
+	}
+	if got, _ := srv.reputationAction("10.9.8.7"); got != RepReject {
+		t.Error("停止之后加载的列表不应该替换当前的列表")
+	}
+	if validateReputation([]ReputationList{{Name: "x", Source: "y", Action: "nope"}}) == nil {
+		t.Error("无效的操作应该返回错误")
+	}
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	tim, tom := joinTestUser(srv, "tim", "timid"), joinTestUser(srv, "tom", "tomid")
+	tim.readOnly = true
+	for _, line := range []string{"hello", "8ball will it work", "shrug", "=tom hi", "tic 1", "nick timmy"} {
+		runCommands(line, tim.User)
+		if tom.saw("") {
+			t.Errorf("只读用户的 %q 不应该被其他人看到", line)
+		}
+		if tim.Name != "tim" {
+			t.Errorf("只读用户不应该能运行 %q", line)
+		}
+	}
+	runCommands("users", tim.User)
+	if !tim.saw("[tim tom]") || tom.saw("") {
+		t.Error("users 的输出应该只发给只读用户")
+	}
+	runCommands("cd #elsewhere", tim.User)
+	if tim.room().name != "#elsewhere" || tom.saw("cd #elsewhere") {
+		t.Error("只读用户应该可以不回显地 cd")
+	}
+}
+
+func TestMute(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Admins = map[string]string{"adminid": "admin"} })
+	admin, tim, tom := joinTestUser(srv, "admin", "adminid"), joinTestUser(srv, "tim", "timid"), joinTestUser(srv, "tom", "tomid")
+	carol := joinTestUser(srv, "carol", "carolid")
+	srv.Rooms.move(carol.User, srv.Rooms.getOrCreate("#other"))
+
+	muteCMD("#typo tim 10m", admin.User)
+	if !admin.saw("房间不存在: #typo") || tim.muteInfo() != "" {
+		t.Error("不应该在不存在的房间里静音:", tim.muteInfo())
+	}
+	muteCMD("#"+strings.Repeat("x", MaxRoomNameLen)+" tim", admin.User)
+	if !admin.saw("无效的房间名称") || tim.muteInfo() != "" {
+		t.Error("不应该在无效的房间里静音:", tim.muteInfo())
+	}
+	muteCMD("#main tim", admin.User)
+	runCommands("hello", tim.User)
+	if admin.saw("hello") || !tim.saw("你已被静音 在 #main 中") {
+		t.Error("在 #main 中被静音的用户不应该能发消息")
+	}
+	runCommands("unmute tim", tim.User)
+	if muted, _ := tim.mutedIn(srv.MainRoom); !muted {
+		t.Error("被静音的用户不应该能解除自己的静音")
+	}
+	runCommands("cd #other", tim.User)
+	runCommands("hi from other", tim.User)
+	if admin.saw("cd #other") || !carol.saw("tim: hi from other") {
+		t.Error("房间静音应该只在那个房间里生效")
+	}
+
+	muteCMD("-s tom", admin.User)
+	runCommands("psst", tom.User)
+	if admin.saw("psst") || !tom.saw("tom: psst") || tom.saw("静音") {
+		t.Error("被静默静音的用户应该只看到自己的消息")
+	}
+	unmuteCMD("tom", admin.User)
+	if tom.saw("你已被解除静音") {
+		t.Error("静默静音解除时不应该通知用户")
+	}
+
+	muteCMD("tom 20ms spam", admin.User)
+	runCommands("too soon", tom.User)
+	if admin.saw("too soon") || !tom.saw("spam") {
+		t.Error("定时静音应该生效")
+	}
+	time.Sleep(30 * time.Millisecond)
+	runCommands("back again", tom.User)
+	if !admin.saw("tom: back again") {
+		t.Error("定时静音过期后应该可以发消息")
+	}
+
+	muteCMD("tom", admin.User)
+	runCommands("exit", tom.User)
+	if _, ok := srv.Rooms.findUser("tom"); ok {
+		t.Error("被静音的用户应该可以退出")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.configFile = filepath.Join(t.TempDir(), "devzat.yml")
+	srv.Backlog = []backlogMessage{{text: "1"}, {text: "2"}, {text: "3"}}
+	admin := &User{id: "adminid", srv: srv}
+
+	write := func(s string) {
+		if err := os.WriteFile(srv.configFile, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("port: " + strconv.Itoa(srv.Config().Port) + "\ndata_dir: " + srv.Config().DataDir + "\nscrollback: 2\nreputation: []\nadmins:\n  adminid: admin\n")
+	needRestart, err := srv.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(needRestart) != 0 {
+		t.Error("不应该需要重启:", needRestart)
+	}
+	if !auth(admin) {
+		t.Error("新的管理员应该立即生效")
+	}
+	if len(srv.Backlog) != 2 || srv.Backlog[0].text != "2" || srv.Backlog[1].text != "3" {
+		t.Error("应该保留最新的消息:", srv.Backlog)
+	}
+
+	write("port: 1\nreputation: []\nadmins:\n  adminid: admin\n")
+	needRestart, err = srv.reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Config().Port == 1 || len(needRestart) == 0 || needRestart[0] != "port" {
+		t.Error("端口更改应该需要重启")
+	}
+
+	write("throttle:\n  action: explode\n")
+	if _, err = srv.reloadConfig(); err == nil {
+		t.Error("无效的配置应该返回错误")
+	}
+	if !auth(admin) {
+		t.Error("无效的配置不应该更改任何设置")
+	}
+}
+
+// TestReloadConfigWhileChatting is for the race detector: the config is replaced while users read it
+func TestReloadConfigWhileChatting(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.configFile = filepath.Join(t.TempDir(), "devzat.yml")
+	config := "port: " + strconv.Itoa(srv.Config().Port) + "\ndata_dir: " + srv.Config().DataDir + "\nreputation: []\nadmins:\n  adminid: admin\n"
+	if err := os.WriteFile(srv.configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	admin := joinTestUser(srv, "admin", "adminid")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := srv.reloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		runCommands("hello", admin.User)
+		if !auth(admin.User) {
+			t.Error("管理员应该在重新加载时保持其权限")
+		}
+	}
+	wg.Wait()
+}
+
+func TestSetAccess(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	id := strings.Repeat("ab", 32)
+	tim := &User{id: id, srv: srv}
+	if err := srv.setAccess("admins", id, "tim", false); err != nil || !auth(tim) {
+		t.Fatal("没有配置文件时也应该可以更改:", err)
+	}
+	if err := srv.setAccess("admins", id, "", true); err != nil || auth(tim) {
+		t.Fatal("没有配置文件时也应该可以更改:", err)
+	}
+
+	configFile := filepath.Join(t.TempDir(), "devzat.yml")
+	srv.configFile = configFile
+	if err := os.WriteFile(configFile, []byte("# the port\nport: 2221\nadmins: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.setAccess("admins", id, "tim: github.com/tim", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.setAccess("allowlist", id, "tim", false); err != nil {
+		t.Fatal(err)
+	}
+	if !auth(tim) || srv.Config().Allowlist[id] != "tim" {
+		t.Error("更改应该立即生效")
+	}
+	c, _, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Admins[id] != "tim: github.com/tim" || c.Allowlist[id] != "tim" {
+		t.Error("更改应该保存到配置文件:", c.Admins, c.Allowlist)
+	}
+	if data, _ := os.ReadFile(configFile); !strings.Contains(string(data), "# the port") {
+		t.Error("应该保留注释:\n" + string(data))
+	}
+	if info, _ := os.Stat(configFile); info.Mode().Perm() != 0600 {
+		t.Error("应该保留文件权限")
+	}
+
+	if err = srv.setAccess("admins", id, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if auth(tim) {
+		t.Error("deop 应该立即生效")
+	}
+	if c, _, _ = readConfig(configFile); len(c.Admins) != 0 {
+		t.Error("deop 应该保存到配置文件")
+	}
+
+	// edits made while the config is reloaded aren't lost
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if _, err := srv.reloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		friend := strconv.Itoa(i)
+		if err = srv.setAccess("allowlist", friend, "friend", false); err != nil {
+			t.Fatal(err)
+		}
+		if srv.Config().Allowlist[friend] != "friend" {
+			t.Error("更改应该立即生效")
+		}
+	}
+	wg.Wait()
+	if len(srv.Config().Allowlist) != 11 {
+		t.Error("重新加载时不应该丢失更改:", srv.Config().Allowlist)
+	}
+}
+
+func TestLockdown(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) {
+		c.Admins = map[string]string{"adminid": "admin"}
+		c.Allowlist = map[string]string{"friendid": "friend"}
+	})
+	admin, friend, stranger := &User{id: "adminid", srv: srv}, &User{id: "friendid", srv: srv}, &User{id: "strangerid", srv: srv}
+
+	srv.Lockdown = LockdownState{Locked: true, TrustedOnly: true}
+	if joinBlocked(stranger) == "" || joinBlocked(admin) != "" {
+		t.Error("锁定时应该只允许管理员加入")
+	}
+	if postBlocked(stranger) == "" || postBlocked(friend) != "" || postBlocked(admin) != "" {
+		t.Error("只有受信任的用户应该可以发送消息")
+	}
+
+	srv.Lockdown = LockdownState{MaintenanceAt: time.Now().Add(time.Hour)}
+	if joinBlocked(stranger) != "" {
+		t.Error("维护开始之前应该可以加入")
+	}
+	srv.Lockdown.MaintenanceAt = time.Now().Add(-time.Second)
+	if joinBlocked(stranger) == "" || postBlocked(stranger) != "" {
+		t.Error("维护期间应该阻止加入，但不阻止发送消息")
+	}
+
+	if at, ok := parseMaintenanceTime("10m", stranger); !ok || time.Until(at) < 9*time.Minute {
+		t.Error("应该可以解析时长")
+	}
+	if at, ok := parseMaintenanceTime("23:30", stranger); !ok || at.Before(time.Now()) || time.Until(at) > 24*time.Hour {
+		t.Error("应该可以解析时间:", at)
+	}
+	if _, ok := parseMaintenanceTime("soon", stranger); ok {
+		t.Error("无效的时间应该返回错误")
+	}
+
+	// the commands tell every room once the lockdown is changed
+	srv.Lockdown = LockdownState{}
+	tim, bob := joinTestUser(srv, "tim", "adminid"), joinTestUser(srv, "bob", "strangerid")
+	runCommands("lockdown -p spam", tim.User)
+	if !bob.saw("服务器已锁定，新的连接将被拒绝: spam。只有管理员和允许列表中的用户可以发送消息") {
+		t.Error("锁定应该广播给所有用户")
+	}
+	runCommands("hello", bob.User)
+	if tim.saw("hello") {
+		t.Error("锁定时不受信任的用户不应该可以发送消息")
+	}
+	runCommands("lockdown off", tim.User)
+	if !bob.saw("服务器锁定已解除") {
+		t.Error("解除锁定应该广播给所有用户")
+	}
+	runCommands("maintenance 10m", tim.User)
+	if !bob.saw("后进入维护模式") {
+		t.Error("维护倒计时应该广播给所有用户")
+	}
+	runCommands("maintenance off", tim.User)
+	if !bob.saw("维护已取消") {
+		t.Error("取消维护应该广播给所有用户")
+	}
+}
+
+func TestConnCounter(t *testing.T) {
+	c := newConnCounter()
+	if n := c.recordJoin("1.2.3.4", "tim"); n != 1 {
+		t.Error("第一次加入应该计为 1, 得到", n)
+	}
+	c.recordJoin("1.2.3.4", "tom")
+	if n := c.recordJoin("5.6.7.8", "tim"); n != 2 {
+		t.Error("应该返回所有键中最高的计数, 得到", n)
+	}
+	if n := c.recordJoin("1.2.3.4", "carol"); n != 3 {
+		t.Error("同一 IP 的加入应该一起计数, 得到", n)
+	}
+
+	limits := ThrottleConfig{MaxSessionsPerID: 2, MaxSessionsPerIP: 3, MaxConnections: 3}
+	for i, want := range []string{"", "", "太多会话"} {
+		if got := c.acquire("tim", "1.2.3.4", false, limits); !strings.Contains(got, want) || (want == "") != (got == "") {
+			t.Errorf("tim 的第 %d 个会话: 得到 %q", i+1, got)
+		}
+	}
+	if got := c.acquire("tom", "1.2.3.4", false, limits); got != "" {
+		t.Error("tom 应该可以连接:", got)
+	}
+	if got := c.acquire("carol", "1.2.3.4", false, limits); !strings.Contains(got, "服务器已满") {
+		t.Error("应该达到最大连接数:", got)
+	}
+	if got := c.acquire("admin", "5.6.7.8", true, limits); got != "" {
+		t.Error("管理员不受最大连接数限制:", got)
+	}
+	if got := c.acquire("carol", "1.2.3.4", true, limits); !strings.Contains(got, "IP") {
+		t.Error("管理员也受每个 IP 的限制:", got)
+	}
+	c.release("tim", "1.2.3.4", false)
+	if got := c.acquire("carol", "9.9.9.9", false, limits); got != "" {
+		t.Error("释放之后应该可以再连接:", got)
+	}
+	c.release("tim", "1.2.3.4", false)
+	c.release("tom", "1.2.3.4", false)
+	c.release("carol", "9.9.9.9", false)
+	c.release("admin", "5.6.7.8", true)
+	if c.total != 0 || len(c.sessions) != 0 {
+		t.Error("全部释放之后不应该还有计数:", c.total, c.sessions)
+	}
+	c.acquire("1.2.3.4", "1.2.3.4", false, limits) // users without a key are counted by IP
+	c.release("1.2.3.4", "1.2.3.4", false)
+	if c.total != 0 || len(c.sessions) != 0 {
+		t.Error("ID 和 IP 相同时应该只计数一次:", c.total, c.sessions)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	configFile := filepath.Join(srv.Config().DataDir, "devzat.yml")
+	srv.configFile = configFile
+	if err := os.WriteFile(configFile, []byte("private: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, err := newInviteCode()
+	if err != nil || len(code) != inviteCodeLen {
+		t.Fatal("无效的邀请码:", code, err)
+	}
+	srv.Invites = []Invite{
+		{Code: code, MaxUses: 1, Role: RoleMember},
+		{Code: "expired", Expires: time.Now().Add(-time.Minute), Role: RoleMember},
+		{Code: "revoked", Revoked: true, Role: RoleMember},
+		{Code: "admin", Role: RoleAdmin},
+	}
+
+	tim, tom := &User{Name: "tim", id: "timid", srv: srv}, &User{Name: "tom", id: "tomid", srv: srv}
+	if !redeemInvite(strings.ToUpper(code)+" ", tim) {
+		t.Fatal("应该可以使用邀请码")
+	}
+	if _, ok := srv.Config().Allowlist["timid"]; !ok {
+		t.Error("应该被添加到允许列表")
+	}
+	if redeemInvite(code, tom) {
+		t.Error("邀请码只能使用一次")
+	}
+	if redeemInvite("expired", tom) || redeemInvite("revoked", tom) || redeemInvite("nope", tom) {
+		t.Error("过期、撤销或不存在的邀请码不能使用")
+	}
+	if !redeemInvite("admin", tom) || !auth(tom) {
+		t.Error("管理员邀请应该让用户成为管理员")
+	}
+	c, _, err := readConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Allowlist["timid"]; !ok {
+		t.Error("允许列表应该保存到配置文件")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+	c := ChallengeConfig{Questions: []ChallengeQuestion{{Question: "2 + 3 = ?", Answers: []string{"5", "five"}}}}
+	prompt, answers := pickChallenge(c)
+	if !strings.Contains(prompt, "2 + 3 = ?") {
+		t.Error("应该使用配置的问题:", prompt)
+	}
+	if !challengeAnswerOK(" FIVE ", answers) || challengeAnswerOK("6", answers) {
+		t.Error("答案检查不正确")
+	}
+	if _, answers = pickChallenge(ChallengeConfig{}); len(answers) != 1 {
+		t.Error("没有配置时应该使用内置的短语")
+	}
+
+	if got := stripLinks("look ![cat](http://x.com/cat.png) [here](https://x.com) https://evil.com/a?b www.x.com <img src=a>"); strings.Contains(got, "x.com") ||
+		strings.Contains(got, "evil") || strings.Contains(got, "img") || !strings.Contains(got, "cat") || !strings.Contains(got, "here") {
+		t.Error("链接应该被隐藏:", got)
+	}
+
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Challenge.ProbationMessages = 2 })
+	u := &User{ProbationUntil: time.Now().Add(time.Hour), srv: srv}
+	if !u.probationAllows() || !u.probationAllows() || u.probationAllows() {
+		t.Error("试用期用户应该被限制为每分钟 2 条消息")
+	}
+	u.ProbationUntil = time.Now().Add(-time.Second)
+	if !u.probationAllows() {
+		t.Error("试用期结束后不应该有限制")
+	}
+}
+
+// gatedWriter blocks writes until gate is closed, like a stalled client
+type gatedWriter struct {
+	dummyRW
+	gate chan struct{}
+	lock sync.Mutex
+	out  strings.Builder
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.out.Write(p)
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Outbox = OutboxConfig{Size: 3, Overflow: OverflowDropOldest} })
+
+	w := &gatedWriter{gate: make(chan struct{})}
+	u := &User{Name: "slow", term: terminal.NewTerminal(w, ""), srv: srv}
+	u.startOutbox()
+	defer u.outbox.shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			u.write([]byte("msg" + strconv.Itoa(i) + "\n"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("写入不应该等待慢速客户端")
+	}
+	close(w.gate)
+	u.outbox.flush(time.Second)
+	w.lock.Lock()
+	out := w.out.String()
+	w.lock.Unlock()
+	if !strings.Contains(out, "msg9") || !strings.Contains(out, "丢弃了") || strings.Contains(out, "msg5") {
+		t.Error("应该丢弃最旧的消息:", out)
+	}
+
+	c := OutboxConfig{Size: 3, Overflow: OverflowDisconnect}
+	ob := newOutbox()
+	for i := 0; i < 3; i++ {
+		if ob.push(outboxItem{data: []byte("x")}, c) {
+			t.Fatal("队列未满时不应该断开连接")
+		}
+	}
+	if !ob.push(outboxItem{data: []byte("x")}, c) || !ob.stopped {
+		t.Error("队列已满时应该断开连接")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	admin := &User{Name: "admin", id: "adminid", srv: srv}
+	srv.audit(admin, "ban", "tim", "timid", "spam")
+	srv.audit(nil, "kick", "tom", "tomid", "")
+	entries, err := srv.readAudit(func(e *AuditEntry) bool { return e.Action == "ban" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ActorID != "adminid" || entries[0].TargetID != "timid" || entries[0].Reason != "spam" {
+		t.Error("意外的审计记录:", entries)
+	}
+	entries, _ = srv.readAudit(func(e *AuditEntry) bool { return true })
+	if len(entries) != 2 || entries[1].Actor != "devbot" {
+		t.Error("意外的审计记录:", entries)
+	}
+}
+
+func TestAuditSelfModeration(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Admins = map[string]string{"adminid": "admin"} })
+	admin, tim := joinTestUser(srv, "admin", "adminid"), joinTestUser(srv, "tim", "timid")
+	muteCMD("tim", tim.User)
+	unmuteCMD("tim", tim.User)
+	kickCMD("tim", tim.User)
+	if entries, _ := srv.readAudit(func(e *AuditEntry) bool { return true }); len(entries) != 0 {
+		t.Error("用户对自己的操作不应该被记录:", entries)
+	}
+	tim = joinTestUser(srv, "tim", "timid")
+	muteCMD("tim", admin.User)
+	kickCMD("tim", admin.User)
+	if entries, _ := srv.readAudit(func(e *AuditEntry) bool { return e.ActorID == "adminid" }); len(entries) != 2 {
+		t.Error("管理员的操作应该被记录:", entries)
+	}
+}
+
+func TestReports(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Admins = map[string]string{"adminid": "admin"} })
+	admin, tim, tom := joinTestUser(srv, "admin", "adminid"), joinTestUser(srv, "tim", "timid"), joinTestUser(srv, "tom", "tomid")
+	numeric := joinTestUser(srv, "123", "numid")
+
+	runCommands("something rude", tim.User)
+	id := srv.MainRoom.recentMessages(1)[0].id
+	tim.saw("")
+	runCommands("report", tom.User)
+	if !tom.saw("#" + strconv.Itoa(id) + ". tim: something rude") {
+		t.Error("report 应该列出最近消息的 ID")
+	}
+	runCommands("report #"+strconv.Itoa(id)+" rude", tom.User)
+	if !tom.saw("你的举报已发送给管理员") || !admin.saw("新举报 #1: tom 举报了 tim") || tim.saw("") {
+		t.Error("举报应该只通知管理员")
+	}
+	runCommands("report 123 spam", tom.User)
+	runCommands("report #999999 nope", tom.User)
+	if !tom.saw("找不到该消息") {
+		t.Error("不存在的消息 ID 应该报错")
+	}
+
+	srv.reportsMutex.Lock()
+	srv.Reports = nil
+	srv.reportsMutex.Unlock()
+	srv.readReports() // reports are saved as they are made
+	srv.reportsMutex.Lock()
+	reports := srv.Reports
+	srv.reportsMutex.Unlock()
+	if len(reports) != 2 || reports[0].MessageID != id || reports[0].TargetID != "timid" || reports[1].TargetID != numeric.id {
+		t.Fatal("意外的举报:", reports)
+	}
+	if len(reports[0].Context) == 0 || !strings.Contains(reports[0].Context[len(reports[0].Context)-1], "something rude") {
+		t.Error("举报应该包含上下文:", reports[0].Context)
+	}
+
+	reportsCMD("", tom.User)
+	runCommands("report show 1", tom.User)
+	runCommands("report resolve 1", tom.User)
+	if tom.saw("举报了") {
+		t.Error("非管理员不应该看到举报")
+	}
+	reportsCMD("", admin.User)
+	if !admin.saw("tom 举报了 123") {
+		t.Error("reports 应该列出待处理的举报")
+	}
+	runCommands("report show #1", admin.User)
+	if !admin.saw("something rude") {
+		t.Error("report show 应该显示上下文")
+	}
+	runCommands("report resolve 1 warned tim", admin.User)
+	reportsCMD("", admin.User)
+	if admin.saw("tom 举报了 tim") {
+		t.Error("已处理的举报不应该再列出")
+	}
+	if entries, _ := srv.readAudit(func(e *AuditEntry) bool { return e.Action == "resolve-report" }); len(entries) != 1 || entries[0].TargetID != "timid" {
+		t.Error("处理举报应该被审计:", entries)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	err := srv.applyFilters(FilterConfig{
+		Policy:   PolicyCensor,
+		Rooms:    map[string]string{"#strict": PolicyBlock, "#wild": PolicyOff},
+		Deny:     []string{"frobnicate"},
+		Patterns: []string{`bad\d+`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, blocked := srv.filterMessage(srv.MainRoom, "frobnicate bad42 ok"); blocked || msg != "********** ***** ok" {
+		t.Error("应该被审查:", msg, blocked)
+	}
+	if _, blocked := srv.filterMessage(&Room{name: "#strict"}, "bad42"); !blocked {
+		t.Error("应该被阻止")
+	}
+	if msg, blocked := srv.filterMessage(&Room{name: "#wild"}, "frobnicate"); blocked || msg != "frobnicate" {
+		t.Error("不应该被过滤:", msg, blocked)
+	}
+	if err = srv.applyFilters(FilterConfig{Patterns: []string{"("}}); err == nil {
+		t.Error("无效的正则表达式应该返回错误")
+	}
+
+	if msg, _ := srv.filterMessage(srv.MainRoom, "the cockpit is here"); msg == "the cockpit is here" {
+		t.Fatal("默认情况下 cockpit 应该被审查") // otherwise the allow case below tests nothing
+	}
+	if err = srv.applyFilters(FilterConfig{Policy: PolicyCensor, Allow: []string{"Cockpit"}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := srv.filterMessage(srv.MainRoom, "the cockpit is here"); msg != "the cockpit is here" {
+		t.Error("允许的词不应该被审查:", msg)
+	}
+}
+
+func TestFilterConcurrentEdits(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Admins = map[string]string{"adminid": "admin"} })
+	admin := joinTestUser(srv, "admin", "adminid")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			filterCMD("add deny word"+strconv.Itoa(i), admin.User)
+		}(i)
+	}
+	wg.Wait()
+	srv.filtersMutex.RLock()
+	defer srv.filtersMutex.RUnlock()
+	if len(srv.Filters.Deny) != 20 {
+		t.Error("同时进行的编辑不应该丢失:", srv.Filters.Deny)
+	}
+}
+
+func TestImagePolicy(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, img) //nolint:errcheck
+	}))
+	defer ts.Close()
+	srv := newTestServer(t)
+
+	var blocked errImageBlocked
+	if _, err := srv.fetchImage(ts.URL); !errors.As(err, &blocked) {
+		t.Error("本地地址应该被阻止:", err)
+	}
+	if _, err := srv.fetchImage("http://[::1]/x.png"); !errors.As(err, &blocked) {
+		t.Error("本地地址应该被阻止:", err)
+	}
+	for addr, private := range map[string]bool{
+		"100.64.0.1": true, "100.127.255.254": true, "::ffff:100.100.1.1": true, "10.0.0.1": true,
+		"100.128.0.1": false, "100.63.255.255": false, "8.8.8.8": false, "2001:4860::8888": false,
+	} {
+		if isPrivateIP(net.ParseIP(addr)) != private {
+			t.Error(addr, "应该是内部地址:", private)
+		}
+	}
+	srv.updateConfig(func(c *ConfigType) { c.Images.AllowPrivate = true })
+	if _, err := srv.fetchImage(ts.URL); err != nil {
+		t.Error(err)
+	}
+	srv.updateConfig(func(c *ConfigType) { c.Images.MaxWidth = 2 })
+	if _, err := srv.fetchImage(ts.URL); err == nil {
+		t.Error("图像应该太大")
+	}
+	srv.updateConfig(func(c *ConfigType) { c.Images.DenyDomains = []string{"example.com"} })
+	if _, err := srv.fetchImage("https://img.example.com/a.png"); !errors.As(err, &blocked) {
+		t.Error("域名应该被拒绝:", err)
+	}
+	srv.updateConfig(func(c *ConfigType) {
+		c.Images.DenyDomains = nil
+		c.Images.AllowDomains = []string{"example.org"}
+	})
+	if _, err := srv.fetchImage("https://example.com/a.png"); !errors.As(err, &blocked) {
+		t.Error("域名应该不在允许列表中:", err)
+	}
+}
+
+func TestImageStore(t *testing.T) {
+	t.Parallel()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	var requests int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		png.Encode(w, img) //nolint:errcheck
+	}))
+	defer ts.Close()
+	srv := newTestServer(t)
+	srv.updateConfig(func(c *ConfigType) { c.Images.AllowPrivate = true })
+
+	msg := "![](" + ts.URL + "/a.png)"
+	md, pending := srv.mdRender(msg, 0, 80, true)
+	if len(pending) != 1 || !strings.Contains(md, "正在加载图像") {
+		t.Fatal("图像应该在后台获取:", md)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := srv.images.wait(ts.URL + "/a.png"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("同一图像应该只获取一次，但获取了", n, "次")
+	}
+	if md, pending = srv.mdRender(msg, 0, 80, true); len(pending) != 0 || strings.Contains(md, "正在加载图像") {
+		t.Error("图像应该已经准备好:", md)
+	}
+
+	srv.images = newImageStore(srv) // as if the server restarted
+	if _, err := srv.images.wait(ts.URL + "/a.png"); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Error("图像应该从磁盘缓存中加载")
+	}
+
+	srv.updateConfig(func(c *ConfigType) { c.Images.DiskCache = 1 }) // too small for anything
+	srv.images.saveCachedImage(ts.URL+"/b.png", []byte("xx"))
+	if _, err := os.Stat(srv.images.cachedImageFile(ts.URL + "/b.png")); err == nil {
+		t.Error("超出磁盘缓存大小的图像不应该被保存")
+	}
+}
+
+func TestCdWhileClosing(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	bob := joinTestUser(srv, "bob", "bobid")
+	carol := joinTestUser(srv, "carol", "carolid")
+	runCommands("cd #elsewhere", carol.User)
+	for i := 0; i < 50; i++ {
+		bob.saw("")
+		carol.saw("")
+		tim := joinTestUser(srv, "tim", "timid")
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			runCommands("cd #elsewhere", tim.User)
+		}()
+		go func() {
+			defer wg.Done()
+			tim.close("tim 已离开聊天")
+		}()
+		wg.Wait()
+		if _, ok := srv.Rooms.findUser("tim"); ok {
+			t.Fatal("关闭的用户不应该留在任何房间里")
+		}
+		if left := bob.saw("tim 已离开聊天"); left == carol.saw("tim 已离开聊天") {
+			t.Fatal("离开的消息应该只发送到用户最后所在的房间")
+		}
+	}
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	t.Parallel()
+	srv := newTestServer(t)
+	main := srv.MainRoom
+
+	dummyTerm := terminal.NewTerminal(dummyRW{}, "")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := &User{Name: "u" + strconv.Itoa(i), id: strconv.Itoa(i % 5), term: dummyTerm, winWidth: 80, srv: srv}
+			srv.Rooms.join(u, main)
+			for j := 0; j < 50; j++ {
+				r := srv.Rooms.getOrCreate("#r" + strconv.Itoa(j%3))
+				srv.Rooms.move(u, r)
+				r.broadcast("", "hi from "+u.Name)
+				srv.Rooms.findUser("u3")
+				srv.Rooms.findByID("1")
+				srv.Rooms.removeRoom("#r" + strconv.Itoa((j+1)%3)) //nolint:errcheck // fails while someone is in it
+				if j%10 == 0 {
+					srv.Rooms.leave(u)
+					srv.Rooms.join(u, main)
+				}
+			}
+			srv.Rooms.leave(u)
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			main.broadcast("", "announcement")
+			_ = srv.Rooms.all()
+		}
+	}()
+	wg.Wait()
+
+	if n := len(srv.Rooms.users()); n != 0 {
+		t.Error("所有用户都应该已经离开，但还有", n)
+	}
+	if err := srv.Rooms.removeRoom("#main"); err == nil {
+		t.Error("不应该删除主房间")
+	}
+}
+
+/* ------------------------- Rendering large rooms -------------------------- */
+
+func TestRenderCache(t *testing.T) {
+	t.Parallel()
+	c := newRenderCache(2)
+	a, b, d := renderKey{msg: "a"}, renderKey{msg: "b"}, renderKey{msg: "d"}
+	c.add(a, "A")
+	c.add(b, "B")
+	c.get(a) // a is now the most recently used
+	c.add(d, "D")
+	if _, ok := c.get(b); ok {
+		t.Error("应该删除最近最少使用的消息")
+	}
+	if s, ok := c.get(a); !ok || s != "A" {
+		t.Error("应该保留最近使用的消息")
+	}
+	srv := newTestServer(t)
+	first, _ := srv.mdRender("**hi**", 5, 80, true)
+	if second, _ := srv.mdRender("**hi**", 5, 80, true); first != second {
+		t.Error("缓存的渲染结果应该相同")
+	}
+
+	for wrap := 10; wrap < 10+2*maxRenderers; wrap++ {
+		if _, err := renderMarkdown("**hi**", wrap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	renderersMutex.Lock()
+	defer renderersMutex.Unlock()
+	if len(renderers) > maxRenderers || renderersOrder.Len() != len(renderers) {
+		t.Error("不应该保留每个宽度的渲染器:", len(renderers))
+	}
+}
+
+func makeLargeRoom(srv *Server, n int) *Room {
+	r := &Room{name: "#bench", srv: srv}
+	dummyTerm := terminal.NewTerminal(dummyRW{}, "")
+	for i := 0; i < n; i++ {
+		u := &User{Name: "user" + strconv.Itoa(i), term: dummyTerm, winWidth: 80 + i%3, srv: srv}
+		u.inRoom.Store(r)
+		r.users = append(r.users, u)
+	}
+	return r
+}
+
+func benchmarkBroadcast(b *testing.B, cacheSize int) {
+	srv := newTestServer(b)
+	r := makeLargeRoom(srv, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srv.renders = newRenderCache(cacheSize) // every message is new
+		r.broadcastNoBridges("someone", "Check out **this** _message_ with `code` and a [link](https://example.com) "+strconv.Itoa(i))
+	}
+}
+
+func BenchmarkBroadcast50UsersUncached(b *testing.B) { benchmarkBroadcast(b, 0) }
+
+func BenchmarkBroadcast50UsersCached(b *testing.B) { benchmarkBroadcast(b, renderCacheSize) }
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acarl005/stripansi"
+	"github.com/bwmarrin/discordgo"
+	"github.com/leaanthony/go-ansi-parser"
+	"github.com/quackduck/term"
+	"golang.org/x/image/draw"
+)
+
+type DiscordMsg struct {
+	senderName string
+	msg        string
+	channel    string
+}
+
+// discordBridge relays messages between the main room and a Discord channel. A new one is made whenever the
+// Discord config changes, and the old one is stopped.
+type discordBridge struct {
+	srv     *Server
+	info    DiscordInfo
+	sess    *discordgo.Session
+	webhook *discordgo.Webhook // nil in compact mode
+	out     chan DiscordMsg    // messages to send to Discord
+	done    chan struct{}      // closed by stop
+	wg      sync.WaitGroup
+
+	handling sync.Mutex // held while a message from Discord is handled
+	stopped  bool
+	user     *User // sends the messages from Discord, renamed for each one
+
+	avatars []discordAvatar // only used when sending
+}
+
+// newDiscordBridge connects to Discord, returning nil if Discord isn't configured or can't be connected to
+func (srv *Server) newDiscordBridge(info *DiscordInfo) *discordBridge {
+	if info == nil {
+		return nil
+	}
+
+	sess, err := discordgo.New("Bot " + info.Token)
+	if err != nil {
+		srv.Log.Println("Error creating Discord session:", err)
+		return nil
+	}
+
+	b := &discordBridge{
+		srv:  srv,
+		info: *info,
+		sess: sess,
+		out:  make(chan DiscordMsg, 100),
+		done: make(chan struct{}),
+		user: &User{srv: srv, isBridge: true},
+	}
+	b.user.inRoom.Store(srv.MainRoom)
+	devnull, _ := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	b.user.term = term.NewTerminal(devnull, "")
+
+	sess.AddHandler(b.messageHandler)
+	sess.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentGuildWebhooks // listen to messages, manage webhooks
+	err = sess.Open()
+	if err != nil {
+		srv.Log.Println("Error opening Discord session:", err)
+		return nil
+	}
+
+	// get or create a webhook if we're not in compact mode
+	if !info.CompactMode {
+		webhooks, err := sess.ChannelWebhooks(info.ChannelID)
+		if err != nil {
+			srv.Log.Println("Error getting Discord webhooks:", err)
+			b.stop()
+			return nil
+		}
+		for _, wh := range webhooks {
+			if wh.Name == "Devzat" {
+				b.webhook = wh
+			}
+		}
+		if b.webhook == nil {
+			b.webhook, err = sess.WebhookCreate(info.ChannelID, "Devzat", "")
+			if err != nil {
+				srv.Log.Println("Error creating a Discord webhook:", err)
+				b.stop()
+				return nil
+			}
+		}
+	}
+	b.wg.Add(1)
+	go b.send()
+	srv.Log.Println("Connected to Discord with bot ID", sess.State.User.ID, "as", sess.State.User.Username)
+	return b
+}
+
+// stop disconnects from Discord and waits for messages being sent or handled
+func (b *discordBridge) stop() {
+	b.sess.Close() //nolint:errcheck
+	b.handling.Lock()
+	b.stopped = true // the session may still deliver a message it already read
+	b.handling.Unlock()
+	close(b.done)
+	b.wg.Wait()
+}
+
+// relay queues msg to be sent to Discord, dropping it if the queue is full
+func (b *discordBridge) relay(msg DiscordMsg) {
+	select {
+	case b.out <- msg:
+	default:
+		b.srv.Log.Println("Discord 频道溢出")
+	}
+}
+
+func (b *discordBridge) send() {
+	defer b.wg.Done()
+	srv, sess, webhook := b.srv, b.sess, b.webhook
+	overloading := false
+	for {
+		var msg DiscordMsg
+		select {
+		case <-b.done:
+			return
+		case msg = <-b.out:
+		}
+		var err error
+		sendingTimeStart := time.Now()
+		txt := strings.ReplaceAll(msg.msg, "@everyone", "@\\everyone")
+		if b.info.CompactMode || overloading {
+			var toSend string
+			if msg.senderName == "" {
+				toSend = strings.ReplaceAll(stripansi.Strip("["+msg.channel+"] "+txt), `\n`, "\n")
+			} else {
+				toSend = strings.ReplaceAll(stripansi.Strip("["+msg.channel+"] **"+msg.senderName+"**: "+txt), `\n`, "\n")
+			}
+			_, err = sess.ChannelMessageSend(b.info.ChannelID, toSend)
+			if err != nil {
+				srv.Log.Println("Error sending Discord message:", err)
+			}
+		} else {
+			// discord allows for 30 webhook edits per minute: https://twitter.com/lolpython/status/967621046277820416
+			if len(b.out) < 5 { // rate-limit the edits
+				avatarFor := msg.senderName
+				//if len(DiscordChan) == 9 { // blank out pfp if we're about to hit the limit
+				//	avatarFor = ""
+				//}
+				//Log.Println("before edit")
+				//_, err = sess.WebhookEditWithToken(webhook.ID, webhook.Token, webhook.Name, createDiscordImage(avatarFor))
+				_, err = sess.WebhookEdit(webhook.ID, webhook.Name, b.createDiscordImage(avatarFor), webhook.ChannelID, discordgo.WithRetryOnRatelimit(true))
+				if err != nil {
+					srv.Log.Println("Error modifying Discord webhook:", err)
+				}
+				//Log.Println("after edit", msg.msg)
+			}
+			_, err = sess.WebhookExecute(webhook.ID, webhook.Token, false,
+				&discordgo.WebhookParams{
+					Content:  strings.ReplaceAll(stripansi.Strip(txt), `\n`, "\n"),
+					Username: stripansi.Strip("[" + msg.channel + "] " + msg.senderName),
+				},
+				discordgo.WithRetryOnRatelimit(true),
+			)
+			if err != nil {
+				srv.Log.Println("Error sending Discord message:", err)
+			}
+		}
+		elaspsedTime := time.Since(sendingTimeStart)
+		if elaspsedTime.Seconds() > 20 {
+			overloading = true
+		}
+		if len(b.out) == 0 && elaspsedTime.Seconds() < 10 {
+			overloading = false
+		}
+	}
+}
+
+func (b *discordBridge) messageHandler(_ *discordgo.Session, m *discordgo.MessageCreate) {
+	if m == nil || m.Author == nil || m.Author.Bot || m.ChannelID != b.info.ChannelID { // ignore self and other channels
+		return
+	}
+	b.handling.Lock()
+	defer b.handling.Unlock()
+	if b.stopped {
+		return
+	}
+	h := sha1.Sum([]byte(m.Author.ID))
+	i, _ := strconv.ParseInt(hex.EncodeToString(h[:2]), 16, 0) // two bytes as an int
+	name := m.Author.Username
+	if m.Member != nil && m.Member.Nick != "" {
+		name = m.Member.Nick
+	}
+	b.user.Name = Magenta.Paint(b.info.Prefix+" ") + (Styles[int(i)%len(Styles)]).apply(name)
+
+	msgContent := strings.TrimSpace(m.ContentWithMentionsReplaced())
+	if s := b.srv.slack.Load(); s != nil {
+		s.relay(b.info.Prefix + " " + name + ": " + msgContent) // send this discord message to slack
+	}
+	runCommands(msgContent, b.user)
+}
+
+var cacheSize = 20
+
+// discordAvatar is an entry in the basic cache of avatars made from usernames
+type discordAvatar struct {
+	user  string
+	image string
+}
+
+func (b *discordBridge) createDiscordImage(user string) string {
+	// a completely transparent one pixel png
+	fallback := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAAEUlEQVR4nGJiYGBgAAQAAP//AA8AA/6P688AAAAASUVORK5CYII="
+	if user == "" {
+		// make messages with no sender (eg. command outputs) look seamless
+		return fallback
+	}
+	for i := range b.avatars {
+		if b.avatars[i].user == user {
+			return b.avatars[i].image
+		}
+	}
+	styledTexts, err := ansi.Parse(user)
+	if err != nil {
+		b.srv.Log.Println("Error parsing ANSI from username while creating Discord avatar:", err)
+		return fallback
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, len(styledTexts), 3))
+
+	for i := 0; i < len(styledTexts); i++ {
+		for j := 0; j < 3 && styledTexts[i].FgCol != nil; j++ {
+			col := styledTexts[i].FgCol
+			if (j == 0 || j == 2) && styledTexts[i].BgCol != nil {
+				col = styledTexts[i].BgCol
+			}
+			img.Set(i, j, color.NRGBA{R: col.Rgb.R, G: col.Rgb.G, B: col.Rgb.B, A: 255})
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	//(&draw.Kernel{
+	//	Support: 10,
+	//	At: func(t float64) float64 {
+	//		return math.Exp(-t * t * 2)
+	//	},
+	//}).Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
+	//draw.BiLinear.Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
+	draw.CatmullRom.Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
+	//draw.NearestNeighbor.Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
+	buff := new(bytes.Buffer)
+	err = png.Encode(buff, dst)
+	if err != nil {
+		b.srv.Log.Println("Error creating Discord avatar:", err)
+		return fallback
+	}
+	result := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buff.Bytes())
+
+	if len(b.avatars) >= cacheSize {
+		// remove the first value
+		b.avatars = b.avatars[1:]
+	}
+	b.avatars = append(b.avatars, discordAvatar{user: user, image: result})
+	//Log.Println("returned", result)
+	return result
+}
@@ -0,0 +1,790 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "devzat/plugin"
+
+	"github.com/acarl005/stripansi"
+	"github.com/caarlos0/sshmarshal"
+	cryptoSSH "golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const e2eTimeout = 5 * time.Second
+
+// testServer is a chat server listening on an ephemeral port with its own data dir
+type testServer struct {
+	t    *testing.T
+	srv  *Server
+	addr string
+}
+
+// startTestServer starts a server with a fresh config and state. admins are the keys of clients that
+// should be admins. The server is shut down when the test ends.
+func startTestServer(t *testing.T, admins ...ed25519.PrivateKey) *testServer {
+	return startTestServerWith(t, IntegrationsType{}, admins...)
+}
+
+// startTestServerWith is like startTestServer but with integrations enabled
+func startTestServerWith(t *testing.T, integrations IntegrationsType, admins ...ed25519.PrivateKey) *testServer {
+	c := testConfig(t)
+	for _, key := range admins {
+		c.Admins[keyID(t, key)] = "test admin"
+	}
+	return runTestServer(t, c, integrations)
+}
+
+// testConfig returns a config for a server on an ephemeral port with its own data dir
+func testConfig(t *testing.T) ConfigType {
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.Port = 0
+	c.AltPort = 0
+	c.DataDir = dir
+	c.KeyFile = filepath.Join(dir, "devzat-sshkey")
+	c.Reputation = nil
+	c.Throttle = ThrottleConfig{Action: "delay"}
+	c.Admins = make(map[string]string)
+	return c
+}
+
+func runTestServer(t *testing.T, c ConfigType, integrations IntegrationsType) *testServer {
+	srv, err := NewServer(c, integrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, errShutDown) {
+			t.Error("关闭服务器时出错:", err)
+		}
+	})
+	port := srv.Addr().(*net.TCPAddr).Port
+	return &testServer{t: t, srv: srv, addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+}
+
+// restart restarts the server with the same config and data dir, on a new port
+func (s *testServer) restart() *testServer {
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	if err := s.srv.Restart(ctx); err != nil {
+		s.t.Fatal(err)
+	}
+	return runTestServer(s.t, *s.srv.Config(), *s.srv.Integrations())
+}
+
+// writeHostKey makes a host key for a server and returns its public key in authorized_keys format
+func writeHostKey(t *testing.T, file string) string {
+	priv, pub, err := genKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := sshmarshal.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(file, pem.EncodeToMemory(blk), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return string(cryptoSSH.MarshalAuthorizedKey(pub))
+}
+
+// startFederation starts a server called each of names, sharing #main. Each link is a pair of names where
+// the first server connects to the second, so servers can only connect to servers that come after them.
+// It returns once all the links are up.
+func startFederation(t *testing.T, names []string, links [][2]string) map[string]*testServer {
+	configs := make(map[string]ConfigType)
+	keys := make(map[string]string)
+	for _, name := range names {
+		c := testConfig(t)
+		c.Federation = FederationConfig{Name: name, Rooms: []string{"#main"}}
+		configs[name] = c
+		keys[name] = writeHostKey(t, c.KeyFile)
+	}
+	servers := make(map[string]*testServer)
+	for i := len(names) - 1; i >= 0; i-- {
+		c := configs[names[i]]
+		for _, l := range links {
+			if l[0] == names[i] {
+				c.Federation.Peers = append(c.Federation.Peers, FederationPeer{Name: l[1], Addr: servers[l[1]].addr, Key: keys[l[1]]})
+			} else if l[1] == names[i] {
+				c.Federation.Peers = append(c.Federation.Peers, FederationPeer{Name: l[0], Key: keys[l[0]]})
+			}
+		}
+		configs[names[i]] = c
+		servers[names[i]] = runTestServer(t, c, IntegrationsType{})
+	}
+	for _, l := range links {
+		servers[l[0]].waitForLink(l[1])
+		servers[l[1]].waitForLink(l[0])
+	}
+	return servers
+}
+
+// waitForLink waits until the server is linked to the peer called name
+func (s *testServer) waitForLink(name string) {
+	s.t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for s.srv.federation.link(name) == nil {
+		if time.Now().After(deadline) {
+			s.t.Fatal(s.srv.Config().Federation.Name, "没有连接到", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// keyID returns the ID a user connecting with key gets
+func keyID(t *testing.T, key ed25519.PrivateKey) string {
+	signer, err := cryptoSSH.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shasum(string(signer.PublicKey().Marshal()))
+}
+
+// testClient is an SSH client with a terminal, like someone chatting
+type testClient struct {
+	t       *testing.T
+	name    string
+	conn    *cryptoSSH.Client
+	session *cryptoSSH.Session
+	stdin   io.WriteCloser
+	stderr  bytes.Buffer // only safe to read after wait
+
+	lock   sync.Mutex
+	out    strings.Builder // everything received, with escape codes stripped
+	seen   int             // how much of out has been matched by expect
+	closed bool
+	update chan struct{}
+}
+
+// dial connects to the server without waiting to join
+func (s *testServer) dial(name string, key ed25519.PrivateKey) *testClient {
+	return s.dialSession(name, key, true, "")
+}
+
+// dialSession connects, with a terminal if pty is set, and runs cmd or a shell if cmd is empty
+func (s *testServer) dialSession(name string, key ed25519.PrivateKey, pty bool, cmd string) *testClient {
+	t := s.t
+	signer, err := cryptoSSH.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cryptoSSH.Dial("tcp", s.addr, &cryptoSSH.ClientConfig{
+		User:            name,
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.PublicKeys(signer)},
+		HostKeyCallback: cryptoSSH.InsecureIgnoreHostKey(), //nolint:gosec // test server
+		Timeout:         e2eTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, name: name, conn: conn, update: make(chan struct{}, 1)}
+	t.Cleanup(func() { conn.Close() })
+	if c.session, err = conn.NewSession(); err != nil {
+		t.Fatal(err)
+	}
+	if pty {
+		if err = c.session.RequestPty("xterm-256color", 50, 200, cryptoSSH.TerminalModes{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.session.Stderr = &c.stderr
+	if c.stdin, err = c.session.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := c.session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd == "" {
+		err = c.session.Shell()
+	} else {
+		err = c.session.Start(cmd)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.read(stdout)
+	return c
+}
+
+// join connects and waits until the client is in the chat
+func (s *testServer) join(name string, key ed25519.PrivateKey) *testClient {
+	c := s.dial(name, key)
+	c.expect("欢迎来到聊天室")
+	return c
+}
+
+func (c *testClient) read(stdout io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := stdout.Read(buf)
+		c.lock.Lock()
+		c.out.Write(buf[:n])
+		if err != nil {
+			c.closed = true
+		}
+		c.lock.Unlock()
+		select {
+		case c.update <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *testClient) send(line string) {
+	if _, err := io.WriteString(c.stdin, line+"\r"); err != nil {
+		c.t.Fatal(c.name, "发送失败:", err)
+	}
+}
+
+// sendJSON sends a line in JSON mode
+func (c *testClient) sendJSON(line string) {
+	if _, err := io.WriteString(c.stdin, line+"\n"); err != nil {
+		c.t.Fatal(c.name, "发送失败:", err)
+	}
+}
+
+// expectEvent waits for an event in JSON mode with the fields that are set in want. Text only has to be
+// contained in the event's text.
+func (c *testClient) expectEvent(want chatEvent) {
+	c.t.Helper()
+	deadline := time.After(e2eTimeout)
+	for {
+		c.lock.Lock()
+		out := c.out.String()
+		for c.seen < len(out) {
+			end := strings.IndexByte(out[c.seen:], '\n')
+			if end < 0 {
+				break
+			}
+			line := out[c.seen : c.seen+end]
+			c.seen += end + 1
+			var ev chatEvent
+			if json.Unmarshal([]byte(line), &ev) != nil {
+				continue
+			}
+			if (want.Type == "" || want.Type == ev.Type) && (want.Room == "" || want.Room == ev.Room) &&
+				(want.From == "" || want.From == ev.From) && (want.To == "" || want.To == ev.To) &&
+				(want.Name == "" || want.Name == ev.Name) && (want.OldName == "" || want.OldName == ev.OldName) &&
+				strings.Contains(ev.Text, want.Text) {
+				c.lock.Unlock()
+				return
+			}
+		}
+		closed := c.closed
+		c.lock.Unlock()
+		if closed {
+			c.t.Fatalf("%s 在收到 %+v 之前断开了连接", c.name, want)
+		}
+		select {
+		case <-c.update:
+		case <-deadline:
+			c.t.Fatalf("%s 没有收到 %+v, 输出:\n%s", c.name, want, out)
+		}
+	}
+}
+
+// expect waits for text to appear in the output after whatever the last expect matched
+func (c *testClient) expect(text string) {
+	c.t.Helper()
+	deadline := time.After(e2eTimeout)
+	for {
+		c.lock.Lock()
+		out := stripansi.Strip(c.out.String())
+		closed := c.closed
+		if i := strings.Index(out[c.seen:], text); i >= 0 {
+			c.seen += i + len(text)
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+		if closed {
+			c.t.Fatalf("%s 在收到 %q 之前断开了连接, 输出:\n%s", c.name, text, out[c.seen:])
+		}
+		select {
+		case <-c.update:
+		case <-deadline:
+			c.t.Fatalf("%s 没有收到 %q, 输出:\n%s", c.name, text, out[c.seen:])
+		}
+	}
+}
+
+// count returns how many times text has been received
+func (c *testClient) count(text string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return strings.Count(stripansi.Strip(c.out.String()), text)
+}
+
+// wait waits for the command to finish, returning its error like exec.Cmd.Wait
+func (c *testClient) wait() error {
+	c.t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- c.session.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(e2eTimeout):
+		c.t.Fatal(c.name, "的命令没有结束")
+		return nil
+	}
+}
+
+// expectClosed waits for the server to close the session
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	deadline := time.After(e2eTimeout)
+	for {
+		c.lock.Lock()
+		closed := c.closed
+		c.lock.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case <-c.update:
+		case <-deadline:
+			c.t.Fatal(c.name, "应该被断开连接")
+		}
+	}
+}
+
+func TestE2ERoomsAndDMs(t *testing.T) {
+	t.Parallel()
+	s := startTestServer(t)
+	alice := s.join("alice", newTestKey(t))
+	bob := s.join("bob", newTestKey(t))
+	alice.expect("bob 已加入聊天")
+
+	alice.send("hello everyone")
+	bob.expect("alice: hello everyone")
+
+	alice.send("cd #rust")
+	bob.expect("alice 正在加入 #rust")
+	alice.expect("alice 已加入 #rust")
+	bob.send("cd #rust")
+	alice.expect("bob 已加入 #rust")
+	alice.send("hi in rust")
+	bob.expect("alice: hi in rust")
+
+	bob.send("=alice psst")
+	alice.expect("bob -> psst")
+	bob.expect("alice <- psst")
+
+	alice.send("nick alicia")
+	bob.expect("alice: nick alicia")
+	alice.send("new name")
+	bob.expect("alicia: new name")
+	bob.send("=alicia still there?")
+	alice.expect("bob -> still there?")
+}
+
+func TestE2EBan(t *testing.T) {
+	t.Parallel()
+	adminKey, bobKey := newTestKey(t), newTestKey(t)
+	s := startTestServer(t, adminKey)
+	admin := s.join("admin", adminKey)
+	bob := s.join("bob", bobKey)
+
+	bob.send("ban admin")
+	bob.expect("未授权")
+	admin.send("ban bob spamming")
+	admin.expect("bob 已被 admin")
+	bob.expectClosed()
+
+	again := s.dial("bob", bobKey)
+	again.expect("您被禁止了")
+	again.expectClosed()
+
+	post := s.dialSession("bob", bobKey, false, "post #main still here")
+	if err := post.wait(); err == nil {
+		t.Fatal("被禁止的用户应该不能发消息")
+	}
+	admin.send("hi")
+	admin.expect("admin: hi")
+	if admin.count("still here") != 0 {
+		t.Fatal("被禁止的用户发出了消息")
+	}
+}
+
+func TestE2EPlugin(t *testing.T) {
+	t.Parallel()
+	s := startTestServerWith(t, IntegrationsType{RPC: &RPCInfo{Key: "test-key"}})
+	pluginAddr := s.srv.PluginAddr()
+	if pluginAddr == nil {
+		t.Fatal("插件服务器没有启动")
+	}
+
+	conn, err := grpc.Dial(net.JoinHostPort("127.0.0.1", strconv.Itoa(pluginAddr.(*net.TCPAddr).Port)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	plugin := pb.NewPluginClient(conn)
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer test-key"))
+	defer cancel()
+
+	if _, err = plugin.SendMessage(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong"),
+		&pb.Message{Room: "#main", Msg: "hi"}); err == nil {
+		t.Error("错误的令牌应该被拒绝")
+	}
+
+	stream, err := plugin.RegisterCmd(ctx, &pb.CmdDef{Name: "echo", ArgsInfo: "<text>", Info: "repeats text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ { // the command is registered in the background
+		if _, ok := s.srv.getPluginCMD("echo"); ok {
+			break
+		}
+		if i > 100 {
+			t.Fatal("插件命令没有注册")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	from := "echobot"
+	go func() {
+		for {
+			inv, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			plugin.SendMessage(ctx, &pb.Message{Room: inv.Room, From: &from, Msg: inv.From + " said " + inv.Args}) //nolint:errcheck
+		}
+	}()
+
+	alice := s.join("alice", newTestKey(t))
+	alice.send("echo hello plugin")
+	alice.expect("echobot: alice said hello plugin")
+}
+
+func TestE2ETwoServers(t *testing.T) {
+	t.Parallel()
+	s1, s2 := startTestServer(t), startTestServer(t)
+	key := newTestKey(t)
+	alice := s1.join("alice", key)
+	carol := s1.join("carol", newTestKey(t))
+	bob := s2.join("bob", newTestKey(t))
+
+	alice.send("only on the first server")
+	carol.expect("alice: only on the first server")
+	bob.send("=alice hello?")
+	bob.expect("没有这个人")
+	bob.send("users")
+	bob.expect("[bob] Admins")
+
+	s2.join("alice", key) // the same key can be on both servers
+	bob.expect("alice 已加入聊天")
+	carol.send("users")
+	carol.expect("[alice carol] Admins")
+}
+
+func TestE2ERestart(t *testing.T) {
+	t.Parallel()
+	s := startTestServer(t)
+	aliceKey, bobKey := newTestKey(t), newTestKey(t)
+	alice := s.join("alice", aliceKey)
+	bob := s.join("bob", bobKey)
+	alice.send("before the restart")
+	bob.expect("alice: before the restart")
+	bob.send("cd #rust")
+	alice.expect("bob 正在加入 #rust")
+
+	s = s.restart()
+	alice.expect("服务器正在重启")
+	bob.expect("您将回到您现在所在的房间")
+	alice.expectClosed()
+	bob.expectClosed()
+
+	bob = s.dial("bob", bobKey)
+	bob.expect("alice: before the restart") // the backlog was kept
+	bob.expect("欢迎回来")
+	bob.expect("bob 已加入 #rust")
+	alice = s.join("alice", aliceKey)
+	alice.send("users")
+	alice.expect("[alice] Admins") // only users who were in other rooms are moved
+	if _, ok := s.srv.restoredRoom(keyID(t, bobKey)); ok {
+		t.Error("用户只应该被放回一次")
+	}
+}
+
+func TestE2EFederation(t *testing.T) {
+	t.Parallel()
+	servers := startFederation(t, []string{"a", "b"}, [][2]string{{"a", "b"}})
+	a, b := servers["a"], servers["b"]
+	bobKey := newTestKey(t)
+	bob := b.join("bob", bobKey)
+	alice := a.join("alice", newTestKey(t))
+	bob.expect("alice@a 已加入 #main")
+
+	alice.send("hello from a")
+	bob.expect("alice@a: hello from a")
+	bob.send("hi from b")
+	alice.expect("bob@b: hi from b")
+	alice.send("users")
+	alice.expect("bob@b")
+
+	bob.send("=alice@a psst")
+	alice.expect("bob@b -> psst")
+	alice.send("=nobody@b hey")
+	alice.expect("没有这个人哈哈: nobody@b")
+
+	alice.send("cd #private") // not shared
+	bob.expect("alice@a 已离开 #main")
+	alice.send("just us")
+	alice.send("cd #main")
+	bob.expect("alice@a 已加入 #main")
+	alice.send("back")
+	bob.expect("alice@a: back")
+	if bob.count("just us") != 0 {
+		t.Error("#private 中的消息不应该被发送到 b")
+	}
+
+	// a reconnects when b comes back
+	port := b.srv.Addr().(*net.TCPAddr).Port
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	if err := b.srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c := *b.srv.Config()
+	c.Port = port
+	b = runTestServer(t, c, IntegrationsType{})
+	a.waitForLink("b")
+	b.waitForLink("a")
+	bob = b.join("bob", bobKey)
+	alice.expect("bob@b 已加入 #main")
+	alice.send("welcome back")
+	bob.expect("alice@a: welcome back")
+}
+
+func TestE2EFederationRelay(t *testing.T) {
+	t.Parallel()
+	// a and c are only linked through b
+	servers := startFederation(t, []string{"a", "b", "c"}, [][2]string{{"a", "b"}, {"b", "c"}})
+	carol := servers["c"].join("carol", newTestKey(t))
+	alice := servers["a"].join("alice", newTestKey(t))
+	alice.send("hello c")
+	carol.expect("alice@a: hello c")
+	carol.send("hello a")
+	alice.expect("carol@c: hello a")
+}
+
+func TestE2EFederationLoop(t *testing.T) {
+	t.Parallel()
+	servers := startFederation(t, []string{"a", "b", "c"}, [][2]string{{"a", "b"}, {"a", "c"}, {"b", "c"}})
+	bob := servers["b"].join("bob", newTestKey(t))
+	carol := servers["c"].join("carol", newTestKey(t))
+	alice := servers["a"].join("alice", newTestKey(t))
+	alice.send("hello everyone")
+	alice.send("done")
+	bob.expect("alice@a: done")
+	carol.expect("alice@a: done")
+	time.Sleep(100 * time.Millisecond) // give copies that went around the loop time to arrive
+	for _, c := range []*testClient{bob, carol} {
+		if n := c.count("alice@a: hello everyone"); n != 1 {
+			t.Errorf("%s 收到了 %d 次消息", c.name, n)
+		}
+	}
+}
+
+func TestE2EJSON(t *testing.T) {
+	t.Parallel()
+	s := startTestServer(t)
+	alice := s.join("alice", newTestKey(t))
+	bot := s.dialSession("bot", newTestKey(t), false, "") // no terminal
+	bot.expectEvent(chatEvent{Type: "join", Room: "#main", Name: "bot"})
+	alice.expect("bot 已加入聊天")
+
+	alice.send("hello bot")
+	bot.expectEvent(chatEvent{Type: "msg", From: "alice", Text: "hello bot"})
+	bot.sendJSON(`{"type":"msg","text":"hi alice"}`)
+	alice.expect("bot: hi alice")
+	bot.sendJSON(`{"type":"msg","text":"nick robot"}`) // only cmd runs commands
+	alice.expect("bot: nick robot")
+
+	bot.sendJSON(`{"type":"dm","to":"alice","text":"secret"}`)
+	alice.expect("bot -> secret")
+	bot.expectEvent(chatEvent{Type: "dm-sent", To: "alice", Text: "secret"})
+	alice.send("=bot psst")
+	bot.expectEvent(chatEvent{Type: "dm", From: "alice", Text: "psst"})
+
+	alice.send("nick alicia")
+	bot.expectEvent(chatEvent{Type: "nick", Name: "alicia", OldName: "alice"})
+	bot.sendJSON(`not json`)
+	bot.expectEvent(chatEvent{Type: "error"})
+	bot.sendJSON(`{"type":"cmd","text":"users"}`)
+	bot.expectEvent(chatEvent{Type: "notice", Text: "[alicia bot]"})
+
+	bot.sendJSON(`{"type":"msg","room":"#bots","text":"moved"}`)
+	alice.expect("bot 正在加入 #bots")
+	bot.expectEvent(chatEvent{Type: "msg", Room: "#bots", From: "bot", Text: "moved"})
+	alice.send("cd #bots")
+	bot.expectEvent(chatEvent{Type: "join", Room: "#bots", Name: "alicia"})
+	bot.stdin.Close()
+	alice.expect("bot 已离开聊天")
+
+	// ssh devzat json works with a terminal too
+	bot = s.dialSession("bot", newTestKey(t), true, "json")
+	bot.expectEvent(chatEvent{Type: "join", Name: "bot"})
+}
+
+func TestE2EExec(t *testing.T) {
+	t.Parallel()
+	s := startTestServer(t)
+	alice := s.join("alice", newTestKey(t))
+	botKey := newTestKey(t)
+
+	post := s.dialSession("bot", botKey, false, "post '#main' build green")
+	if err := post.wait(); err != nil {
+		t.Fatal(err, post.stderr.String())
+	}
+	alice.expect("bot: build green")
+	post = s.dialSession("bot", botKey, false, "post '#main' help") // not run as a command
+	if err := post.wait(); err != nil {
+		t.Fatal(err, post.stderr.String())
+	}
+	alice.expect("bot: help")
+	alice.send("after help")
+	alice.expect("alice: after help") // anything the post sent has arrived by now
+	if alice.count("运行 cmds 查看命令列表") != 0 {
+		t.Fatal("post 不应该运行命令")
+	}
+	if alice.count("bot 已加入") != 0 || alice.count("bot 已离开") != 0 {
+		t.Fatal("post 不应该宣布加入或离开")
+	}
+	if _, ok := s.srv.Rooms.findUser("bot"); ok {
+		t.Fatal("post 之后用户应该已经离开房间")
+	}
+
+	paste := s.dialSession("bot", botKey, false, "paste #main")
+	io.WriteString(paste.stdin, "line one\nline two\n") //nolint:errcheck // wait checks how it went
+	paste.stdin.Close()
+	if err := paste.wait(); err != nil {
+		t.Fatal(err, paste.stderr.String())
+	}
+	alice.expect("bot: line one")
+	alice.expect("line two")
+
+	tail := s.dialSession("watcher", newTestKey(t), false, "tail #main")
+	tail.expect("bot: line one") // recent messages come first
+	alice.expect("watcher 已加入聊天")
+	alice.send("hi watcher")
+	tail.expect("alice: hi watcher")
+	tail.stdin.Close()
+	alice.expect("watcher 已离开聊天")
+	if err := tail.wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	carol := s.dialSession("carol", newTestKey(t), true, "cd #ops")
+	carol.expect("carol 已加入 #ops")
+	alice.expect("carol 正在加入 #ops")
+	carol.send("hello ops")
+	carol.expect("carol: hello ops")
+	if alice.count("hello ops") != 0 {
+		t.Fatal("#ops 的消息被发到了 #main")
+	}
+
+	bad := s.dialSession("bot", botKey, false, "frobnicate")
+	if err := bad.wait(); err == nil || !strings.Contains(bad.stderr.String(), "未知命令") {
+		t.Fatal("未知命令应该失败:", err, bad.stderr.String())
+	}
+	bad = s.dialSession("bot", botKey, false, "post main oops")
+	if err := bad.wait(); err == nil || !strings.Contains(bad.stderr.String(), "用法: post") {
+		t.Fatal("无效的房间名称应该失败:", err, bad.stderr.String())
+	}
+}
+
+// openSessions waits until the server counts n sessions in total, failing the test if it doesn't
+func (s *testServer) openSessions(n int) map[string]int {
+	s.t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for {
+		c := s.srv.Conns
+		c.lock.Lock()
+		total, sessions := c.total, make(map[string]int, len(c.sessions))
+		for k, v := range c.sessions {
+			sessions[k] = v
+		}
+		c.lock.Unlock()
+		if total == n {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("应该有 %d 个会话, 但有 %d 个: %v", n, total, sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestE2EConnLimits(t *testing.T) {
+	t.Parallel()
+	c := testConfig(t)
+	c.Throttle = ThrottleConfig{MaxSessionsPerID: 1, MaxConnections: 2, ThrottleAfter: 4, Action: "reject"}
+	s := runTestServer(t, c, IntegrationsType{})
+	aliceKey, bobKey := newTestKey(t), newTestKey(t)
+
+	alice := s.join("alice", aliceKey)  // join 1
+	again := s.dial("alice2", aliceKey) // join 2
+	again.expect("您的密钥已有太多会话")
+	again.expectClosed()
+	s.srv.addBan(Ban{ID: keyID(t, bobKey)})
+	bob := s.dial("bob", bobKey) // bans are checked before joins are counted
+	bob.expect("您被禁止了")
+	bob.expectClosed()
+	carol := s.join("carol", newTestKey(t)) // join 3
+	dave := s.dial("dave", newTestKey(t))   // join 4
+	dave.expect("服务器已满")
+	dave.expectClosed()
+	erin := s.dial("erin", newTestKey(t)) // join 5
+	erin.expect("您加入得太频繁了")
+	erin.expectClosed()
+	if sessions := s.openSessions(2); sessions[keyID(t, aliceKey)] != 1 || sessions["127.0.0.1"] != 2 {
+		t.Error("被拒绝的连接不应该被计数:", sessions)
+	}
+
+	alice.send("exit")
+	alice.expectClosed()
+	carol.stdin.Close()
+	carol.expectClosed()
+	if sessions := s.openSessions(0); len(sessions) != 0 {
+		t.Error("离开的用户应该释放他们的会话:", sessions)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// execCMD is a command run as ssh devzat <cmd> [args] instead of chatting. Users go through the same checks
+// as when they join interactively.
+type execCMD struct {
+	name     string
+	run      func(srv *Server, s ssh.Session, args []string) bool // returns false if the command failed
+	argsInfo string
+	info     string
+}
+
+var execCMDs []execCMD
+
+func init() { // avoid initialization loop
+	execCMDs = []execCMD{
+		{"post", execPost, "#`room` `msg`", "Send msg to room"},
+		{"paste", execPaste, "#`room`", "Send what is read from stdin to room"},
+		{"tail", execTail, "#`room`", "Print messages in room until stdin is closed"},
+		{"cd", execCd, "#`room`", "Chat, starting in room (use ssh -t)"},
+		{"json", execJSON, "", "Chat using the JSON line protocol"},
+	}
+}
+
+// tailRecent is how many of a room's recent messages tail prints first
+const tailRecent = 10
+
+// runExec runs the command in cmd, returning false if it failed
+func (srv *Server) runExec(s ssh.Session, cmd []string) bool {
+	for _, c := range execCMDs {
+		if c.name == cmd[0] {
+			return c.run(srv, s, cmd[1:])
+		}
+	}
+	fmt.Fprint(s.Stderr(), "未知命令: "+cmd[0]+"\n"+execUsage())
+	return false
+}
+
+func execUsage() string {
+	b := new(bytes.Buffer)
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	w.Write([]byte("可用命令:\n")) //nolint:errcheck // bytes.Buffer is never going to err out
+	for _, c := range execCMDs {
+		w.Write([]byte("   " + c.name + "\t" + strings.ReplaceAll(c.argsInfo, "`", "") + "\t" + c.info + "\n")) //nolint:errcheck
+	}
+	w.Flush()
+	return b.String()
+}
+
+// execUsageError tells the user how to use c, returning false
+func execUsageError(s ssh.Session, name string) bool {
+	for _, c := range execCMDs {
+		if c.name == name {
+			fmt.Fprintln(s.Stderr(), "用法: "+c.name+" "+strings.ReplaceAll(c.argsInfo, "`", ""))
+		}
+	}
+	return false
+}
+
+func execPost(srv *Server, s ssh.Session, args []string) bool {
+	if len(args) < 2 || !validRoomName(args[0]) {
+		return execUsageError(s, "post")
+	}
+	return srv.postFrom(s, args[0], func() (string, bool) { return strings.Join(args[1:], " "), true })
+}
+
+func execPaste(srv *Server, s ssh.Session, args []string) bool {
+	if len(args) != 1 || !validRoomName(args[0]) {
+		return execUsageError(s, "paste")
+	}
+	return srv.postFrom(s, args[0], func() (string, bool) {
+		data, err := io.ReadAll(io.LimitReader(s, maxMsgLen+1))
+		if err != nil {
+			fmt.Fprintln(s.Stderr(), "读取输入时出错:", err)
+			return "", false
+		}
+		if len(data) > maxMsgLen {
+			fmt.Fprintln(s.Stderr(), "输入太长，只发送了前 "+strconv.Itoa(maxMsgLen)+" 个字节")
+			data = data[:maxMsgLen]
+		}
+		return string(data), true
+	})
+}
+
+// postFrom sends a message to room as the session's user. The message is only read once they are let in, and
+// they are only in the room while it is sent, without anyone being told they joined or left.
+func (srv *Server) postFrom(s ssh.Session, room string, read func() (string, bool)) bool {
+	u := srv.admitUser(s, plainEvent)
+	if u == nil {
+		return false
+	}
+	defer u.close("")
+	msg, ok := read()
+	if ok {
+		if msg = strings.TrimSpace(msg); msg == "" {
+			fmt.Fprintln(s.Stderr(), "消息是空的")
+			ok = false
+		}
+	}
+	if !ok {
+		s.Exit(1) //nolint:errcheck // before close says all went well
+		return false
+	}
+	srv.Rooms.join(u, srv.Rooms.getOrCreate(room))
+	defer srv.Rooms.leave(u) // before close, which would tell the room
+	return u.handleLine(msg, sendMessage)
+}
+
+func execTail(srv *Server, s ssh.Session, args []string) bool {
+	if len(args) != 1 || !validRoomName(args[0]) {
+		return execUsageError(s, "tail")
+	}
+	u := srv.newUser(s, plainEvent)
+	if u == nil {
+		return false
+	}
+	u.changeRoom(srv.Rooms.getOrCreate(args[0]))
+	for _, m := range u.room().recentMessages(tailRecent) {
+		u.sendEvent(chatEvent{Type: "msg", Time: m.time, From: m.sender, Text: m.text})
+	}
+	io.Copy(io.Discard, s) //nolint:errcheck // until the client closes stdin or disconnects
+	u.close(u.Name + " 已离开聊天")
+	return true
+}
+
+func execCd(srv *Server, s ssh.Session, args []string) bool {
+	if len(args) != 1 || !validRoomName(args[0]) {
+		return execUsageError(s, "cd")
+	}
+	u := srv.newUser(s, nil)
+	if u == nil {
+		return false
+	}
+	u.changeRoom(srv.Rooms.getOrCreate(args[0]))
+	u.formatPrompt()
+	u.repl()
+	return true
+}
+
+func execJSON(srv *Server, s ssh.Session, args []string) bool {
+	if len(args) != 0 {
+		return execUsageError(s, "json")
+	}
+	u := srv.newUser(s, jsonEvent)
+	if u == nil {
+		return false
+	}
+	u.jsonRepl()
+	return true
+}
+
+// plainEvent formats events as lines of plain text, for exec commands
+func plainEvent(ev chatEvent) []byte {
+	var line string
+	switch ev.Type {
+	case "msg":
+		line = ev.From + ": " + ev.Text
+	case "dm":
+		line = ev.From + " -> " + ev.Text
+	case "dm-sent":
+		line = ev.To + " <- " + ev.Text
+	case "join":
+		line = "--> " + ev.Name + " 已加入 " + ev.Room
+	case "leave":
+		line = "<-- " + ev.Name + " 已离开 " + ev.Room
+	case "nick":
+		line = ev.OldName + " 现在名称为 " + ev.Name
+	default:
+		line = ev.Text
+	}
+	if line == "" {
+		return nil
+	}
+	return []byte(strings.ReplaceAll(line, "\n", "\r\n") + "\r\n")
+}
@@ -0,0 +1,594 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acarl005/stripansi"
+	"github.com/gliderlabs/ssh"
+	cryptoSSH "golang.org/x/crypto/ssh"
+)
+
+// FederationConfig links this server to other Devzat servers so that rooms can be shared between them.
+// Federation is off if there are no peers.
+type FederationConfig struct {
+	// Name is what this server is called on its peers. Users from here are shown there as name@server.
+	Name string `yaml:"name"`
+	// Rooms are the rooms shared with peers. Messages in other rooms stay on this server.
+	Rooms []string         `yaml:"rooms"`
+	Peers []FederationPeer `yaml:"peers"`
+}
+
+type FederationPeer struct {
+	Name string `yaml:"name"`
+	// Addr is where to connect to the peer. If it is empty, the peer is expected to connect to this server.
+	Addr string `yaml:"addr,omitempty"`
+	// Key is the peer's SSH host key, in authorized_keys format. It is checked when connecting to the peer,
+	// and the peer has to authenticate with it when connecting here.
+	Key string `yaml:"key"`
+}
+
+const (
+	// federationSubsystem is the SSH subsystem peers request to open a link
+	federationSubsystem = "devzat-federation"
+	federationQueueSize = 256
+	federationSeenSize  = 4096 // how many message IDs are remembered to drop messages that loop back
+	federationTimeout   = 10 * time.Second
+	federationRetryMin  = time.Second
+	federationRetryMax  = time.Minute
+)
+
+func validateFederation(c FederationConfig) error {
+	if len(c.Peers) == 0 {
+		return nil
+	}
+	if !validServerName(c.Name) {
+		return errors.New("federation.name 不能为空，也不能包含 @ 或空格")
+	}
+	if len(c.Rooms) == 0 {
+		return errors.New("federation.rooms 不能为空")
+	}
+	for _, room := range c.Rooms {
+		if !strings.HasPrefix(room, "#") {
+			return errors.New("federation.rooms 中的房间必须以 # 开头: " + room)
+		}
+	}
+	names := map[string]bool{c.Name: true}
+	for _, p := range c.Peers {
+		if !validServerName(p.Name) || names[p.Name] {
+			return errors.New("federation.peers 中的名称必须唯一，不能为空，也不能包含 @ 或空格: " + p.Name)
+		}
+		names[p.Name] = true
+		if _, _, _, _, err := cryptoSSH.ParseAuthorizedKey([]byte(p.Key)); err != nil {
+			return errors.New("无法解析对等服务器 " + p.Name + " 的密钥: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func validServerName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "@ \t\n")
+}
+
+// fedFrame is a line of the federation protocol. Messages are relayed to every peer sharing the room that
+// hasn't seen them yet, so servers that aren't linked directly still get them. Rosters and DMs only go to
+// the server they are for.
+type fedFrame struct {
+	Type string `json:"type"` // "msg", "users", "dm" or "dm-error"
+
+	// msg
+	ID     string   `json:"id,omitempty"`
+	Origin string   `json:"origin,omitempty"` // the server the message was sent on
+	Via    []string `json:"via,omitempty"`    // the servers the message has been through
+
+	Room   string   `json:"room,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	From   string   `json:"from,omitempty"`
+	FromID string   `json:"from_id,omitempty"`
+	To     string   `json:"to,omitempty"` // a user's name for dm, or their ID for dm-error
+	Text   string   `json:"text,omitempty"`
+}
+
+type federation struct {
+	srv    *Server
+	name   string
+	rooms  map[string]bool
+	peers  []FederationPeer
+	keys   []cryptoSSH.PublicKey // the keys of peers, in the same order
+	signer cryptoSSH.Signer
+
+	lock      sync.Mutex // guards the fields below and the rosters of links
+	links     map[string]*fedLink
+	seen      map[string]bool
+	seenOrder []string
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// fedLink is a connection to a peer
+type fedLink struct {
+	peer    FederationPeer
+	dialer  string    // the server that opened the connection
+	conn    io.Closer // closing it ends the link
+	out     chan fedFrame
+	done    chan struct{}
+	once    sync.Once
+	rosters map[string][]string // the peer's users by room
+}
+
+// federationInit links the server to its peers, if it has any
+func (srv *Server) federationInit() error {
+	c := srv.Config().Federation
+	if len(c.Peers) == 0 {
+		return nil
+	}
+	key, err := os.ReadFile(srv.Config().KeyFile)
+	if err != nil {
+		return err
+	}
+	f := &federation{srv: srv, name: c.Name, rooms: make(map[string]bool), peers: c.Peers,
+		links: make(map[string]*fedLink), seen: make(map[string]bool)}
+	if f.signer, err = cryptoSSH.ParsePrivateKey(key); err != nil {
+		return err
+	}
+	for _, room := range c.Rooms {
+		f.rooms[room] = true
+	}
+	for _, p := range c.Peers {
+		k, _, _, _, err := cryptoSSH.ParseAuthorizedKey([]byte(p.Key))
+		if err != nil {
+			return err
+		}
+		f.keys = append(f.keys, k)
+	}
+	srv.federation = f
+	for _, p := range c.Peers {
+		if p.Addr != "" {
+			f.wg.Add(1)
+			go f.connect(p)
+		}
+	}
+	return nil
+}
+
+// connect keeps a link to p open until the server shuts down
+func (f *federation) connect(p FederationPeer) {
+	defer f.wg.Done()
+	retry := federationRetryMin
+	for {
+		if f.link(p.Name) != nil { // they connected to us
+			retry = federationRetryMax
+		} else {
+			start := time.Now()
+			err := f.dial(p)
+			if err != nil {
+				f.srv.Log.Println("连接联邦服务器 "+p.Name+" 时出错:", err)
+			}
+			if time.Since(start) > federationRetryMax { // the link was up for a while, so reconnect quickly
+				retry = federationRetryMin
+			}
+		}
+		select {
+		case <-f.srv.done:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > federationRetryMax {
+			retry = federationRetryMax
+		}
+	}
+}
+
+// dial connects to p and runs the link until it ends
+func (f *federation) dial(p FederationPeer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), federationTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-f.srv.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(federationTimeout)) //nolint:errcheck // the handshake fails if the deadline isn't set and passes
+	c, chans, reqs, err := cryptoSSH.NewClientConn(conn, p.Addr, &cryptoSSH.ClientConfig{
+		User:            f.name,
+		Auth:            []cryptoSSH.AuthMethod{cryptoSSH.PublicKeys(f.signer)},
+		HostKeyCallback: cryptoSSH.FixedHostKey(f.keys[f.peerIndex(p.Name)]),
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	client := cryptoSSH.NewClient(c, chans, reqs)
+	sess, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	if err = sess.RequestSubsystem(federationSubsystem); err != nil {
+		client.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{}) //nolint:errcheck
+	f.run(&fedLink{peer: p, dialer: f.name, conn: client}, stdout, stdin)
+	return nil
+}
+
+// handleFederation runs a link opened by a peer
+func (srv *Server) handleFederation(s ssh.Session) {
+	f := srv.federation
+	if f == nil || s.PublicKey() == nil {
+		return
+	}
+	for i, k := range f.keys {
+		if ssh.KeysEqual(k, s.PublicKey()) {
+			f.run(&fedLink{peer: f.peers[i], dialer: f.peers[i].Name, conn: s}, s, s)
+			return
+		}
+	}
+	srv.Log.Println("拒绝来自 " + s.RemoteAddr().String() + " 的联邦连接: 未知的密钥")
+}
+
+func (f *federation) peerIndex(name string) int {
+	for i := range f.peers {
+		if f.peers[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// run sends and receives frames on l until it ends
+func (f *federation) run(l *fedLink, r io.Reader, w io.Writer) {
+	l.out = make(chan fedFrame, federationQueueSize)
+	l.done = make(chan struct{})
+	l.rosters = make(map[string][]string)
+	if !f.add(l) {
+		l.close()
+		return
+	}
+	defer f.remove(l)
+	f.srv.Log.Println("已连接到联邦服务器 " + l.peer.Name)
+	go l.write(w)
+	for room := range f.rooms {
+		var users []string
+		if r, ok := f.srv.Rooms.get(room); ok {
+			users = rosterOf(r)
+		}
+		l.send(fedFrame{Type: "users", Room: room, Users: users})
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var fr fedFrame
+		if err := dec.Decode(&fr); err != nil {
+			if !errors.Is(err, io.EOF) {
+				select {
+				case <-l.done: // closed on our side
+				default:
+					f.srv.Log.Println("读取联邦服务器 "+l.peer.Name+" 时出错:", err)
+				}
+			}
+			return
+		}
+		f.handle(l, fr)
+	}
+}
+
+// add makes l the link to its peer. If both servers connected to each other, the connection opened by the
+// server whose name sorts first is kept, so that both ends pick the same one.
+func (f *federation) add(l *fedLink) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return false
+	}
+	if old, ok := f.links[l.peer.Name]; ok {
+		preferred := f.name
+		if l.peer.Name < preferred {
+			preferred = l.peer.Name
+		}
+		if old.dialer != l.dialer && old.dialer == preferred {
+			return false
+		}
+		old.close() // either the old connection is dead and the peer reconnected, or this one is preferred
+	}
+	f.links[l.peer.Name] = l
+	f.wg.Add(1)
+	return true
+}
+
+func (f *federation) remove(l *fedLink) {
+	l.close()
+	f.lock.Lock()
+	if f.links[l.peer.Name] == l {
+		delete(f.links, l.peer.Name)
+		f.srv.Log.Println("与联邦服务器 " + l.peer.Name + " 的连接已断开")
+	}
+	f.lock.Unlock()
+	f.wg.Done()
+}
+
+// link returns the link to the peer called name, or nil if it isn't connected
+func (f *federation) link(name string) *fedLink {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.links[name]
+}
+
+func (f *federation) allLinks() []*fedLink {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	links := make([]*fedLink, 0, len(f.links))
+	for _, l := range f.links {
+		links = append(links, l)
+	}
+	return links
+}
+
+// close ends every link and waits for them and the connecting goroutines, which stop once srv.done is closed
+func (f *federation) close() {
+	f.lock.Lock()
+	f.closed = true
+	for _, l := range f.links {
+		l.close()
+	}
+	f.lock.Unlock()
+	f.wg.Wait()
+}
+
+// firstSeen records a message ID, returning false if it was seen before
+func (f *federation) firstSeen(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.seen[id] {
+		return false
+	}
+	f.seen[id] = true
+	f.seenOrder = append(f.seenOrder, id)
+	if len(f.seenOrder) > federationSeenSize {
+		delete(f.seen, f.seenOrder[0])
+		f.seenOrder = f.seenOrder[1:]
+	}
+	return true
+}
+
+func (l *fedLink) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// send queues fr for the peer. Frames are dropped if the peer can't keep up.
+func (l *fedLink) send(fr fedFrame) {
+	select {
+	case l.out <- fr:
+	case <-l.done:
+	default:
+		l.close() // it reconnects and sends the rosters again, so the peer doesn't miss who left
+	}
+}
+
+func (l *fedLink) write(w io.Writer) {
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case fr := <-l.out:
+			if err := enc.Encode(fr); err != nil {
+				l.close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (f *federation) handle(l *fedLink, fr fedFrame) {
+	srv := f.srv
+	switch fr.Type {
+	case "msg":
+		if fr.Origin == f.name || !f.rooms[fr.Room] || !f.firstSeen(fr.ID) {
+			return
+		}
+		f.relay(fr)
+		r, ok := srv.Rooms.get(fr.Room)
+		if !ok || srv.isBanned("", fr.FromID) {
+			return
+		}
+		text, blocked := srv.filterMessage(r, truncate(fr.Text, maxMsgLen))
+		if blocked {
+			return
+		}
+		r.broadcast(remoteName(fr.From, fr.Origin), text)
+	case "users":
+		if !f.rooms[fr.Room] {
+			return
+		}
+		users := make([]string, 0, len(fr.Users))
+		for _, name := range fr.Users {
+			if name = cleanName(stripansi.Strip(name)); name != "" {
+				users = append(users, name)
+			}
+		}
+		sort.Strings(users)
+		f.lock.Lock()
+		old, known := l.rosters[fr.Room]
+		l.rosters[fr.Room] = users
+		f.lock.Unlock()
+		r, ok := srv.Rooms.get(fr.Room)
+		if !known || !ok { // the roster sent when linking isn't news
+			return
+		}
+		for _, name := range difference(users, old) {
+			r.deliver("", Green.Paint(" --> ")+remoteName(name, l.peer.Name)+" 已加入 "+Blue.Paint(r.name),
+				&chatEvent{Type: "join", Name: name + "@" + l.peer.Name})
+		}
+		for _, name := range difference(old, users) {
+			r.deliver("", Red.Paint(" <-- ")+remoteName(name, l.peer.Name)+" 已离开 "+Blue.Paint(r.name),
+				&chatEvent{Type: "leave", Name: name + "@" + l.peer.Name})
+		}
+	case "dm":
+		u, ok := srv.Rooms.findUser(fr.To)
+		if !ok {
+			l.send(fedFrame{Type: "dm-error", To: fr.FromID, Text: "没有这个人哈哈: " + fr.To + "@" + f.name})
+			return
+		}
+		if srv.isBanned("", fr.FromID) {
+			return
+		}
+		u.writeln(remoteName(fr.From, l.peer.Name)+" -> ", truncate(fr.Text, maxMsgLen))
+	case "dm-error":
+		for _, u := range srv.Rooms.findByID(fr.To) {
+			u.writeln(Devbot, fr.Text)
+		}
+	}
+}
+
+// relay passes a message on to the peers it hasn't been through
+func (f *federation) relay(fr fedFrame) {
+	via := fr.Via
+	fr.Via = append(append([]string(nil), via...), f.name)
+	for _, l := range f.allLinks() {
+		if l.peer.Name != fr.Origin && !contains(via, l.peer.Name) {
+			l.send(fr)
+		}
+	}
+}
+
+// federate sends a message u sent in r to the peers, if r is shared
+func (srv *Server) federate(r *Room, u *User, text string) {
+	f := srv.federation
+	if f == nil || !f.rooms[r.name] {
+		return
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		srv.Log.Println(err)
+		return
+	}
+	fr := fedFrame{Type: "msg", ID: hex.EncodeToString(b), Origin: f.name, Room: r.name,
+		From: stripansi.Strip(u.Name), FromID: u.id, Text: text}
+	f.firstSeen(fr.ID)
+	f.relay(fr)
+}
+
+// federateRoster tells the peers who is in r, if r is shared. It is called whenever someone joins or
+// leaves r or changes their name.
+func (srv *Server) federateRoster(r *Room) {
+	f := srv.federation
+	if f == nil || !f.rooms[r.name] {
+		return
+	}
+	fr := fedFrame{Type: "users", Room: r.name, Users: rosterOf(r)}
+	for _, l := range f.allLinks() {
+		l.send(fr)
+	}
+}
+
+// dmRemote sends a DM to a user on a peer, if to is name@server for a peer. It returns false if to isn't
+// someone on a peer.
+func (srv *Server) dmRemote(u *User, to string, msg string) bool {
+	f := srv.federation
+	i := strings.LastIndexByte(to, '@')
+	if f == nil || i <= 0 || f.peerIndex(to[i+1:]) < 0 {
+		return false
+	}
+	name, server := strings.TrimPrefix(to[:i], "@"), to[i+1:]
+	l := f.link(server)
+	if l == nil {
+		u.writeln(Devbot, "没有连接到 "+server+"，私信无法发送")
+		return true
+	}
+	u.writeln(remoteName(name, server)+" <- ", msg)
+	l.send(fedFrame{Type: "dm", From: stripansi.Strip(u.Name), FromID: u.id, To: name, Text: msg})
+	return true
+}
+
+// remoteUsers returns the users in the room called room on linked servers, as name@server
+func (srv *Server) remoteUsers(room string) []string {
+	f := srv.federation
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var names []string
+	for _, l := range f.links {
+		for _, name := range l.rosters[room] {
+			names = append(names, remoteName(name, l.peer.Name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func rosterOf(r *Room) []string {
+	users := r.snapshot()
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, stripansi.Strip(u.Name))
+	}
+	return names
+}
+
+// remoteName colors name@server, picking the color from the name so that it is the same everywhere
+func remoteName(name, server string) string {
+	name = cleanName(stripansi.Strip(name)) + "@" + server
+	h := sha1.Sum([]byte(name))
+	return Styles[int(binary.BigEndian.Uint16(h[:2]))%len(Styles)].apply(name)
+}
+
+// difference returns the strings in a that aren't in b
+func difference(a, b []string) []string {
+	var d []string
+	for _, s := range a {
+		if !contains(b, s) {
+			d = append(d, s)
+		}
+	}
+	return d
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"fmt"
@@ -7,12 +7,6 @@ import (
 	"github.com/shurcooL/tictactoe"
 )
 
-var (
-	tttGame       = new(tictactoe.Board)
-	currentPlayer = tictactoe.X
-	hangGame      = new(hangman)
-)
-
 type hangman struct {
 	word      string
 	triesLeft int
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"container/list"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageErrorTTL is how long a failed fetch is remembered before the image is tried again
+const imageErrorTTL = time.Minute
+
+// imageStore keeps recently used images in memory, and the downloaded files on disk, so each image is
+// only fetched once. Fetches happen in the background so they never hold up a broadcast.
+type imageStore struct {
+	srv      *Server
+	lock     sync.Mutex
+	order    *list.List // most recently used at the front
+	entries  map[string]*list.Element
+	size     int64                  // roughly how much memory the decoded images in the cache use
+	inflight map[string]*imageFetch // fetches in progress, so concurrent requests for an image share one fetch
+	diskLock sync.Mutex             // serializes writes to the disk cache
+}
+
+type imageEntry struct {
+	url     string
+	img     image.Image
+	err     error
+	size    int64
+	expires time.Time // for errors, when to try again
+}
+
+type imageFetch struct {
+	waiters []func(image.Image, error)
+}
+
+func newImageStore(srv *Server) *imageStore {
+	return &imageStore{srv: srv, order: list.New(), entries: make(map[string]*list.Element), inflight: make(map[string]*imageFetch)}
+}
+
+// get returns the image at url if it is in memory. ok is false if it still has to be fetched.
+func (c *imageStore) get(url string) (img image.Image, err error, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[url]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := e.Value.(*imageEntry)
+	if entry.err != nil && time.Now().After(entry.expires) {
+		c.removeEntry(e)
+		return nil, nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.img, entry.err, true
+}
+
+// fetch calls done with the image at url once it is available, fetching it in the background if needed.
+// done may be nil to only start the fetch.
+func (c *imageStore) fetch(url string, done func(image.Image, error)) {
+	if img, err, ok := c.get(url); ok {
+		if done != nil {
+			done(img, err)
+		}
+		return
+	}
+	c.lock.Lock()
+	f, ok := c.inflight[url]
+	if !ok {
+		f = &imageFetch{}
+		c.inflight[url] = f
+		go c.load(url, f)
+	}
+	if done != nil {
+		f.waiters = append(f.waiters, done)
+	}
+	c.lock.Unlock()
+}
+
+// wait fetches the image at url and waits for it
+func (c *imageStore) wait(url string) (image.Image, error) {
+	type result struct {
+		img image.Image
+		err error
+	}
+	ch := make(chan result, 1)
+	c.fetch(url, func(img image.Image, err error) { ch <- result{img, err} })
+	r := <-ch
+	return r.img, r.err
+}
+
+func (c *imageStore) load(url string, f *imageFetch) {
+	img, err := c.loadCachedImage(url)
+	if err != nil {
+		var data []byte
+		data, err = c.srv.downloadImage(url)
+		if err == nil {
+			img, err = c.srv.decodeImage(data)
+		}
+		if err == nil {
+			c.saveCachedImage(url, data)
+		}
+	}
+
+	c.lock.Lock()
+	c.add(url, img, err)
+	delete(c.inflight, url)
+	waiters := f.waiters
+	c.lock.Unlock()
+	for _, done := range waiters {
+		done(img, err)
+	}
+}
+
+// add stores an image or the error fetching it. c.lock must be held.
+func (c *imageStore) add(url string, img image.Image, err error) {
+	entry := &imageEntry{url: url, img: img, err: err, size: 64}
+	if err != nil {
+		entry.expires = time.Now().Add(imageErrorTTL)
+	} else {
+		b := img.Bounds()
+		entry.size = int64(b.Dx()) * int64(b.Dy()) * 4
+	}
+	if e, ok := c.entries[url]; ok {
+		c.removeEntry(e)
+	}
+	c.entries[url] = c.order.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.srv.Config().Images.MemoryCache && c.order.Len() > 1 {
+		c.removeEntry(c.order.Back())
+	}
+}
+
+// removeEntry removes an image. c.lock must be held.
+func (c *imageStore) removeEntry(e *list.Element) {
+	entry := e.Value.(*imageEntry)
+	c.order.Remove(e)
+	delete(c.entries, entry.url)
+	c.size -= entry.size
+}
+
+func (c *imageStore) imageCacheDir() string {
+	return filepath.Join(c.srv.Config().DataDir, "image-cache")
+}
+
+func (c *imageStore) cachedImageFile(url string) string {
+	return filepath.Join(c.imageCacheDir(), shasum(url))
+}
+
+// loadCachedImage reads an image downloaded earlier from disk
+func (c *imageStore) loadCachedImage(url string) (image.Image, error) {
+	if c.srv.Config().Images.DiskCache == 0 {
+		return nil, os.ErrNotExist
+	}
+	file := c.cachedImageFile(url)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	os.Chtimes(file, now, now) //nolint:errcheck // only used to pick what to delete when the cache is full
+	return c.srv.decodeImage(data)
+}
+
+// saveCachedImage stores a downloaded image on disk, deleting the least recently used images if the cache is full
+func (c *imageStore) saveCachedImage(url string, data []byte) {
+	limit := c.srv.Config().Images.DiskCache
+	if limit == 0 || int64(len(data)) > limit {
+		return
+	}
+	c.diskLock.Lock()
+	defer c.diskLock.Unlock()
+	if err := os.MkdirAll(c.imageCacheDir(), 0755); err != nil {
+		c.srv.Log.Println("创建图像缓存目录时出错:", err)
+		return
+	}
+	if err := writeFileAtomic(c.cachedImageFile(url), data); err != nil {
+		c.srv.Log.Println("保存图像到缓存时出错:", err)
+		return
+	}
+
+	entries, err := os.ReadDir(c.imageCacheDir())
+	if err != nil {
+		c.srv.Log.Println(err)
+		return
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	total := int64(0)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") { // a temporary file being written
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for i := 0; total > limit && i < len(files); i++ {
+		if err = os.Remove(filepath.Join(c.imageCacheDir(), files[i].Name())); err == nil {
+			total -= files[i].Size()
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ImageConfig controls which images linked in messages get fetched and rendered.
+type ImageConfig struct {
+	// AllowPrivate allows fetching images from loopback, private, link-local and shared (CGNAT) addresses
+	AllowPrivate bool `yaml:"allow_private,omitempty"`
+	// AllowDomains, if not empty, is the list of domains (including subdomains) images can be fetched from
+	AllowDomains []string `yaml:"allow_domains,omitempty"`
+	DenyDomains  []string `yaml:"deny_domains,omitempty"`
+	// MaxBytes is the largest image that will be downloaded
+	MaxBytes int64 `yaml:"max_bytes"`
+	// MaxWidth and MaxHeight are the largest dimensions of an image that will be rendered
+	MaxWidth  int `yaml:"max_width"`
+	MaxHeight int `yaml:"max_height"`
+	// MemoryCache is roughly how many bytes of decoded images are kept in memory
+	MemoryCache int64 `yaml:"memory_cache"`
+	// DiskCache is how many bytes of downloaded images are kept in the data dir. 0 disables the disk cache.
+	DiskCache int64 `yaml:"disk_cache"`
+}
+
+// errImageBlocked wraps the reasons an image fetch was refused by the policy
+type errImageBlocked struct{ reason string }
+
+func (e errImageBlocked) Error() string { return "图像已被阻止: " + e.reason }
+
+// newImageClient makes the client used to fetch images. It checks the image policy at each dial and redirect.
+func (srv *Server) newImageClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy: nil, // the dialer has to see the real address to check it
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: func(_, address string, _ syscall.RawConn) error {
+					host, _, err := net.SplitHostPort(address)
+					if err != nil {
+						return err
+					}
+					if ip := net.ParseIP(host); ip != nil && !srv.Config().Images.AllowPrivate && isPrivateIP(ip) {
+						return errImageBlocked{"不允许私有地址"}
+					}
+					return nil
+				},
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("重定向过多")
+			}
+			return srv.checkImageURL(req.URL)
+		},
+	}
+}
+
+// sharedAddressSpace is 100.64.0.0/10, used for carrier-grade NAT and by VPNs like Tailscale
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// isPrivateIP reports whether ip is somewhere a server shouldn't be making requests to on behalf of users
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+func domainIn(host string, domains []string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImageURL applies the parts of the image policy that can be checked before connecting.
+// Addresses that hostnames resolve to are checked when dialing.
+func (srv *Server) checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errImageBlocked{"只支持 http 和 https"}
+	}
+	policy := srv.Config().Images
+	host := strings.ToLower(u.Hostname())
+	if domainIn(host, policy.DenyDomains) {
+		return errImageBlocked{"域名被拒绝"}
+	}
+	if len(policy.AllowDomains) > 0 && !domainIn(host, policy.AllowDomains) {
+		return errImageBlocked{"域名不在允许列表中"}
+	}
+	if ip := net.ParseIP(host); ip != nil && !policy.AllowPrivate && isPrivateIP(ip) {
+		return errImageBlocked{"不允许私有地址"}
+	}
+	return nil
+}
+
+// checkImage applies the image policy to a link before it is fetched or shown from the cache
+func (srv *Server) checkImage(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.New("无效的链接")
+	}
+	return srv.checkImageURL(u)
+}
+
+// fetchImage downloads and decodes an image, applying the image policy.
+// The returned error's message is shown to users in place of the image.
+func (srv *Server) fetchImage(rawURL string) (image.Image, error) {
+	data, err := srv.downloadImage(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return srv.decodeImage(data)
+}
+
+// downloadImage downloads an image, applying the image policy
+func (srv *Server) downloadImage(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("无效的链接")
+	}
+	if err = srv.checkImageURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.New("无效的链接")
+	}
+	res, err := srv.imageClient.Do(req)
+	if err != nil {
+		var blocked errImageBlocked
+		if errors.As(err, &blocked) {
+			return nil, blocked
+		}
+		return nil, errors.New("获取图像时出错")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("error: http: " + http.StatusText(res.StatusCode))
+	}
+	policy := srv.Config().Images
+	if res.ContentLength > policy.MaxBytes {
+		return nil, errors.New("无效或太大而无法渲染")
+	}
+	limitReader := io.LimitReader(res.Body, policy.MaxBytes)
+	// check the size before downloading the rest: https://github.com/golang/go/issues/12512#issuecomment-137981217
+	data := new(bytes.Buffer)
+	config, _, err := image.DecodeConfig(io.TeeReader(limitReader, data))
+	if err != nil || config.Width > policy.MaxWidth || config.Height > policy.MaxHeight {
+		return nil, errors.New("无效或太大而无法渲染")
+	}
+	if _, err = data.ReadFrom(limitReader); err != nil {
+		return nil, errors.New("获取图像时出错")
+	}
+	return data.Bytes(), nil
+}
+
+// decodeImage decodes a downloaded image, checking that it isn't too big to render
+func (srv *Server) decodeImage(data []byte) (image.Image, error) {
+	policy := srv.Config().Images
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width > policy.MaxWidth || config.Height > policy.MaxHeight {
+		return nil, errors.New("无效或太大而无法渲染")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("错误解码图像")
+	}
+	return img, nil
+}
+
+func imagesCMD(rest string, u *User) {
+	switch rest {
+	case "off":
+		u.ImagesAsLinks = true
+		u.writeln(Devbot, "图像将显示为链接")
+	case "on":
+		u.ImagesAsLinks = false
+		u.writeln(Devbot, "图像将被渲染")
+	case "":
+		if u.ImagesAsLinks {
+			u.writeln(Devbot, "images off (显示为链接)")
+		} else {
+			u.writeln(Devbot, "images on (渲染)")
+		}
+	default:
+		u.writeln(Devbot, "您的选项包括 on 和 off")
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+)
+
+// Roles an invite can grant
+const (
+	RoleMember = "member" // added to the allowlist
+	RoleAdmin  = "admin"  // added to the admins
+)
+
+// Invite lets people who don't have their ID on the allowlist join a private server
+type Invite struct {
+	Code        string
+	CreatedBy   string
+	CreatedByID string
+	Created     time.Time
+	Expires     time.Time `json:",omitempty"` // zero means it never expires
+	MaxUses     int       // zero means unlimited
+	Role        string
+	UsedBy      []string `json:",omitempty"` // IDs of the users who used it
+	Revoked     bool     `json:",omitempty"`
+}
+
+const (
+	inviteCodeLen     = 10
+	inviteCodeChars   = "abcdefghjkmnpqrstuvwxyz23456789" // no 0/o or 1/l/i so codes are easy to type
+	maxInviteAttempts = 3
+)
+
+func (srv *Server) invitesFile() string {
+	return filepath.Join(srv.Config().DataDir, "invites.json")
+}
+
+// saveInvites saves the invites. invitesMutex must be held.
+func (srv *Server) saveInvites() {
+	data, err := json.MarshalIndent(srv.Invites, "", "   ")
+	if err != nil {
+		srv.Log.Println("编码邀请时出错:", err)
+		return
+	}
+	if err = os.WriteFile(srv.invitesFile(), data, 0600); err != nil {
+		srv.Log.Println("保存邀请时出错:", err)
+	}
+}
+
+func (srv *Server) readInvites() {
+	data, err := os.ReadFile(srv.invitesFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			srv.Log.Println(err)
+		}
+		return
+	}
+	srv.invitesMutex.Lock()
+	defer srv.invitesMutex.Unlock()
+	if err = json.Unmarshal(data, &srv.Invites); err != nil {
+		srv.Log.Println("加载邀请时出错:", err)
+	}
+}
+
+func (inv *Invite) usable() bool {
+	return !inv.Revoked && (inv.Expires.IsZero() || time.Now().Before(inv.Expires)) &&
+		(inv.MaxUses == 0 || len(inv.UsedBy) < inv.MaxUses)
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, inviteCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = inviteCodeChars[int(b[i])%len(inviteCodeChars)]
+	}
+	return string(b), nil
+}
+
+// findInvite returns the invite with code. invitesMutex must be held.
+func (srv *Server) findInvite(code string) *Invite {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i := range srv.Invites {
+		if srv.Invites[i].Code == code {
+			return &srv.Invites[i]
+		}
+	}
+	return nil
+}
+
+// anyUsableInvites reports whether it's worth asking a user for an invite code
+func (srv *Server) anyUsableInvites() bool {
+	srv.invitesMutex.Lock()
+	defer srv.invitesMutex.Unlock()
+	for i := range srv.Invites {
+		if srv.Invites[i].usable() {
+			return true
+		}
+	}
+	return false
+}
+
+// redeemInvite uses up one use of code for u and gives u the invite's role. It returns false if the code can't be used.
+func redeemInvite(code string, u *User) bool {
+	u.srv.invitesMutex.Lock()
+	inv := u.srv.findInvite(code)
+	if inv == nil || !inv.usable() {
+		u.srv.invitesMutex.Unlock()
+		return false
+	}
+	inv.UsedBy = append(inv.UsedBy, u.id)
+	role, creator, creatorID, usedCode := inv.Role, inv.CreatedBy, inv.CreatedByID, inv.Code
+	u.srv.saveInvites()
+	u.srv.invitesMutex.Unlock()
+
+	key := "allowlist"
+	if role == RoleAdmin {
+		key = "admins"
+	}
+	note := stripansi.Strip(u.Name) + " (邀请 " + usedCode + ", 由 " + creator + " 创建)"
+	if err := u.srv.setAccess(key, u.id, note, false); err != nil {
+		u.srv.Log.Println("兑换邀请时编辑配置出错:", err)
+		u.srv.invitesMutex.Lock()
+		if inv = u.srv.findInvite(usedCode); inv != nil && len(inv.UsedBy) > 0 { // give the use back
+			inv.UsedBy = inv.UsedBy[:len(inv.UsedBy)-1]
+			u.srv.saveInvites()
+		}
+		u.srv.invitesMutex.Unlock()
+		return false
+	}
+	u.srv.audit(u, "redeem-invite", creator, creatorID, usedCode+" ("+role+")")
+	return true
+}
+
+// askForInvite prompts a user who isn't allowed on a private server for an invite code.
+// It returns whether they redeemed one.
+func askForInvite(u *User) bool {
+	if !u.srv.anyUsableInvites() {
+		return false
+	}
+	u.writeln(Devbot, "您不在此私人服务器的允许列表中。如果您有邀请码，请在下面输入:")
+	u.term.SetPrompt("邀请码: ")
+	defer u.term.SetPrompt("> ")
+	for i := 0; i < maxInviteAttempts; i++ {
+		code, err := u.term.ReadLine()
+		if err != nil || strings.TrimSpace(code) == "" {
+			return false
+		}
+		if redeemInvite(code, u) {
+			u.srv.Log.Println(u.Name + " [" + u.id + "] 使用了邀请码")
+			u.writeln(Devbot, "欢迎! 您已被添加到允许列表")
+			return true
+		}
+		u.srv.Log.Println(u.Name + " [" + u.id + "] 输入了无效的邀请码")
+		if i < maxInviteAttempts-1 {
+			u.writeln(Devbot, "无效或已过期的邀请码，请重试:")
+		}
+	}
+	return false
+}
+
+func inviteCMD(line string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		u.writeln(Devbot, "用法: invite create [uses] [expiry] [member|admin], invite list, invite revoke <code>")
+		return
+	}
+	switch args[0] {
+	case "create":
+		inviteCreateCMD(args[1:], u)
+	case "list":
+		inviteListCMD(u)
+	case "revoke":
+		if len(args) < 2 {
+			u.writeln(Devbot, "用法: invite revoke <code>")
+			return
+		}
+		u.srv.invitesMutex.Lock()
+		inv := u.srv.findInvite(args[1])
+		if inv == nil {
+			u.srv.invitesMutex.Unlock()
+			u.writeln(Devbot, "找不到该邀请")
+			return
+		}
+		inv.Revoked = true
+		u.srv.saveInvites()
+		u.srv.invitesMutex.Unlock()
+		u.srv.audit(u, "revoke-invite", "", "", args[1])
+		u.writeln(Devbot, "邀请 "+args[1]+" 已被撤销")
+	default:
+		u.writeln(Devbot, "用法: invite create [uses] [expiry] [member|admin], invite list, invite revoke <code>")
+	}
+}
+
+func inviteCreateCMD(args []string, u *User) {
+	inv := Invite{
+		CreatedBy:   stripansi.Strip(u.Name),
+		CreatedByID: u.id,
+		Created:     time.Now(),
+		MaxUses:     1,
+		Role:        RoleMember,
+	}
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+			inv.MaxUses = n
+		} else if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+			inv.Expires = inv.Created.Add(d)
+		} else if arg == RoleMember || arg == RoleAdmin {
+			inv.Role = arg
+		} else {
+			u.writeln(Devbot, "无效的参数 "+arg+"。用法: invite create [uses] [expiry] [member|admin]")
+			return
+		}
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		u.writeln(Devbot, "创建邀请时出错: "+err.Error())
+		return
+	}
+	inv.Code = code
+
+	u.srv.invitesMutex.Lock()
+	u.srv.Invites = append(u.srv.Invites, inv)
+	u.srv.saveInvites()
+	u.srv.invitesMutex.Unlock()
+
+	u.srv.audit(u, "create-invite", "", "", inviteInfo(inv))
+	msg := "邀请码: " + Cyan.Cyan(code) + " (" + inviteInfo(inv) + ")"
+	if !u.srv.Config().Private {
+		msg += "  \n注意: 这个服务器不是私人服务器，所以不会要求输入邀请码"
+	}
+	u.writeln(Devbot, msg) // not broadcast, only the admin should see the code
+}
+
+func inviteInfo(inv Invite) string {
+	info := inv.Role + ", "
+	if inv.MaxUses == 0 {
+		info += "无限次使用"
+	} else {
+		info += strconv.Itoa(len(inv.UsedBy)) + "/" + strconv.Itoa(inv.MaxUses) + " 次使用"
+	}
+	if !inv.Expires.IsZero() {
+		if left := time.Until(inv.Expires); left > 0 {
+			info += ", 剩余 " + printPrettyDuration(left)
+		} else {
+			info += ", 已过期"
+		}
+	}
+	return info
+}
+
+func inviteListCMD(u *User) {
+	u.srv.invitesMutex.Lock()
+	msg := ""
+	for _, inv := range u.srv.Invites {
+		if !inv.usable() {
+			continue
+		}
+		msg += Cyan.Cyan(inv.Code) + " " + inviteInfo(inv) + ", 由 " + inv.CreatedBy + " 创建  \n"
+	}
+	u.srv.invitesMutex.Unlock()
+	if msg == "" {
+		u.writeln(Devbot, "没有可用的邀请")
+		return
+	}
+	u.writeln(Devbot, "可用的邀请:  \n"+msg)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+)
+
+// chatEvent is what users without a terminal are sent instead of text. In JSON mode, each event is a line
+// of JSON.
+type chatEvent struct {
+	Type    string    `json:"type"` // "msg", "notice", "dm", "dm-sent", "join", "leave", "nick" or "error"
+	Time    time.Time `json:"time"`
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Name    string    `json:"name,omitempty"`     // who joined, left or changed their name
+	OldName string    `json:"old_name,omitempty"` // the name before a nick change
+	Text    string    `json:"text,omitempty"`
+}
+
+// jsonRequest is a line sent by a client in JSON mode
+type jsonRequest struct {
+	Type string `json:"type"` // "msg", "cmd" or "dm". Only the text of a cmd is run as a command.
+	Room string `json:"room"` // for msg: the room to send to. The user moves there if they aren't in it.
+	To   string `json:"to"`   // for dm
+	Text string `json:"text"`
+}
+
+func jsonEvent(ev chatEvent) []byte {
+	data, _ := json.Marshal(ev) //nolint:errcheck // chatEvent always marshals
+	return append(data, '\n')
+}
+
+// sendEvent sends ev to a user without a terminal
+func (u *User) sendEvent(ev chatEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Room == "" {
+		ev.Room = u.room().name
+	}
+	if data := u.format(ev); len(data) > 0 {
+		u.queue(data, u.session)
+	}
+}
+
+// eventFor turns what writeln would show into an event
+func (u *User) eventFor(senderName, msg string) chatEvent {
+	msg = strings.ReplaceAll(stripansi.Strip(msg), "\a", "")
+	msg = strings.ReplaceAll(msg, `\n`, "\n")
+	ev := chatEvent{Type: "msg", From: stripansi.Strip(senderName), Text: strings.TrimSpace(msg)}
+	switch {
+	case senderName == "":
+		ev.Type = "notice"
+	case strings.HasSuffix(senderName, " -> "): // a DM to u
+		ev.Type, ev.From = "dm", strings.TrimSuffix(ev.From, " -> ")
+	case strings.HasSuffix(senderName, " <- "): // a DM u sent
+		ev.Type, ev.From, ev.To = "dm-sent", stripansi.Strip(u.Name), strings.TrimSuffix(ev.From, " <- ")
+	}
+	return ev
+}
+
+// jsonRepl reads requests from a client in JSON mode until it disconnects
+func (u *User) jsonRepl() {
+	sc := bufio.NewScanner(u.session)
+	sc.Buffer(make([]byte, 0, 4096), 4*maxMsgLen)
+	for sc.Scan() {
+		u.lastInteract = time.Now()
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var req jsonRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			u.sendEvent(chatEvent{Type: "error", Text: "无法解析请求: " + err.Error()})
+			continue
+		}
+		line, errMsg := u.jsonLine(req)
+		if errMsg != "" {
+			u.sendEvent(chatEvent{Type: "error", Text: errMsg})
+			continue
+		}
+		if len(line) > maxMsgLen {
+			line = line[:maxMsgLen]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		run := runCommands
+		if req.Type == "msg" { // only cmd runs commands
+			run = sendMessage
+		}
+		if !u.handleLine(line, run) {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil {
+		u.srv.Log.Println(u.Name, err)
+		u.close(u.Name + " 由于错误已离开聊天: " + err.Error())
+		return
+	}
+	u.close(u.Name + " 已离开聊天")
+}
+
+// jsonLine turns a request into the line to send, moving u to the request's room if needed
+func (u *User) jsonLine(req jsonRequest) (line string, errMsg string) {
+	switch req.Type {
+	case "msg":
+		if req.Room != "" && req.Room != u.room().name {
+			if !validRoomName(req.Room) {
+				return "", "无效的房间名称: " + req.Room
+			}
+			u.messaging = nil
+			u.changeRoom(u.srv.Rooms.getOrCreate(req.Room))
+		}
+		return req.Text, ""
+	case "cmd":
+		return req.Text, ""
+	case "dm":
+		if req.To == "" {
+			return "", "dm 需要 to"
+		}
+		return "=" + req.To + " " + req.Text, ""
+	}
+	return "", "未知的请求类型: " + req.Type
+}
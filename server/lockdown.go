@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+)
+
+// LockdownState is stored in lockdown.json in the data directory so it survives restarts
+type LockdownState struct {
+	Locked bool      `json:",omitempty"`
+	Reason string    `json:",omitempty"`
+	By     string    `json:",omitempty"`
+	Since  time.Time `json:",omitempty"`
+	// TrustedOnly restricts posting to admins and users on the allowlist
+	TrustedOnly bool `json:",omitempty"`
+
+	// MaintenanceAt is when maintenance starts. Joins are blocked from then until maintenance is lifted.
+	MaintenanceAt     time.Time `json:",omitempty"`
+	MaintenanceReason string    `json:",omitempty"`
+}
+
+// maintenanceWarnings are how long before maintenance the countdown is broadcast
+var maintenanceWarnings = []time.Duration{time.Hour, 30 * time.Minute, 15 * time.Minute, 10 * time.Minute,
+	5 * time.Minute, 2 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second}
+
+func (srv *Server) lockdownFile() string {
+	return filepath.Join(srv.Config().DataDir, "lockdown.json")
+}
+
+// saveLockdown saves the lockdown state. lockdownMutex must be held.
+func (srv *Server) saveLockdown() {
+	data, err := json.MarshalIndent(srv.Lockdown, "", "   ")
+	if err != nil {
+		srv.Log.Println("编码锁定状态时出错:", err)
+		return
+	}
+	if err = os.WriteFile(srv.lockdownFile(), data, 0600); err != nil {
+		srv.Log.Println("保存锁定状态时出错:", err)
+	}
+}
+
+// readLockdown loads the lockdown state and resumes a maintenance countdown if one was running
+func (srv *Server) readLockdown() {
+	data, err := os.ReadFile(srv.lockdownFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			srv.Log.Println(err)
+		}
+		return
+	}
+	srv.lockdownMutex.Lock()
+	defer srv.lockdownMutex.Unlock()
+	if err = json.Unmarshal(data, &srv.Lockdown); err != nil {
+		srv.Log.Println("加载锁定状态时出错:", err)
+		return
+	}
+	if !srv.Lockdown.MaintenanceAt.IsZero() && time.Now().Before(srv.Lockdown.MaintenanceAt) {
+		srv.startCountdown(srv.Lockdown.MaintenanceAt, srv.Lockdown.MaintenanceReason)
+	}
+}
+
+func (srv *Server) broadcastAll(msg string) {
+	for _, r := range srv.Rooms.all() {
+		r.broadcast(Devbot, msg)
+	}
+}
+
+func printCountdown(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return printPrettyDuration(d)
+}
+
+// startCountdown broadcasts warnings to every room until maintenance starts at at. lockdownMutex must be held.
+func (srv *Server) startCountdown(at time.Time, reason string) {
+	if srv.countdownStop != nil {
+		close(srv.countdownStop)
+	}
+	stop := make(chan struct{})
+	srv.countdownStop = stop
+	go func() {
+		for _, w := range maintenanceWarnings {
+			wait := time.Until(at.Add(-w))
+			if wait < 0 {
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+				srv.broadcastAll("服务器将在 " + printCountdown(w) + " 后进入维护模式" + reasonSuffix(reason))
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(at)):
+			srv.broadcastAll("服务器现在处于维护模式，新的连接将被拒绝" + reasonSuffix(reason))
+			srv.Log.Println("维护开始" + reasonSuffix(reason))
+		}
+	}()
+}
+
+// joinBlocked returns why u can't join because of a lockdown or maintenance, or an empty string if they can.
+// Admins can always join.
+func joinBlocked(u *User) string {
+	if auth(u) {
+		return ""
+	}
+	u.srv.lockdownMutex.Lock()
+	defer u.srv.lockdownMutex.Unlock()
+	if u.srv.Lockdown.Locked {
+		return "服务器已锁定，暂时不接受新的连接" + reasonSuffix(u.srv.Lockdown.Reason)
+	}
+	if !u.srv.Lockdown.MaintenanceAt.IsZero() && !time.Now().Before(u.srv.Lockdown.MaintenanceAt) {
+		return "服务器正在维护中，请稍后再试" + reasonSuffix(u.srv.Lockdown.MaintenanceReason)
+	}
+	return ""
+}
+
+// trusted reports whether u can post when a lockdown restricts posting. On a public server that is only
+// admins unless users were added to the allowlist.
+func trusted(u *User) bool {
+	_, ok := u.srv.Config().Allowlist[u.id]
+	return ok || auth(u) || u.isBridge
+}
+
+// postBlocked returns why u can't send messages to other users, or an empty string if they can
+func postBlocked(u *User) string {
+	if u.readOnly {
+		return "您的网络只有只读权限，不能发送消息"
+	}
+	u.srv.lockdownMutex.Lock()
+	restricted := u.srv.Lockdown.Locked && u.srv.Lockdown.TrustedOnly
+	u.srv.lockdownMutex.Unlock()
+	if restricted && !trusted(u) {
+		return "服务器已锁定，只有管理员和允许列表中的用户可以发送消息"
+	}
+	return ""
+}
+
+// trustedOnlyNote is added to lockdown messages when only trusted users can post
+const trustedOnlyNote = "。只有管理员和允许列表中的用户可以发送消息"
+
+func lockdownCMD(line string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	if msg := u.srv.setLockdown(line, u); msg != "" { // broadcast after unlocking, it can take a while
+		u.srv.broadcastAll(msg)
+	}
+}
+
+// setLockdown changes the lockdown as admin u asked in line, returning what to tell every room
+func (srv *Server) setLockdown(line string, u *User) (announce string) {
+	args := strings.Fields(line)
+	srv.lockdownMutex.Lock()
+	defer srv.lockdownMutex.Unlock()
+	if len(args) > 0 {
+		switch args[0] {
+		case "status":
+			if !srv.Lockdown.Locked {
+				u.writeln(Devbot, "服务器没有锁定")
+				return ""
+			}
+			msg := "服务器已被 " + srv.Lockdown.By + " 锁定 " + printPrettyDuration(time.Since(srv.Lockdown.Since)) + reasonSuffix(srv.Lockdown.Reason)
+			if srv.Lockdown.TrustedOnly {
+				msg += trustedOnlyNote
+			}
+			u.writeln(Devbot, msg)
+			return ""
+		case "off":
+			if !srv.Lockdown.Locked {
+				u.writeln(Devbot, "服务器没有锁定")
+				return ""
+			}
+			srv.Lockdown.Locked = false
+			srv.Lockdown.Reason, srv.Lockdown.By, srv.Lockdown.Since, srv.Lockdown.TrustedOnly = "", "", time.Time{}, false
+			srv.saveLockdown()
+			srv.audit(u, "unlock", "", "", "")
+			return "服务器锁定已解除"
+		}
+	}
+	trustedOnly := len(args) > 0 && args[0] == "-p"
+	if trustedOnly {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "-p"))
+	}
+	srv.Lockdown.Locked = true
+	srv.Lockdown.Reason = line
+	srv.Lockdown.By = stripansi.Strip(u.Name)
+	srv.Lockdown.Since = time.Now()
+	srv.Lockdown.TrustedOnly = trustedOnly
+	srv.saveLockdown()
+	srv.audit(u, "lockdown", "", "", line)
+	msg := "服务器已锁定，新的连接将被拒绝" + reasonSuffix(line)
+	if trustedOnly {
+		msg += trustedOnlyNote
+	}
+	return msg
+}
+
+func maintenanceCMD(line string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	if msg := u.srv.setMaintenance(line, u); msg != "" {
+		u.srv.broadcastAll(msg)
+	}
+}
+
+// setMaintenance schedules or cancels maintenance as admin u asked in line, returning what to tell every room
+func (srv *Server) setMaintenance(line string, u *User) (announce string) {
+	args := strings.Fields(line)
+	srv.lockdownMutex.Lock()
+	defer srv.lockdownMutex.Unlock()
+	if len(args) == 0 {
+		switch {
+		case srv.Lockdown.MaintenanceAt.IsZero():
+			u.writeln(Devbot, "没有计划的维护。用法: maintenance <time>|off [reason]")
+		case time.Now().Before(srv.Lockdown.MaintenanceAt):
+			u.writeln(Devbot, "维护将在 "+printCountdown(time.Until(srv.Lockdown.MaintenanceAt))+" 后开始"+reasonSuffix(srv.Lockdown.MaintenanceReason))
+		default:
+			u.writeln(Devbot, "服务器处于维护模式"+reasonSuffix(srv.Lockdown.MaintenanceReason))
+		}
+		return ""
+	}
+	if args[0] == "off" {
+		if srv.Lockdown.MaintenanceAt.IsZero() {
+			u.writeln(Devbot, "没有计划的维护")
+			return ""
+		}
+		if srv.countdownStop != nil {
+			close(srv.countdownStop)
+			srv.countdownStop = nil
+		}
+		srv.Lockdown.MaintenanceAt, srv.Lockdown.MaintenanceReason = time.Time{}, ""
+		srv.saveLockdown()
+		srv.audit(u, "maintenance", "", "", "off")
+		return "维护已取消"
+	}
+	at, ok := parseMaintenanceTime(args[0], u)
+	if !ok {
+		u.writeln(Devbot, "无效的时间。使用时长 (如 10m) 或时间 (如 23:30)")
+		return ""
+	}
+	reason := strings.TrimSpace(strings.TrimPrefix(line, args[0]))
+	srv.Lockdown.MaintenanceAt, srv.Lockdown.MaintenanceReason = at, reason
+	srv.saveLockdown()
+	srv.startCountdown(at, reason)
+	srv.audit(u, "maintenance", "", "", line)
+	return "服务器将在 " + printCountdown(time.Until(at)) + " 后进入维护模式" + reasonSuffix(reason)
+}
+
+// parseMaintenanceTime parses a duration from now or a time of day in u's timezone
+func parseMaintenanceTime(s string, u *User) (time.Time, bool) {
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return time.Now().Add(d), true
+	}
+	loc := time.Local
+	if u.Timezone.Location != nil {
+		loc = u.Timezone.Location
+	}
+	t, err := time.ParseInLocation("15:04", s, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	now := time.Now().In(loc)
+	at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	if at.Before(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at, true
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// parseNetwork parses a CIDR range or a single IP (treated as a /32 or /128).
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// parseNetworks parses a list of CIDR ranges or IPs.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isCIDR reports whether s looks like a CIDR range rather than a single address
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// addrMatches reports whether addr is equal to pattern or, if pattern is a CIDR range, inside it.
+func addrMatches(pattern string, addr string) bool {
+	if pattern == "" || addr == "" {
+		return false
+	}
+	if pattern == addr {
+		return true
+	}
+	if !strings.Contains(pattern, "/") {
+		return false
+	}
+	_, n, err := net.ParseCIDR(pattern)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && n.Contains(ip)
+}
+
+func inNetworks(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// netAllowed applies the static network denylist and allowlist from the config.
+// An empty allowlist allows everyone who isn't on the denylist.
+func (srv *Server) netAllowed(addr string) bool {
+	c := srv.Config()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return len(c.allowNets) == 0
+	}
+	if inNetworks(c.denyNets, ip) {
+		return false
+	}
+	return len(c.allowNets) == 0 || inNetworks(c.allowNets, ip)
+}
+
+// filterConn is used as the SSH server's connection callback. It drops connections from
+// denied networks before the SSH handshake starts.
+func (srv *Server) filterConn(_ ssh.Context, conn net.Conn) net.Conn {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !srv.netAllowed(host) {
+		srv.Log.Println("拒绝来自 " + host + " 的连接 (网络不被允许)")
+		return nil // the ssh package closes the connection
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)              //nolint:errcheck
+		tcp.SetKeepAlivePeriod(time.Minute) //nolint:errcheck
+	}
+	return conn
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outbox overflow policies
+const (
+	OverflowDropOldest = "drop-oldest" // drop the oldest queued message to make room
+	OverflowDisconnect = "disconnect"  // disconnect clients that can't keep up
+)
+
+// OutboxConfig controls the queue of output waiting to be written to each user's terminal
+type OutboxConfig struct {
+	// Size is the maximum number of writes queued for a user
+	Size     int    `yaml:"size"`
+	Overflow string `yaml:"overflow"`
+}
+
+const outboxFlushTimeout = time.Second
+
+// outbox queues writes to a user's terminal so a slow client doesn't hold up everyone else.
+// It is drained by the user's own goroutine.
+type outbox struct {
+	lock    sync.Mutex
+	queue   []outboxItem
+	dropped int           // writes dropped since the last one that was written
+	ready   chan struct{} // has a value if there might be something in the queue
+	stop    chan struct{} // closed when the outbox is shut down
+	stopped bool
+}
+
+type outboxItem struct {
+	data    []byte
+	flushed chan struct{} // if set, this is a marker that is closed when everything before it was written
+}
+
+func validateOutbox(c OutboxConfig) error {
+	if c.Size < 1 {
+		return errors.New("outbox.size 必须至少为 1")
+	}
+	if c.Overflow != OverflowDropOldest && c.Overflow != OverflowDisconnect {
+		return errors.New("outbox.overflow 必须是 drop-oldest 或 disconnect")
+	}
+	return nil
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1), stop: make(chan struct{})}
+}
+
+// push queues an item, applying the limits in c. It returns true if the queue was full and the client
+// should be disconnected.
+func (ob *outbox) push(item outboxItem, c OutboxConfig) (overflowed bool) {
+	ob.lock.Lock()
+	if ob.stopped {
+		ob.lock.Unlock()
+		return false
+	}
+	if item.flushed == nil && len(ob.queue) >= c.Size {
+		if c.Overflow == OverflowDisconnect {
+			ob.lock.Unlock()
+			ob.shutdown()
+			return true
+		}
+		ob.queue = ob.queue[1:]
+		ob.dropped++
+	}
+	ob.queue = append(ob.queue, item)
+	ob.lock.Unlock()
+	select {
+	case ob.ready <- struct{}{}:
+	default: // already signalled
+	}
+	return false
+}
+
+// pop removes the next item, returning false if the queue is empty
+func (ob *outbox) pop() (item outboxItem, dropped int, ok bool) {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if len(ob.queue) == 0 {
+		return outboxItem{}, 0, false
+	}
+	item = ob.queue[0]
+	ob.queue[0] = outboxItem{} // let the data be garbage collected
+	ob.queue = ob.queue[1:]
+	dropped, ob.dropped = ob.dropped, 0
+	return item, dropped, true
+}
+
+// shutdown stops the outbox. Anything still queued is discarded.
+func (ob *outbox) shutdown() {
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if !ob.stopped {
+		ob.stopped = true
+		ob.queue = nil
+		close(ob.stop)
+	}
+}
+
+// flush waits until everything queued so far has been written, the outbox is shut down, or the timeout passes
+func (ob *outbox) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	ob.push(outboxItem{flushed: done}, OutboxConfig{}) // flush markers are never dropped
+	select {
+	case <-done:
+	case <-ob.stop:
+	case <-time.After(timeout):
+	}
+}
+
+// drainOutbox writes queued output to u's terminal until the outbox is shut down
+func (u *User) drainOutbox(ob *outbox) {
+	out := io.Writer(u.term)
+	if u.format != nil { // events go straight to the session
+		out = u.session
+	}
+	for {
+		select {
+		case <-ob.stop:
+			return
+		case <-ob.ready:
+		}
+		for {
+			item, dropped, ok := ob.pop()
+			if !ok {
+				break
+			}
+			if item.flushed != nil {
+				close(item.flushed)
+				continue
+			}
+			if dropped > 0 {
+				notice := "(您的连接太慢，丢弃了 " + strconv.Itoa(dropped) + " 条消息)"
+				if u.format != nil {
+					item.data = append(u.format(chatEvent{Type: "notice", Time: time.Now(), Room: u.room().name, Text: notice}), item.data...)
+				} else {
+					item.data = append([]byte(notice+"\n"), item.data...)
+				}
+			}
+			if _, err := out.Write(item.data); err != nil {
+				ob.shutdown()
+				u.close(u.Name + " 由于写入终端时出错而离开了聊天: " + err.Error())
+				return
+			}
+		}
+	}
+}
+
+// startOutbox makes writes to u's terminal asynchronous
+func (u *User) startOutbox() {
+	u.outbox = newOutbox()
+	go u.drainOutbox(u.outbox)
+}
+
+// write sends data to u's terminal. Once the outbox is started this never blocks on the client.
+// Users without a terminal are only sent events, so it does nothing for them.
+func (u *User) write(data []byte) {
+	if u.format != nil {
+		return
+	}
+	u.queue(data, u.term)
+}
+
+// queue sends data through the outbox, or straight to w if the outbox hasn't started
+func (u *User) queue(data []byte, w io.Writer) {
+	ob := u.outbox
+	if ob == nil { // bridges, and users who haven't finished joining
+		if _, err := w.Write(data); err != nil {
+			u.close(u.Name + " 由于写入终端时出错而离开了聊天: " + err.Error())
+		}
+		return
+	}
+	if ob.push(outboxItem{data: data}, u.srv.Config().Outbox) {
+		u.srv.Log.Println(u.Name + " [" + u.id + "] 的输出队列已满，断开连接")
+		go u.close(u.Name + " 由于连接太慢而离开了聊天")
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// roomCleanupDelay is how long an empty room is kept around before it is deleted
+const roomCleanupDelay = 24 * time.Hour
+
+// Registry owns the rooms and the users in them. Rooms are only added or removed, and users only
+// join, leave or move, through the registry, so that these changes are synchronized.
+//
+// Lock order: Registry.lock, then Room.usersMutex.
+type Registry struct {
+	lock    sync.RWMutex
+	rooms   map[string]*Room
+	main    *Room
+	cleanup map[*Room]*time.Timer // deletes rooms that stay empty
+}
+
+func newRegistry(main *Room) *Registry {
+	return &Registry{
+		rooms:   map[string]*Room{main.name: main},
+		main:    main,
+		cleanup: make(map[*Room]*time.Timer),
+	}
+}
+
+// get returns the room called name, if there is one
+func (reg *Registry) get(name string) (*Room, bool) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	r, ok := reg.rooms[name]
+	return r, ok
+}
+
+// getOrCreate returns the room called name, creating it if needed
+func (reg *Registry) getOrCreate(name string) *Room {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if r, ok := reg.rooms[name]; ok {
+		return r
+	}
+	r := &Room{name: name, users: make([]*User, 0, 10), srv: reg.main.srv}
+	reg.rooms[name] = r
+	return r
+}
+
+// restore returns the room called name, creating it if needed. A room created here is deleted
+// like any other empty room if nobody joins it.
+func (reg *Registry) restore(name string) *Room {
+	r := reg.getOrCreate(name)
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if r.userCount() == 0 {
+		reg.scheduleCleanup(r)
+	}
+	return r
+}
+
+// all returns the rooms sorted by name
+func (reg *Registry) all() []*Room {
+	reg.lock.RLock()
+	rooms := make([]*Room, 0, len(reg.rooms))
+	for _, r := range reg.rooms {
+		rooms = append(rooms, r)
+	}
+	reg.lock.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	return rooms
+}
+
+// users returns everyone in every room
+func (reg *Registry) users() []*User {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	var all []*User
+	for _, r := range reg.rooms {
+		all = append(all, r.snapshot()...)
+	}
+	return all
+}
+
+// findUser returns a user called name (or @name) in any room
+func (reg *Registry) findUser(name string) (*User, bool) {
+	for _, r := range reg.all() {
+		if u, ok := findUserByName(r, name); ok {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// findByID returns every session with id
+func (reg *Registry) findByID(id string) []*User {
+	var found []*User
+	for _, u := range reg.users() {
+		if u.id == id {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+// join adds u to r
+func (reg *Registry) join(u *User, r *Room) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if _, ok := reg.rooms[r.name]; !ok {
+		reg.rooms[r.name] = r
+	}
+	u.inRoom.Store(r)
+	u.left = false
+	r.usersMutex.Lock()
+	r.users = append(r.users, u)
+	r.usersMutex.Unlock()
+}
+
+// leave removes u from their room and returns it. It returns nil if they weren't in it, so that only one
+// caller goes on to clean up after a user who is closed from several places at once.
+func (reg *Registry) leave(u *User) *Room {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	r := u.room()
+	if r == nil || u.left {
+		return nil
+	}
+	u.left = true // so a move that was about to happen doesn't put them back
+	r.usersMutex.Lock()
+	before := len(r.users)
+	r.users = remove(r.users, u)
+	left := len(r.users) < before
+	r.usersMutex.Unlock()
+	if !left {
+		return nil
+	}
+	reg.scheduleCleanup(r)
+	return r
+}
+
+// move takes u out of their room and puts them in r in one step, returning the room they were in.
+// It returns nil and does nothing if they are already in r or have left.
+func (reg *Registry) move(u *User, r *Room) *Room {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	old := u.room()
+	if old == r || u.left {
+		return nil
+	}
+	if _, ok := reg.rooms[r.name]; !ok {
+		reg.rooms[r.name] = r
+	}
+	if old != nil {
+		old.usersMutex.Lock()
+		old.users = remove(old.users, u)
+		old.usersMutex.Unlock()
+		reg.scheduleCleanup(old)
+	}
+	u.inRoom.Store(r)
+	r.usersMutex.Lock()
+	r.users = append(r.users, u)
+	r.usersMutex.Unlock()
+	return old
+}
+
+// removeRoom deletes an empty room
+func (reg *Registry) removeRoom(name string) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	r, ok := reg.rooms[name]
+	if !ok {
+		return errors.New("No such room")
+	}
+	if r == reg.main {
+		return errors.New("Operation not permitted")
+	}
+	if r.userCount() != 0 {
+		return errors.New("Room not empty")
+	}
+	reg.deleteRoom(r)
+	return nil
+}
+
+// scheduleCleanup deletes r once it has been empty for roomCleanupDelay. reg.lock must be held.
+func (reg *Registry) scheduleCleanup(r *Room) {
+	if r == reg.main {
+		return
+	}
+	if t, ok := reg.cleanup[r]; ok {
+		t.Reset(roomCleanupDelay)
+		return
+	}
+	reg.cleanup[r] = time.AfterFunc(roomCleanupDelay, func() {
+		reg.lock.Lock()
+		defer reg.lock.Unlock()
+		if r.userCount() == 0 && reg.rooms[r.name] == r {
+			reg.deleteRoom(r)
+		} else {
+			delete(reg.cleanup, r)
+		}
+	})
+}
+
+// deleteRoom removes r. reg.lock must be held.
+func (reg *Registry) deleteRoom(r *Room) {
+	if t, ok := reg.cleanup[r]; ok {
+		t.Stop()
+		delete(reg.cleanup, r)
+	}
+	delete(reg.rooms, r.name)
+}
+
+// snapshot returns a copy of the users in r that is safe to iterate over
+func (r *Room) snapshot() []*User {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+	return append(make([]*User, 0, len(r.users)), r.users...)
+}
+
+func (r *Room) userCount() int {
+	r.usersMutex.RLock()
+	defer r.usersMutex.RUnlock()
+	return len(r.users)
+}
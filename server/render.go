@@ -0,0 +1,134 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/charmbracelet/glamour"
+	"github.com/charmbracelet/glamour/ansi"
+)
+
+// renderCacheSize is how many rendered messages are kept. A broadcast renders the same message for
+// everyone with the same terminal width, so only recent messages need to be kept.
+const renderCacheSize = 256
+
+type renderKey struct {
+	msg        string
+	prefix     int // the length of what's printed before the message
+	width      int
+	showImages bool
+}
+
+// renderCache is an LRU cache of rendered messages
+type renderCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List // most recently used at the front
+	entries map[renderKey]*list.Element
+}
+
+type renderEntry struct {
+	key      renderKey
+	rendered string
+}
+
+// newRenderCache makes a cache that holds size messages. A size of 0 disables caching.
+func newRenderCache(size int) *renderCache {
+	return &renderCache{size: size, order: list.New(), entries: make(map[renderKey]*list.Element, size)}
+}
+
+func (c *renderCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order.Init()
+	c.entries = make(map[renderKey]*list.Element, c.size)
+}
+
+func (c *renderCache) get(k renderKey) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*renderEntry).rendered, true
+	}
+	return "", false
+}
+
+func (c *renderCache) add(k renderKey, rendered string) {
+	if c.size == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*renderEntry).rendered = rendered
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&renderEntry{k, rendered})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderEntry).key)
+	}
+}
+
+// lockedRenderer is a glamour renderer that can be shared. Renderers can't be used concurrently.
+type lockedRenderer struct {
+	sync.Mutex
+	*glamour.TermRenderer
+	wrap int
+}
+
+// maxRenderers is how many renderers are kept. Every terminal width needs its own renderer, so
+// the least recently used ones are dropped instead of keeping one for every width a client sends.
+const maxRenderers = 32
+
+var (
+	renderers      = make(map[int]*list.Element, maxRenderers) // keyed by word wrap width
+	renderersOrder = list.New()                                // most recently used at the front
+	renderersMutex sync.Mutex
+)
+
+func glamourStyle() ansi.StyleConfig {
+	style := glamour.DarkStyleConfig
+	style.Document.Color = nil
+	style.Document.Margin = nil
+	style.Image = ansi.StylePrimitive{Format: "\n<img>{{.text}}</img>\n"}
+	style.ImageText.Format = "Image: {{.text}}"
+	style.Table.StyleBlock.StylePrimitive.Prefix = "\x1b[0m" // ansi reset: hack to stop space in front of table from being erased
+	return style
+}
+
+// renderer returns the renderer that wraps text at wrap, making it if needed
+func renderer(wrap int) (*lockedRenderer, error) {
+	renderersMutex.Lock()
+	defer renderersMutex.Unlock()
+	if e, ok := renderers[wrap]; ok {
+		renderersOrder.MoveToFront(e)
+		return e.Value.(*lockedRenderer), nil
+	}
+	tr, err := glamour.NewTermRenderer(glamour.WithEmoji(), glamour.WithStyles(glamourStyle()), glamour.WithWordWrap(wrap), glamour.WithPreservedNewLines())
+	if err != nil {
+		return nil, err
+	}
+	r := &lockedRenderer{TermRenderer: tr, wrap: wrap}
+	renderers[wrap] = renderersOrder.PushFront(r)
+	if renderersOrder.Len() > maxRenderers { // anyone still using the oldest renderer can finish with it
+		oldest := renderersOrder.Back()
+		renderersOrder.Remove(oldest)
+		delete(renderers, oldest.Value.(*lockedRenderer).wrap)
+	}
+	return r, nil
+}
+
+// renderMarkdown renders a with a shared renderer
+func renderMarkdown(a string, wrap int) (string, error) {
+	r, err := renderer(wrap)
+	if err != nil {
+		return "", err
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.Render(a)
+}
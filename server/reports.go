@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+)
+
+// Report is a user's complaint about another user, queued for the admins
+type Report struct {
+	Num        int
+	Time       time.Time
+	Reporter   string
+	ReporterID string
+	Target     string
+	TargetID   string
+	Room       string
+	Reason     string   `json:",omitempty"`
+	MessageID  int      `json:",omitempty"`
+	Context    []string // the last few messages in the room when the report was made
+
+	Resolved   bool   `json:",omitempty"`
+	ResolvedBy string `json:",omitempty"`
+	ResolvedAt time.Time
+	Action     string `json:",omitempty"`
+}
+
+const reportContextLen = 10
+
+func (srv *Server) reportsFile() string {
+	return filepath.Join(srv.Config().DataDir, "reports.json")
+}
+
+// saveReports saves the reports queue. reportsMutex must be held.
+func (srv *Server) saveReports() {
+	data, err := json.MarshalIndent(srv.Reports, "", "   ")
+	if err != nil {
+		srv.Log.Println("编码举报时出错:", err)
+		return
+	}
+	if err = os.WriteFile(srv.reportsFile(), data, 0600); err != nil {
+		srv.Log.Println("保存举报时出错:", err)
+	}
+}
+
+func (srv *Server) readReports() {
+	data, err := os.ReadFile(srv.reportsFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			srv.Log.Println(err)
+		}
+		return
+	}
+	srv.reportsMutex.Lock()
+	defer srv.reportsMutex.Unlock()
+	if err = json.Unmarshal(data, &srv.Reports); err != nil {
+		srv.Log.Println("加载举报时出错:", err)
+	}
+}
+
+// findReport returns the report numbered num. reportsMutex must be held.
+func (srv *Server) findReport(num string) *Report {
+	n, err := strconv.Atoi(strings.TrimPrefix(num, "#"))
+	if err != nil {
+		return nil
+	}
+	for i := range srv.Reports {
+		if srv.Reports[i].Num == n {
+			return &srv.Reports[i]
+		}
+	}
+	return nil
+}
+
+// findRecentMessage looks for a message by ID in the recent messages of every room
+func (srv *Server) findRecentMessage(id int) (*Room, roomMessage, bool) {
+	for _, r := range srv.Rooms.all() {
+		for _, m := range r.recentMessages(maxRecentMessages) {
+			if m.id == id {
+				return r, m, true
+			}
+		}
+	}
+	return nil, roomMessage{}, false
+}
+
+// notifyAdmins DMs every admin who is online
+func (srv *Server) notifyAdmins(msg string) {
+	for _, us := range srv.Rooms.users() {
+		if auth(us) {
+			us.writeln(Devbot+" -> ", msg)
+		}
+	}
+}
+
+func reportCMD(line string, u *User) {
+	args := strings.Fields(line)
+	if len(args) == 0 { // show message IDs so the user knows what to report
+		msgs := u.room().recentMessages(reportContextLen)
+		if len(msgs) == 0 {
+			u.writeln(Devbot, "这个房间里还没有消息。使用 report @user [reason] 举报用户")
+			return
+		}
+		msg := "最近的消息 (使用 report #<id> [reason] 举报一条消息):  \n"
+		for _, m := range msgs {
+			msg += Cyan.Cyan("#"+strconv.Itoa(m.id)) + ". " + m.sender + ": " + m.text + "  \n"
+		}
+		u.writeln(Devbot, msg)
+		return
+	}
+	switch args[0] {
+	case "show":
+		reportShowCMD(strings.Join(args[1:], " "), u)
+		return
+	case "resolve":
+		reportResolveCMD(strings.Join(args[1:], " "), u)
+		return
+	}
+
+	rep := Report{
+		Time:       time.Now(),
+		Reporter:   stripansi.Strip(u.Name),
+		ReporterID: u.id,
+		Room:       u.room().name,
+		Reason:     strings.TrimSpace(strings.TrimPrefix(line, args[0])),
+	}
+	room := u.room()
+	if strings.HasPrefix(args[0], "#") { // a message ID, so that users with numbers for names can be reported too
+		id, err := strconv.Atoi(args[0][1:])
+		if err != nil {
+			u.writeln(Devbot, "无效的消息 ID。运行 report 查看最近消息的 ID")
+			return
+		}
+		r, m, ok := u.srv.findRecentMessage(id)
+		if !ok {
+			u.writeln(Devbot, "找不到该消息。运行 report 查看最近消息的 ID")
+			return
+		}
+		room = r
+		rep.Room = r.name
+		rep.MessageID = id
+		rep.Target = m.sender
+		rep.TargetID = m.senderID
+	} else {
+		target, ok := findUserByName(u.room(), args[0])
+		if !ok {
+			u.writeln(Devbot, "未找到用户")
+			return
+		}
+		rep.Target = stripansi.Strip(target.Name)
+		rep.TargetID = target.id
+	}
+	for _, m := range room.recentMessages(reportContextLen) {
+		rep.Context = append(rep.Context, "["+strconv.Itoa(m.id)+"] "+m.sender+": "+m.text)
+	}
+
+	u.srv.reportsMutex.Lock()
+	rep.Num = 1
+	if len(u.srv.Reports) > 0 {
+		rep.Num = u.srv.Reports[len(u.srv.Reports)-1].Num + 1
+	}
+	u.srv.Reports = append(u.srv.Reports, rep)
+	u.srv.saveReports()
+	u.srv.reportsMutex.Unlock()
+
+	u.writeln(Devbot, "谢谢，你的举报已发送给管理员")
+	u.srv.notifyAdmins("新举报 #" + strconv.Itoa(rep.Num) + ": " + rep.Reporter + " 举报了 " + rep.Target + " (" + rep.Room + ")" +
+		reasonSuffix(rep.Reason) + "。使用 report show " + strconv.Itoa(rep.Num) + " 查看")
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
+
+func reportsCMD(_ string, u *User) {
+	if !auth(u) {
+		u.room().broadcast(Devbot, "未授权")
+		return
+	}
+	u.srv.reportsMutex.Lock()
+	msg := ""
+	for _, rep := range u.srv.Reports {
+		if rep.Resolved {
+			continue
+		}
+		msg += Cyan.Cyan(strconv.Itoa(rep.Num)) + ". " + rep.Reporter + " 举报了 " + rep.Target + " (" + rep.Room + ", " +
+			printPrettyDuration(time.Since(rep.Time)) + " 前)" + reasonSuffix(rep.Reason) + "  \n"
+	}
+	u.srv.reportsMutex.Unlock()
+	if msg == "" {
+		u.writeln(Devbot, "没有待处理的举报")
+		return
+	}
+	u.writeln(Devbot, "待处理的举报:  \n"+msg)
+}
+
+func reportShowCMD(num string, u *User) {
+	if !auth(u) {
+		u.writeln(Devbot, "未授权")
+		return
+	}
+	u.srv.reportsMutex.Lock()
+	found := u.srv.findReport(num)
+	if found == nil {
+		u.srv.reportsMutex.Unlock()
+		u.writeln(Devbot, "找不到该举报")
+		return
+	}
+	rep := *found
+	u.srv.reportsMutex.Unlock()
+	msg := "举报 #" + strconv.Itoa(rep.Num) + "  \n" +
+		"举报者: " + rep.Reporter + " [" + rep.ReporterID + "]  \n" +
+		"被举报者: " + rep.Target + " [" + rep.TargetID + "]  \n" +
+		"房间: " + rep.Room + "  \n" +
+		"时间: " + printPrettyDuration(time.Since(rep.Time)) + " 前  \n"
+	if rep.Reason != "" {
+		msg += "原因: " + rep.Reason + "  \n"
+	}
+	if rep.MessageID != 0 {
+		msg += "消息 ID: " + strconv.Itoa(rep.MessageID) + "  \n"
+	}
+	if rep.Resolved {
+		msg += "已由 " + rep.ResolvedBy + " 处理: " + rep.Action + "  \n"
+	}
+	if len(rep.Context) > 0 {
+		msg += "上下文:  \n"
+		for _, c := range rep.Context {
+			msg += "> " + c + "  \n"
+		}
+	}
+	u.writeln(Devbot, msg)
+}
+
+func reportResolveCMD(line string, u *User) {
+	if !auth(u) {
+		u.writeln(Devbot, "未授权")
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		u.writeln(Devbot, "用法: report resolve <n> [action]")
+		return
+	}
+	action := strings.TrimSpace(strings.TrimPrefix(line, args[0]))
+	if action == "" {
+		action = "已处理"
+	}
+	u.srv.reportsMutex.Lock()
+	rep := u.srv.findReport(args[0])
+	if rep == nil {
+		u.srv.reportsMutex.Unlock()
+		u.writeln(Devbot, "找不到该举报")
+		return
+	}
+	rep.Resolved = true
+	rep.ResolvedBy = stripansi.Strip(u.Name)
+	rep.ResolvedAt = time.Now()
+	rep.Action = action
+	target, targetID := rep.Target, rep.TargetID
+	u.srv.saveReports()
+	u.srv.reportsMutex.Unlock()
+
+	u.srv.audit(u, "resolve-report", target, targetID, "#"+args[0]+": "+action)
+	u.writeln(Devbot, "举报 #"+strings.TrimPrefix(args[0], "#")+" 已处理: "+action)
+}
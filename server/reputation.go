@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Actions taken against users whose address is on a reputation list
+const (
+	RepReject   = "reject"   // refuse the connection
+	RepKeyAuth  = "keyauth"  // only allow users who log in with an SSH key
+	RepReadOnly = "readonly" // let them in, but don't let them send messages
+)
+
+// ReputationList is a list of IPs and CIDR ranges, one per line, loaded from a file or an http(s) URL.
+// Lines starting with # are ignored.
+type ReputationList struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+	// Refresh is how often the list is reloaded. Zero means it is only loaded once.
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+	Action  string        `yaml:"action"`
+}
+
+// reputationEntries is the loaded contents of a reputation list
+type reputationEntries struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+const maxReputationListSize = 16 << 20
+
+var reputationClient = &http.Client{Timeout: 30 * time.Second}
+
+func validRepAction(a string) bool {
+	return a == RepReject || a == RepKeyAuth || a == RepReadOnly
+}
+
+// validateReputation checks the reputation lists in the config
+func validateReputation(lists []ReputationList) error {
+	names := make(map[string]bool, len(lists))
+	for _, l := range lists {
+		if l.Name == "" || l.Source == "" {
+			return errors.New("信誉列表需要 name 和 source")
+		}
+		if names[l.Name] {
+			return errors.New("重复的信誉列表: " + l.Name)
+		}
+		names[l.Name] = true
+		if !validRepAction(l.Action) {
+			return errors.New("无效的信誉列表操作 " + l.Action + " (列表 " + l.Name + ")")
+		}
+	}
+	return nil
+}
+
+// parseReputationList reads IPs and CIDR ranges, one per line. Lines that can't be parsed are skipped.
+func parseReputationList(r io.Reader) (reputationEntries, error) {
+	e := reputationEntries{ips: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		n, err := parseNetwork(line)
+		if err != nil {
+			continue
+		}
+		if ones, bits := n.Mask.Size(); ones == bits {
+			e.ips[n.IP.String()] = true
+		} else {
+			e.nets = append(e.nets, n)
+		}
+	}
+	return e, scanner.Err()
+}
+
+func fetchReputationList(source string) (reputationEntries, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := reputationClient.Get(source)
+		if err != nil {
+			return reputationEntries{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return reputationEntries{}, errors.New("http: " + resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return reputationEntries{}, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseReputationList(io.LimitReader(r, maxReputationListSize))
+}
+
+// loadReputationList loads a list and replaces its previous contents. If loading fails,
+// the previous contents are kept. Nothing is replaced if stop was closed while the list was
+// being fetched, so a slow fetch for an old config can't overwrite lists loaded for a new one.
+func (srv *Server) loadReputationList(l ReputationList, stop <-chan struct{}) error {
+	e, err := fetchReputationList(l.Source)
+	if err != nil {
+		return err
+	}
+	srv.reputationMutex.Lock()
+	select {
+	case <-stop:
+		srv.reputationMutex.Unlock()
+		return nil
+	default:
+	}
+	srv.reputationData[l.Name] = e
+	srv.reputationMutex.Unlock()
+	srv.Log.Printf("已加载信誉列表 %s (%d 个地址, %d 个网络)\n", l.Name, len(e.ips), len(e.nets))
+	return nil
+}
+
+// startReputation loads the lists in the background and keeps them refreshed. Calling it again
+// stops refreshing the previous lists and forgets lists that are no longer configured.
+func (srv *Server) startReputation(lists []ReputationList) {
+	srv.reputationMutex.Lock()
+	if srv.reputationStop != nil {
+		close(srv.reputationStop)
+	}
+	stop := make(chan struct{})
+	srv.reputationStop = stop
+	for name := range srv.reputationData {
+		found := false
+		for _, l := range lists {
+			found = found || l.Name == name
+		}
+		if !found {
+			delete(srv.reputationData, name)
+		}
+	}
+	srv.reputationMutex.Unlock()
+
+	for _, l := range lists {
+		go func(l ReputationList) {
+			if err := srv.loadReputationList(l, stop); err != nil {
+				srv.Log.Println("加载信誉列表 "+l.Name+" 时出错:", err)
+			}
+			if l.Refresh <= 0 {
+				return
+			}
+			ticker := time.NewTicker(l.Refresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					if err := srv.loadReputationList(l, stop); err != nil {
+						srv.Log.Println("刷新信誉列表 "+l.Name+" 时出错:", err)
+					}
+				}
+			}
+		}(l)
+	}
+}
+
+// reputationAction returns the strictest action of the lists addr is on and the name of that list.
+// The action is empty if addr isn't on any list.
+func (srv *Server) reputationAction(addr string) (action, list string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", ""
+	}
+	strictness := map[string]int{"": 0, RepReadOnly: 1, RepKeyAuth: 2, RepReject: 3}
+	srv.reputationMutex.RLock()
+	defer srv.reputationMutex.RUnlock()
+	for _, l := range srv.Config().Reputation {
+		e, ok := srv.reputationData[l.Name]
+		if !ok || strictness[l.Action] <= strictness[action] {
+			continue
+		}
+		if e.ips[ip.String()] || inNetworks(e.nets, ip) {
+			action, list = l.Action, l.Name
+		}
+	}
+	return action, list
+}
+
+// readOnlyCMDs are the commands users who can't post can still run. Their output only goes back to the user.
+var readOnlyCMDs = map[string]bool{
+	"help": true, "cmds": true, "rest": true, "man": true, "users": true, "pwd": true, "cd": true, "exit": true,
+	":q": true, ":wq": true, "clear": true, "report": true, "prompt": true, "images": true, "bell": true, "tz": true,
+}
+
+// readOnlyAllowed reports whether a user who can't post can run cmd
+func readOnlyAllowed(cmd string, u *User) bool {
+	if u.messaging != nil {
+		return cmd == "cd" || cmd == "exit" || cmd == "pwd"
+	}
+	return readOnlyCMDs[cmd]
+}
+
+// reply shows a command's output to u's room, or only to u if they can't post there
+func (u *User) reply(senderName, msg string) {
+	room := u.room()
+	if muted, _ := u.mutedIn(room); muted || postBlocked(u) != "" {
+		u.writeln(senderName, msg)
+		return
+	}
+	room.broadcast(senderName, msg)
+}
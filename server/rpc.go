@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"context"
@@ -26,8 +26,7 @@ import (
 )
 
 var (
-	PluginCMDs = map[string]PluginCMD{}
-	RPCCMDs    = []CMD{
+	RPCCMDs = []CMD{
 		{"plugins", pluginsCMD, "", "列出插件命令"},
 	}
 	RPCCMDsRest = []CMD{
@@ -35,19 +34,17 @@ var (
 		{"revoke", revokeTokenCMD, "<token hash>", "撤销插件令牌 (admin)"},
 		{"grant", grantTokenCMD, "[user] [data]", "授予令牌并选择性地将其发送给用户 (admin)"},
 	}
-	ListenersNonMiddleware = make([]chan pb.MiddlewareChannelMessage, 0, 4)
-	ListenersMiddleware    = make([]chan pb.MiddlewareChannelMessage, 0, 4)
-	Tokens                 = make(map[string]string, 10)
 )
 
 type pluginServer struct {
 	pb.UnimplementedPluginServer
+	srv  *Server
 	lock sync.Mutex
 }
 
 func (s *pluginServer) RegisterListener(stream pb.Plugin_RegisterListenerServer) error {
 	s.lock.Lock()
-	Log.Println("[gRPC] 注册事件侦听器")
+	s.srv.Log.Println("[gRPC] 注册事件侦听器")
 	initialData, err := stream.Recv()
 	if err == io.EOF {
 		return nil
@@ -75,9 +72,9 @@ func (s *pluginServer) RegisterListener(stream pb.Plugin_RegisterListenerServer)
 	var listenerList *[]chan pb.MiddlewareChannelMessage
 
 	if isMiddleware {
-		listenerList = &ListenersMiddleware
+		listenerList = &s.srv.ListenersMiddleware
 	} else {
-		listenerList = &ListenersNonMiddleware
+		listenerList = &s.srv.ListenersNonMiddleware
 	}
 
 	c := make(chan pb.MiddlewareChannelMessage)
@@ -95,7 +92,12 @@ func (s *pluginServer) RegisterListener(stream pb.Plugin_RegisterListenerServer)
 	}()
 
 	for {
-		message := <-c
+		var message pb.MiddlewareChannelMessage
+		select {
+		case message = <-c:
+		case <-s.srv.done: // the server is shutting down
+			return nil
+		}
 
 		// If something goes wrong, make sure the goroutine sending the message doesn't block on waiting for a response
 		sendNilResponse := func() {
@@ -152,18 +154,30 @@ type PluginCMD struct {
 
 func (s *pluginServer) RegisterCmd(def *pb.CmdDef, stream pb.Plugin_RegisterCmdServer) error {
 	s.lock.Lock()
-	Log.Print("[gRPC] 使用 name 注册命令 " + def.Name)
-	PluginCMDs[def.Name] = PluginCMD{
+	s.srv.Log.Print("[gRPC] 使用 name 注册命令 " + def.Name)
+	cmd := PluginCMD{
 		argsInfo:       def.ArgsInfo,
 		info:           def.Info,
 		invocationChan: make(chan *pb.CmdInvocation),
 	}
+	s.srv.pluginCMDsMutex.Lock()
+	s.srv.PluginCMDs[def.Name] = cmd
+	s.srv.pluginCMDsMutex.Unlock()
 	s.lock.Unlock()
-	defer delete(PluginCMDs, def.Name)
+	defer func() {
+		s.srv.pluginCMDsMutex.Lock()
+		delete(s.srv.PluginCMDs, def.Name)
+		s.srv.pluginCMDsMutex.Unlock()
+	}()
 
 	for {
-		if err := stream.Send(<-PluginCMDs[def.Name].invocationChan); err != nil {
-			return err
+		select {
+		case inv := <-cmd.invocationChan:
+			if err := stream.Send(inv); err != nil {
+				return err
+			}
+		case <-s.srv.done: // the server is shutting down
+			return nil
 		}
 	}
 }
@@ -172,14 +186,18 @@ func (s *pluginServer) SendMessage(ctx context.Context, msg *pb.Message) (*pb.Me
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if msg.GetEphemeralTo() != "" {
-		u, success := findUserByName(Rooms[msg.Room], *msg.EphemeralTo)
+		r, ok := s.srv.Rooms.get(msg.Room)
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "房间不存在")
+		}
+		u, success := findUserByName(r, *msg.EphemeralTo)
 		if !success {
 			return nil, status.Error(codes.NotFound, "找不到用户 "+*msg.EphemeralTo)
 		}
 		u.writeln(msg.GetFrom()+" -> ", msg.Msg)
 	} else {
-		r := Rooms[msg.Room]
-		if r == nil {
+		r, ok := s.srv.Rooms.get(msg.Room)
+		if !ok {
 			return nil, status.Error(codes.InvalidArgument, "房间不存在")
 		}
 		r.broadcast(msg.GetFrom(), msg.Msg)
@@ -187,69 +205,89 @@ func (s *pluginServer) SendMessage(ctx context.Context, msg *pb.Message) (*pb.Me
 	return &pb.MessageRes{}, nil
 }
 
-func authorize(ctx context.Context) error {
+func (srv *Server) authorize(ctx context.Context) error {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		return status.Error(codes.Unauthenticated, "缺少元数据")
 	}
 
-	values := md["授权"]
+	values := md["authorization"]
 	if len(values) == 0 {
 		return status.Error(codes.Unauthenticated, "缺少授权标头")
 	}
 
-	token := strings.TrimPrefix(values[0], "承载 ")
+	token := strings.TrimPrefix(values[0], "Bearer ")
 
-	if Integrations.RPC.Key != "" && token == Integrations.RPC.Key {
+	if srv.Integrations().RPC.Key != "" && token == srv.Integrations().RPC.Key {
 		return nil
 	}
-	if _, ok = Tokens[token]; !ok {
+	if _, ok = srv.Tokens[token]; !ok {
 		return status.Error(codes.Unauthenticated, "无效的授权标头")
 	}
 	return nil
 }
 
-func rpcInit() {
-	if Integrations.RPC == nil {
+func (srv *Server) rpcInit() {
+	if srv.Integrations().RPC == nil {
+		return
+	}
+	srv.initTokens()
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.Integrations().RPC.Port))
+	if err != nil {
+		srv.Log.Println("[gRPC] 无法侦听插件服务器:", err)
 		return
 	}
-	MainCMDs = append(MainCMDs, RPCCMDs...)
-	RestCMDs = append(RestCMDs, RPCCMDsRest...)
-	initTokens()
+	grpcServer := srv.newPluginServer()
+	srv.lock.Lock()
+	srv.pluginServer, srv.pluginLis = grpcServer, lis
+	srv.lock.Unlock()
+	srv.Log.Printf("[gRPC] 插件服务器已在端口上启动 %d\n", lis.Addr().(*net.TCPAddr).Port)
 	go func() {
-		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", Integrations.RPC.Port))
-		if err != nil {
-			Log.Println("[gRPC] 无法侦听插件服务器:", err)
-			return
-		}
-		// TODO: add TLS if configured
-		grpcServer := grpc.NewServer(
-			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-				if err := authorize(ctx); err != nil {
-					return nil, err
-				}
-				return handler(ctx, req)
-			}),
-			grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-				if err := authorize(stream.Context()); err != nil {
-					return err
-				}
-				return handler(srv, stream)
-			}),
-			grpc.KeepaliveParams(keepalive.ServerParameters{Time: time.Second * 10}),
-		)
-		pb.RegisterPluginServer(grpcServer, &pluginServer{})
-		Log.Printf("[gRPC] 插件服务器已在端口上启动 %d\n", Integrations.RPC.Port)
-		if err = grpcServer.Serve(lis); err != nil {
-			Log.Println("[gRPC] 服务失败:", err)
+		if err := grpcServer.Serve(lis); err != nil {
+			srv.Log.Println("[gRPC] 服务失败:", err)
 		}
 	}()
 }
 
+// newPluginServer makes the gRPC server plugins connect to
+func (srv *Server) newPluginServer() *grpc.Server {
+	// TODO: add TLS if configured
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := srv.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(service interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := srv.authorize(stream.Context()); err != nil {
+				return err
+			}
+			return handler(service, stream)
+		}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: time.Second * 10}),
+	)
+	pb.RegisterPluginServer(grpcServer, &pluginServer{srv: srv})
+	return grpcServer
+}
+
+func (srv *Server) getPluginCMD(name string) (PluginCMD, bool) {
+	srv.pluginCMDsMutex.RLock()
+	defer srv.pluginCMDsMutex.RUnlock()
+	c, ok := srv.PluginCMDs[name]
+	return c, ok
+}
+
+func (srv *Server) pluginCMDCount() int {
+	srv.pluginCMDsMutex.RLock()
+	defer srv.pluginCMDsMutex.RUnlock()
+	return len(srv.PluginCMDs)
+}
+
 func runPluginCMDs(u *User, currCmd string, args string) (found bool) {
-	if pluginCmd, ok := PluginCMDs[currCmd]; ok {
+	if pluginCmd, ok := u.srv.getPluginCMD(currCmd); ok {
 		pluginCmd.invocationChan <- &pb.CmdInvocation{
-			Room: u.room.name,
+			Room: u.room().name,
 			From: stripansi.Strip(u.Name),
 			Args: args,
 		}
@@ -260,10 +298,10 @@ func runPluginCMDs(u *User, currCmd string, args string) (found bool) {
 
 // Hook that is called when a user sends a message (not private DMs)
 func sendMessageToPlugins(line string, u *User) {
-	if len(ListenersNonMiddleware) > 0 {
-		for _, l := range ListenersNonMiddleware {
+	if len(u.srv.ListenersNonMiddleware) > 0 {
+		for _, l := range u.srv.ListenersNonMiddleware {
 			l <- &pb.Event{
-				Room: u.room.name,
+				Room: u.room().name,
 				From: stripansi.Strip(u.Name),
 				Msg:  line,
 			}
@@ -271,23 +309,21 @@ func sendMessageToPlugins(line string, u *User) {
 	}
 }
 
-var middlewareLock = new(sync.Mutex)
-
 func getMiddlewareResult(u *User, line string) string {
-	if Integrations.RPC == nil {
+	if u.srv.Integrations().RPC == nil {
 		return line
 	}
 
-	middlewareLock.Lock()
-	defer middlewareLock.Unlock()
+	u.srv.middlewareLock.Lock()
+	defer u.srv.middlewareLock.Unlock()
 	// Middleware hook
-	for i := 0; i < len(ListenersMiddleware); i++ {
-		ListenersMiddleware[i] <- &pb.Event{
-			Room: u.room.name,
+	for i := 0; i < len(u.srv.ListenersMiddleware); i++ {
+		u.srv.ListenersMiddleware[i] <- &pb.Event{
+			Room: u.room().name,
 			From: stripansi.Strip(u.Name),
 			Msg:  line,
 		}
-		if res := (<-ListenersMiddleware[i]).(*pb.ListenerClientData_Response).Response.Msg; res != nil {
+		if res := (<-u.srv.ListenersMiddleware[i]).(*pb.ListenerClientData_Response).Response.Msg; res != nil {
 			line = *res
 		}
 	}
@@ -295,37 +331,39 @@ func getMiddlewareResult(u *User, line string) string {
 }
 
 func pluginsCMD(_ string, u *User) {
-	plugins := make([]CMD, 0, len(PluginCMDs))
-	for n, c := range PluginCMDs {
+	u.srv.pluginCMDsMutex.RLock()
+	plugins := make([]CMD, 0, len(u.srv.PluginCMDs))
+	for n, c := range u.srv.PluginCMDs {
 		plugins = append(plugins, CMD{
 			name:     n,
 			info:     c.info,
 			argsInfo: c.argsInfo,
 		})
 	}
+	u.srv.pluginCMDsMutex.RUnlock()
 	autogenerated := autogenCommands(plugins)
 	if autogenerated == "" {
 		autogenerated = "   (未加载任何插件命令)"
 	}
-	u.room.broadcast("", "插件命令  \n"+autogenerated)
+	u.room().broadcast("", "插件命令  \n"+autogenerated)
 }
 
-func initTokens() {
-	f, err := os.Open(Config.DataDir + string(os.PathSeparator) + "tokens.json")
+func (srv *Server) initTokens() {
+	f, err := os.Open(srv.Config().DataDir + string(os.PathSeparator) + "tokens.json")
 	if err != nil {
 		if !os.IsNotExist(err) {
-			Log.Println("读取令牌文件时出错:", err)
+			srv.Log.Println("读取令牌文件时出错:", err)
 		}
 		return
 	}
 	defer f.Close()
 	j, err := io.ReadAll(f)
 	if err != nil {
-		Log.Println("读取令牌文件时出错:", err)
+		srv.Log.Println("读取令牌文件时出错:", err)
 		return
 	}
 
-	err = json.Unmarshal(j, &Tokens)
+	err = json.Unmarshal(j, &srv.Tokens)
 	if err != nil {
 		var s []struct { // old format
 			Token string `json:"token"`
@@ -333,49 +371,49 @@ func initTokens() {
 		}
 		err = json.Unmarshal(j, &s)
 		if err != nil {
-			Log.Println("解码令牌文件时出错:", err)
+			srv.Log.Println("解码令牌文件时出错:", err)
 			return
 		}
-		Log.Println("更改令牌文件格式")
+		srv.Log.Println("更改令牌文件格式")
 		for i := range s {
-			Tokens[s[i].Token] = s[i].Data
+			srv.Tokens[s[i].Token] = s[i].Data
 		}
 		f.Close()
-		saveTokens()
+		srv.saveTokens()
 	}
 }
 
-func saveTokens() {
-	f, err := os.Create(Config.DataDir + string(os.PathSeparator) + "tokens.json")
+func (srv *Server) saveTokens() {
+	f, err := os.Create(srv.Config().DataDir + string(os.PathSeparator) + "tokens.json")
 	if err != nil {
-		Log.Println(err)
+		srv.Log.Println(err)
 	}
 	defer f.Close()
-	data, err := json.Marshal(Tokens)
+	data, err := json.Marshal(srv.Tokens)
 	if err != nil {
-		Log.Println("对令牌文件进行编码时出错:", err)
+		srv.Log.Println("对令牌文件进行编码时出错:", err)
 	}
 	_, err = f.Write(data)
 	if err != nil {
-		Log.Println("写入令牌文件时出错:", err)
+		srv.Log.Println("写入令牌文件时出错:", err)
 	}
 }
 
 func lsTokensCMD(_ string, u *User) {
 	if !auth(u) {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
 
-	if len(Tokens) == 0 {
-		u.room.broadcast(Devbot, "未授权.")
+	if len(u.srv.Tokens) == 0 {
+		u.room().broadcast(Devbot, "未授权.")
 		return
 	}
 	msg := "Tokens:  \n"
-	fmtString := "%" + fmt.Sprint(len(fmt.Sprint(len(Tokens)))) + "d"
+	fmtString := "%" + fmt.Sprint(len(fmt.Sprint(len(u.srv.Tokens)))) + "d"
 	i := 1
-	for t := range Tokens {
-		msg += Cyan.Cyan(fmt.Sprintf(fmtString, i)) + ". " + shasum(t) + "\t" + Tokens[t] + "  \n"
+	for t := range u.srv.Tokens {
+		msg += Cyan.Cyan(fmt.Sprintf(fmtString, i)) + ". " + shasum(t) + "\t" + u.srv.Tokens[t] + "  \n"
 		i++
 	}
 	u.writeln(Devbot, msg)
@@ -383,54 +421,58 @@ func lsTokensCMD(_ string, u *User) {
 
 func revokeTokenCMD(rest string, u *User) {
 	if !auth(u) {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
 
 	if len(rest) == 0 {
-		u.room.broadcast(Devbot, "请提供要撤销的令牌的 sha256 哈希值.")
+		u.room().broadcast(Devbot, "请提供要撤销的令牌的 sha256 哈希值.")
 		return
 	}
-	for token := range Tokens {
+	for token := range u.srv.Tokens {
 		if shasum(token) == rest {
-			delete(Tokens, token)
-			saveTokens()
-			u.room.broadcast(Devbot, "令牌已撤销!")
+			u.srv.audit(u, "revoke", rest, "", u.srv.Tokens[token])
+			delete(u.srv.Tokens, token)
+			u.srv.saveTokens()
+			u.room().broadcast(Devbot, "令牌已撤销!")
 			return
 		}
 	}
-	u.room.broadcast(Devbot, "找不到令牌.")
+	u.room().broadcast(Devbot, "找不到令牌.")
 }
 
 func grantTokenCMD(rest string, u *User) {
 	if !auth(u) {
-		u.room.broadcast(Devbot, "未授权")
+		u.room().broadcast(Devbot, "未授权")
 		return
 	}
 
-	token, err := generateToken()
+	token, err := u.srv.generateToken()
 	if err != nil {
-		u.room.broadcast(Devbot, "生成令牌时出错: "+err.Error())
-		Log.Println(err)
+		u.room().broadcast(Devbot, "生成令牌时出错: "+err.Error())
+		u.srv.Log.Println(err)
 		return
 	}
 
 	split := strings.Fields(rest)
+	target, targetID := "", ""
 	if len(split) > 0 && len(split[0]) > 0 && split[0][0] == '@' {
-		toUser, ok := findUserByName(u.room, split[0][1:])
+		toUser, ok := findUserByName(u.room(), split[0][1:])
 		if ok {
+			target, targetID = toUser.Name, toUser.id
 			toUser.writeln(Devbot, "您已获得令牌: "+token)
 		} else {
-			u.room.broadcast(Devbot, "那是谁?")
+			u.room().broadcast(Devbot, "那是谁?")
 			return
 		}
 	}
-	Tokens[token] = rest
+	u.srv.Tokens[token] = rest
+	u.srv.audit(u, "grant", target, targetID, rest)
 	u.writeln(Devbot, "已授予的令牌: "+token)
-	saveTokens()
+	u.srv.saveTokens()
 }
 
-func generateToken() (string, error) {
+func (srv *Server) generateToken() (string, error) {
 	b := make([]byte, 32)
 	_, err := rand.Read(b)
 	if err != nil {
@@ -438,8 +480,8 @@ func generateToken() (string, error) {
 	}
 	token := "dvz@" + base64.StdEncoding.EncodeToString(b)
 	// check if it's already in use
-	if _, ok := Tokens[token]; ok {
-		return generateToken()
+	if _, ok := srv.Tokens[token]; ok {
+		return srv.generateToken()
 	}
 	return token, nil
 }
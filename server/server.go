@@ -0,0 +1,431 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "devzat/plugin"
+
+	goaway "github.com/TwiN/go-away"
+	"github.com/dghubble/go-twitter/twitter" //nolint:staticcheck // library deprecated
+	"github.com/gliderlabs/ssh"
+	"github.com/shurcooL/tictactoe"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v2"
+)
+
+// Server is a chat server. It owns its config, rooms, bans, listeners and integrations, so several
+// servers can run in one process.
+type Server struct {
+	config       atomic.Pointer[ConfigType] // replaced as a whole when it changes, see Config
+	integrations atomic.Pointer[IntegrationsType]
+	configMutex  sync.Mutex // serializes changes to config and integrations
+	configFile   string     // the file the config was loaded from, used when reloading. Empty if there is none.
+	configEdit   sync.Mutex // serializes edits to the config file and reloads of it, locked before configMutex
+	Log          *log.Logger
+	logFile      *os.File
+	StartupTime  time.Time
+
+	MainRoom         *Room
+	Rooms            *Registry
+	Backlog          []backlogMessage
+	backlogMutex     sync.Mutex
+	Bans             []Ban
+	bansMutex        sync.RWMutex
+	AntispamMessages map[string]int
+	antispamMutex    sync.Mutex
+	Conns            *connCounter
+	lastMessageID    int64
+
+	Lockdown      LockdownState
+	lockdownMutex sync.Mutex
+	countdownStop chan struct{} // closed to cancel the current maintenance countdown
+	Invites       []Invite
+	invitesMutex  sync.Mutex
+	Reports       []Report
+	reportsMutex  sync.Mutex
+	auditMutex    sync.Mutex
+
+	Filters        FilterConfig
+	filterPatterns []*regexp.Regexp
+	detector       *goaway.ProfanityDetector // built by applyFilters
+	filtersMutex   sync.RWMutex
+	filtersEdit    sync.Mutex // serializes reading, changing and applying the filters, locked before filtersMutex
+
+	reputationData  map[string]reputationEntries // keyed by list name
+	reputationMutex sync.RWMutex
+	reputationStop  chan struct{} // closed to stop the refresh goroutines of the current lists
+
+	renders     *renderCache
+	images      *imageStore
+	imageClient *http.Client
+	art         string
+
+	tttGame       *tictactoe.Board
+	currentPlayer tictactoe.State
+	hangGame      *hangman
+
+	PluginCMDs             map[string]PluginCMD
+	pluginCMDsMutex        sync.RWMutex // PluginCMDs changes whenever a plugin connects or disconnects
+	ListenersNonMiddleware []chan pb.MiddlewareChannelMessage
+	ListenersMiddleware    []chan pb.MiddlewareChannelMessage
+	middlewareLock         sync.Mutex
+	Tokens                 map[string]string
+
+	// the bridges are nil when they are off, and replaced when their config is reloaded
+	slack         atomic.Pointer[slackBridge]
+	discord       atomic.Pointer[discordBridge]
+	twitterClient atomic.Pointer[twitter.Client]
+	allowTweet    atomic.Bool
+	federation    *federation // nil if there are no peers
+
+	lock         sync.Mutex // guards the fields below
+	sshServers   []*ssh.Server
+	listeners    []net.Listener
+	pluginServer *grpc.Server
+	pluginLis    net.Listener
+	sessions     sync.WaitGroup
+	shuttingDown bool
+	done         chan struct{} // closed on shutdown to stop background goroutines
+
+	restoreRooms map[string]string // rooms to put users back in after a restart, keyed by ID
+	restoreUntil time.Time
+	restoreMutex sync.Mutex
+}
+
+// NewServer makes a server from a config. Nothing is started until Start is called.
+// integrations can be zero to run without any integrations.
+func NewServer(c ConfigType, integrations IntegrationsType) (*Server, error) {
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		return nil, err
+	}
+	logfile, err := os.OpenFile(filepath.Join(c.DataDir, "log.txt"), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		Log:         log.New(io.MultiWriter(logfile, os.Stdout), "", log.Ldate|log.Ltime|log.Lshortfile),
+		logFile:     logfile,
+		StartupTime: time.Now(),
+
+		Backlog:          make([]backlogMessage, c.Scrollback),
+		Bans:             make([]Ban, 0, 10),
+		AntispamMessages: make(map[string]int),
+		Conns:            newConnCounter(),
+		Invites:          make([]Invite, 0, 10),
+		Reports:          make([]Report, 0, 10),
+		reputationData:   make(map[string]reputationEntries),
+
+		renders: newRenderCache(renderCacheSize),
+
+		tttGame:       new(tictactoe.Board),
+		currentPlayer: tictactoe.X,
+		hangGame:      new(hangman),
+
+		PluginCMDs: make(map[string]PluginCMD),
+		Tokens:     make(map[string]string, 10),
+		done:       make(chan struct{}),
+	}
+	if c.denyNets, err = parseNetworks(c.NetDenylist); err != nil {
+		logfile.Close()
+		return nil, err
+	}
+	if c.allowNets, err = parseNetworks(c.NetAllowlist); err != nil {
+		logfile.Close()
+		return nil, err
+	}
+	srv.config.Store(&c)
+	srv.integrations.Store(&integrations)
+	srv.allowTweet.Store(true)
+	srv.MainRoom = &Room{name: "#main", users: make([]*User, 0, 10), srv: srv}
+	srv.Rooms = newRegistry(srv.MainRoom)
+	srv.images = newImageStore(srv)
+	srv.imageClient = srv.newImageClient()
+	srv.art = srv.getASCIIArt()
+
+	if err = srv.loadFilters(); err != nil {
+		logfile.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// Config returns the live config. It is replaced rather than changed, so a reader that needs several
+// settings to agree should call Config once and keep the result. It must not be modified: use updateConfig.
+func (srv *Server) Config() *ConfigType {
+	return srv.config.Load()
+}
+
+// Integrations returns the live integrations config. Like Config, it must not be modified.
+func (srv *Server) Integrations() *IntegrationsType {
+	return srv.integrations.Load()
+}
+
+// updateConfig replaces the config with a copy changed by f. The copy shares its maps and slices with the
+// old config, so f must replace any it changes instead of modifying them.
+func (srv *Server) updateConfig(f func(c *ConfigType)) {
+	srv.configMutex.Lock()
+	defer srv.configMutex.Unlock()
+	c := *srv.Config()
+	f(&c)
+	srv.config.Store(&c)
+}
+
+// LoadServer makes a server from a config file, writing the default config to it if it doesn't exist
+func LoadServer(configFile string) (*Server, error) {
+	if _, err := os.Stat(configFile); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		fmt.Println("配置文件未找到，因此使用默认配置文件并将其写入 " + configFile)
+		d, err := yaml.Marshal(defaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(configFile, d, 0644); err != nil {
+			return nil, err
+		}
+	}
+	c, integrations, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Config 加载自 " + configFile)
+	if c.IntegrationConfig != "" {
+		fmt.Println("集成配置从 " + c.IntegrationConfig)
+	}
+	srv, err := NewServer(c, integrations)
+	if err != nil {
+		return nil, err
+	}
+	srv.configFile = configFile
+	return srv, nil
+}
+
+// Start loads the saved state, starts the integrations and starts listening. It returns once the
+// listeners are open, and the server runs until Shutdown is called. A port of 0 picks a free port,
+// and an alt_port of 0 turns off the port that doesn't need a key.
+func (srv *Server) Start() error {
+	srv.readBans()
+	srv.readReports()
+	srv.readLockdown()
+	srv.readInvites()
+	srv.readState()
+	srv.checkKey(srv.Config().KeyFile)
+	if err := srv.federationInit(); err != nil {
+		return err
+	}
+
+	if err := srv.listen(fmt.Sprintf(":%d", srv.Config().Port), true); err != nil {
+		return err
+	}
+	if !srv.Config().Private && srv.Config().AltPort != 0 { // allow non-sshkey logins on a non-private server
+		if err := srv.listen(fmt.Sprintf(":%d", srv.Config().AltPort), false); err != nil {
+			srv.closeListeners()
+			return err
+		}
+		fmt.Println("还在端口服务", srv.Config().AltPort)
+	}
+	if srv.Config().Private {
+		srv.Log.Printf("在端口上启动专用 Devzat 服务器 %d\n 编辑您的配置以更改允许进入的人员", srv.Config().Port)
+	} else {
+		srv.Log.Printf("在端口上启动 Devzat 服务器 %d\n", srv.Config().Port)
+	}
+
+	go srv.sweepExpiredBans()
+	srv.startReputation(srv.Config().Reputation)
+	srv.startBridges(srv.Integrations(), &IntegrationsType{})
+	srv.rpcInit()
+	return nil
+}
+
+// listen starts an SSH server on addr. If keyAuth is false, clients don't need a key.
+func (srv *Server) listen(addr string, keyAuth bool) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	sshServer := srv.newSSHServer(addr, keyAuth)
+	srv.lock.Lock()
+	srv.sshServers = append(srv.sshServers, sshServer)
+	srv.listeners = append(srv.listeners, lis)
+	srv.lock.Unlock()
+	go func() {
+		if err := sshServer.Serve(lis); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+			srv.Log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address of the port that needs a key, or nil if the server hasn't started
+func (srv *Server) Addr() net.Addr {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if len(srv.listeners) == 0 {
+		return nil
+	}
+	return srv.listeners[0].Addr()
+}
+
+// PluginAddr returns the address of the plugin server, or nil if it isn't running
+func (srv *Server) PluginAddr() net.Addr {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.pluginLis == nil {
+		return nil
+	}
+	return srv.pluginLis.Addr()
+}
+
+func (srv *Server) closeListeners() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for _, s := range srv.sshServers {
+		s.Close()
+	}
+	srv.sshServers = nil
+	if srv.pluginServer != nil {
+		srv.pluginServer.Stop()
+		srv.pluginServer = nil
+	}
+}
+
+// trackSession counts a session so Shutdown can wait for it. It returns false if the server is shutting down.
+func (srv *Server) trackSession() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.shuttingDown {
+		return false
+	}
+	srv.sessions.Add(1)
+	return true
+}
+
+// errShutDown is returned when shutting down a server that was already shut down
+var errShutDown = errors.New("server already shut down")
+
+// Shutdown stops accepting connections, tells everyone the server is going down and disconnects them once
+// their output has been written, ends plugin streams and bridges, and saves the server's state. It waits for
+// sessions and plugin streams to end until ctx is done, in which case they are cut off and ctx's error is
+// returned. The state is saved either way.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	return srv.shutdown(ctx, false)
+}
+
+// Restart is like Shutdown, but users who reconnect soon after the server starts again are put back in
+// the rooms they were in.
+func (srv *Server) Restart(ctx context.Context) error {
+	return srv.shutdown(ctx, true)
+}
+
+func (srv *Server) shutdown(ctx context.Context, restart bool) error {
+	srv.lock.Lock()
+	if srv.shuttingDown {
+		srv.lock.Unlock()
+		return errShutDown
+	}
+	srv.shuttingDown = true
+	sshServers := srv.sshServers
+	srv.lock.Unlock()
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, s := range sshServers {
+		s.Shutdown(closed) //nolint:errcheck // with a done context this only closes the listeners, and the connections are closed below
+	}
+
+	users := srv.Rooms.users()
+	var members map[string]string
+	if restart {
+		members = make(map[string]string)
+		for _, u := range users {
+			if u.room() != srv.MainRoom {
+				members[u.id] = u.room().name
+			}
+		}
+		srv.broadcastAll("服务器正在重启，请在几秒钟后重新连接。 \n" +
+			"如果您在 " + printPrettyDuration(restoreWindow) + " 内重新连接，您将回到您现在所在的房间")
+	} else if len(users) > 0 {
+		srv.broadcastAll("服务器宕机！这可能是因为它正在更新。请尝试立即重新加入。 \n" +
+			"如果您仍然无法加入，请尝试在 2 分钟后重新加入")
+	}
+	for _, u := range users {
+		go u.close("") // closing flushes their output and saves their prefs
+	}
+	var err error
+	if !waitFor(ctx, srv.sessions.Wait) {
+		err = ctx.Err()
+	}
+
+	close(srv.done) // stops background work and ends plugin streams
+	srv.lock.Lock()
+	pluginServer := srv.pluginServer
+	srv.lock.Unlock()
+	if pluginServer != nil && !waitFor(ctx, pluginServer.GracefulStop) {
+		err = ctx.Err()
+	}
+	srv.closeListeners()
+	if srv.federation != nil && !waitFor(ctx, srv.federation.close) {
+		err = ctx.Err()
+	}
+
+	srv.lockdownMutex.Lock()
+	if srv.countdownStop != nil {
+		close(srv.countdownStop)
+		srv.countdownStop = nil
+	}
+	srv.lockdownMutex.Unlock()
+	srv.reputationMutex.Lock()
+	if srv.reputationStop != nil {
+		close(srv.reputationStop)
+		srv.reputationStop = nil
+	}
+	srv.reputationMutex.Unlock()
+	if b := srv.slack.Swap(nil); b != nil {
+		b.stop()
+	}
+	if b := srv.discord.Swap(nil); b != nil {
+		b.stop()
+	}
+
+	srv.saveBans()
+	if srv.Integrations().RPC != nil {
+		srv.saveTokens()
+	}
+	srv.saveState(members)
+	if err != nil {
+		srv.Log.Println("关闭服务器时出错:", err)
+	} else {
+		srv.Log.Println("服务器已关闭")
+	}
+	if closeErr := srv.logFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// waitFor runs f and waits for it to return. It returns false if ctx was done first.
+func waitFor(ctx context.Context, f func()) bool {
+	finished := make(chan struct{})
+	go func() {
+		f()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
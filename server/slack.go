@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/acarl005/stripansi"
+	"github.com/quackduck/term"
+	"github.com/slack-go/slack"
+)
+
+// slackBridge relays messages between the main room and a Slack channel. A new one is made whenever the
+// Slack config changes, and the old one is stopped.
+type slackBridge struct {
+	srv    *Server
+	info   SlackInfo
+	api    *slack.Client
+	rtm    *slack.RTM
+	out    chan string // messages to send to Slack
+	ctx    context.Context
+	cancel context.CancelFunc // stops the bridge
+	wg     sync.WaitGroup
+}
+
+// newSlackBridge connects to Slack, returning nil if Slack isn't configured
+func (srv *Server) newSlackBridge(info *SlackInfo) *slackBridge {
+	if info == nil {
+		return nil
+	}
+	b := &slackBridge{
+		srv:  srv,
+		info: *info,
+		api:  slack.New(info.Token),
+		out:  make(chan string, 100),
+	}
+	b.rtm = b.api.NewRTM()
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	go b.rtm.ManageConnection()
+	b.wg.Add(2)
+	go b.send()
+	go b.receive()
+	return b
+}
+
+// stop disconnects from Slack and waits for the bridge's goroutines to return
+func (b *slackBridge) stop() {
+	b.rtm.Disconnect() //nolint:errcheck // while receive still reads events, so the RTM can't block sending one
+	b.cancel()
+	b.wg.Wait()
+}
+
+// relay queues msg to be sent to Slack, dropping it if the queue is full
+func (b *slackBridge) relay(msg string) {
+	select {
+	case b.out <- msg:
+	default:
+		b.srv.Log.Println("Slack 通道溢出")
+	}
+}
+
+func (b *slackBridge) send() {
+	defer b.wg.Done()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case msg := <-b.out:
+			msg = strings.ReplaceAll(stripansi.Strip(msg), `\n`, "\n")
+			// not sent with the RTM, which blocks forever once it is disconnected
+			if _, _, err := b.api.PostMessageContext(b.ctx, b.info.ChannelID, slack.MsgOptionText(msg, false)); err != nil && b.ctx.Err() == nil {
+				b.srv.Log.Println("Error sending Slack message:", err)
+			}
+		}
+	}
+}
+
+func (b *slackBridge) receive() {
+	defer b.wg.Done()
+	srv := b.srv
+	uslack := new(User)
+	uslack.srv = srv
+	uslack.isBridge = true
+	devnull, _ := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	uslack.term = term.NewTerminal(devnull, "")
+	uslack.inRoom.Store(srv.MainRoom)
+	var botID string
+	for {
+		var msg slack.RTMEvent
+		select {
+		case <-b.ctx.Done():
+			return
+		case msg = <-b.rtm.IncomingEvents:
+		}
+		switch ev := msg.Data.(type) {
+		case *slack.MessageEvent:
+			msg := ev.Msg
+			text := strings.TrimSpace(msg.Text)
+			if msg.SubType != "" {
+				break // We're only handling normal messages.
+			}
+			u, _ := b.api.GetUserInfoContext(b.ctx, msg.User)
+			if u == nil || u.ID == botID {
+				break
+			}
+			h := sha1.Sum([]byte(u.ID))
+			i, _ := strconv.ParseInt(hex.EncodeToString(h[:2]), 16, 0) // two bytes as an int
+			name := strings.Fields(u.RealName)[0]
+			uslack.Name = Yellow.Paint(b.info.Prefix+" ") + (Styles[int(i)%len(Styles)]).apply(name)
+			if d := srv.discord.Load(); d != nil {
+				d.relay(DiscordMsg{
+					senderName: b.info.Prefix + " " + name,
+					msg:        text,
+					channel:    uslack.room().name,
+				}) // send this slack message to discord
+			}
+			runCommands(text, uslack)
+		case *slack.ConnectedEvent:
+			botID = ev.Info.User.ID
+			srv.Log.Println("Connected to Slack with bot ID", botID, "as", ev.Info.User.Name)
+		case *slack.InvalidAuthEvent:
+			srv.Log.Println("Invalid Slack authentication")
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// restoreWindow is how long after a restart users who reconnect are put back in the rooms they were in
+const restoreWindow = 10 * time.Minute
+
+// savedState is what is kept between runs of the server so that a restart doesn't lose the conversation
+type savedState struct {
+	SavedAt       time.Time
+	LastMessageID int64
+	Backlog       []savedMessage
+	Rooms         []savedRoom
+	// Members are the rooms users other than those in #main were in, keyed by ID. Only saved when restarting.
+	Members map[string]string `json:",omitempty"`
+}
+
+type savedRoom struct {
+	Name   string
+	Recent []savedMessage `json:",omitempty"`
+}
+
+// savedMessage is a message from the backlog or a room's recent messages
+type savedMessage struct {
+	ID       int `json:",omitempty"`
+	Time     time.Time
+	Sender   string
+	SenderID string `json:",omitempty"`
+	Text     string
+}
+
+func (srv *Server) stateFile() string {
+	return filepath.Join(srv.Config().DataDir, "state.json")
+}
+
+// saveState saves the rooms, their recent messages and the backlog. members is saved too if it isn't nil.
+func (srv *Server) saveState(members map[string]string) {
+	s := savedState{SavedAt: time.Now(), LastMessageID: atomic.LoadInt64(&srv.lastMessageID), Members: members}
+	srv.backlogMutex.Lock()
+	for _, m := range srv.Backlog {
+		if m.timestamp.IsZero() { // the backlog starts out full of empty messages
+			continue
+		}
+		s.Backlog = append(s.Backlog, savedMessage{Time: m.timestamp, Sender: m.senderName, Text: m.text})
+	}
+	srv.backlogMutex.Unlock()
+	for _, r := range srv.Rooms.all() {
+		room := savedRoom{Name: r.name}
+		for _, m := range r.recentMessages(maxRecentMessages) {
+			room.Recent = append(room.Recent, savedMessage{m.id, m.time, m.sender, m.senderID, m.text})
+		}
+		s.Rooms = append(s.Rooms, room)
+	}
+	data, err := json.MarshalIndent(s, "", "   ")
+	if err != nil {
+		srv.Log.Println("编码服务器状态时出错:", err)
+		return
+	}
+	if err = writeFileAtomic(srv.stateFile(), data); err != nil {
+		srv.Log.Println("保存服务器状态时出错:", err)
+	}
+}
+
+// readState restores what saveState saved. Rooms that nobody comes back to are deleted like other empty rooms.
+func (srv *Server) readState() {
+	data, err := os.ReadFile(srv.stateFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			srv.Log.Println(err)
+		}
+		return
+	}
+	var s savedState
+	if err = json.Unmarshal(data, &s); err != nil {
+		srv.Log.Println("加载服务器状态时出错:", err)
+		return
+	}
+	atomic.StoreInt64(&srv.lastMessageID, s.LastMessageID)
+
+	srv.backlogMutex.Lock()
+	n := len(srv.Backlog)
+	if len(s.Backlog) > n {
+		s.Backlog = s.Backlog[len(s.Backlog)-n:]
+	}
+	for i, m := range s.Backlog {
+		srv.Backlog[n-len(s.Backlog)+i] = backlogMessage{m.Time, m.Sender, m.Text}
+	}
+	srv.backlogMutex.Unlock()
+
+	for _, room := range s.Rooms {
+		r := srv.Rooms.restore(room.Name)
+		recent := make([]roomMessage, 0, len(room.Recent))
+		for _, m := range room.Recent {
+			recent = append(recent, roomMessage{m.ID, m.Time, m.Sender, m.SenderID, m.Text})
+		}
+		r.recentMutex.Lock()
+		r.recent = recent
+		r.recentMutex.Unlock()
+	}
+
+	if len(s.Members) > 0 && time.Since(s.SavedAt) < restoreWindow {
+		srv.restoreMutex.Lock()
+		srv.restoreRooms = s.Members
+		srv.restoreUntil = time.Now().Add(restoreWindow)
+		srv.restoreMutex.Unlock()
+	}
+}
+
+// restoredRoom returns the room the user with id was in before the server restarted, if they should be
+// put back in it. Each user is only put back once.
+func (srv *Server) restoredRoom(id string) (string, bool) {
+	srv.restoreMutex.Lock()
+	defer srv.restoreMutex.Unlock()
+	room, ok := srv.restoreRooms[id]
+	if !ok || time.Now().After(srv.restoreUntil) {
+		return "", false
+	}
+	delete(srv.restoreRooms, id)
+	return room, true
+}
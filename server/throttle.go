@@ -0,0 +1,103 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig limits how often and how many times people can connect.
+// Zero values disable the corresponding limit.
+type ThrottleConfig struct {
+	// ThrottleAfter is the number of joins per minute from one ID or IP after which joins are throttled
+	ThrottleAfter int `yaml:"throttle_after"`
+	// Action is what happens to throttled joins: "delay" or "reject"
+	Action string `yaml:"action"`
+	// Delay is how long throttled joins wait with the delay action
+	Delay time.Duration `yaml:"delay"`
+	// BanAfter is the number of joins per minute from one ID or IP after which they are banned
+	BanAfter int `yaml:"ban_after"`
+
+	MaxSessionsPerID int `yaml:"max_sessions_per_id"`
+	MaxSessionsPerIP int `yaml:"max_sessions_per_ip"`
+	// MaxConnections is the maximum number of users connected at once. Admins are not counted against it.
+	MaxConnections int `yaml:"max_connections"`
+}
+
+// connCounter tracks recent joins and open sessions by ID and IP
+type connCounter struct {
+	lock     sync.Mutex
+	joins    map[string]int // joins in the last minute
+	sessions map[string]int
+	total    int
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{joins: make(map[string]int, 10), sessions: make(map[string]int, 10)}
+}
+
+// recordJoin counts a join from each of keys for the next minute and returns the highest count among them.
+func (c *connCounter) recordJoin(keys ...string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	highest := 0
+	for _, k := range keys {
+		c.joins[k]++
+		if c.joins[k] > highest {
+			highest = c.joins[k]
+		}
+	}
+	time.AfterFunc(time.Minute, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, k := range keys {
+			c.joins[k]--
+			if c.joins[k] <= 0 {
+				delete(c.joins, k)
+			}
+		}
+	})
+	return highest
+}
+
+// acquire counts a session for id and addr. It returns an explanation if a limit is reached, in which case
+// nothing is counted. Admins are only subject to the per-ID and per-IP limits.
+func (c *connCounter) acquire(id, addr string, isAdmin bool, t ThrottleConfig) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.MaxConnections > 0 && !isAdmin && c.total >= t.MaxConnections {
+		return "服务器已满 (" + strconv.Itoa(t.MaxConnections) + " 个连接)，请稍后再试"
+	}
+	if t.MaxSessionsPerID > 0 && c.sessions[id] >= t.MaxSessionsPerID {
+		return "您的密钥已有太多会话 (最多 " + strconv.Itoa(t.MaxSessionsPerID) + " 个)"
+	}
+	if t.MaxSessionsPerIP > 0 && c.sessions[addr] >= t.MaxSessionsPerIP {
+		return "您的 IP 已有太多会话 (最多 " + strconv.Itoa(t.MaxSessionsPerIP) + " 个)"
+	}
+	c.sessions[id]++
+	if addr != id {
+		c.sessions[addr]++
+	}
+	if !isAdmin {
+		c.total++
+	}
+	return ""
+}
+
+// release undoes acquire
+func (c *connCounter) release(id, addr string, isAdmin bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, k := range []string{id, addr} {
+		c.sessions[k]--
+		if c.sessions[k] <= 0 {
+			delete(c.sessions, k)
+		}
+		if addr == id {
+			break
+		}
+	}
+	if !isAdmin {
+		c.total--
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acarl005/stripansi"
+	"github.com/dghubble/go-twitter/twitter" //nolint:staticcheck // library deprecated
+	"github.com/dghubble/oauth1"
+)
+
+func (srv *Server) sendCurrentUsersTwitterMessage() {
+	client := srv.twitterClient.Load()
+	if client == nil {
+		return
+	}
+	// TODO: count all users in all rooms
+	if srv.MainRoom.userCount() == 0 {
+		return
+	}
+	if !srv.allowTweet.CompareAndSwap(true, false) {
+		return
+	}
+	usersSnapshot := srv.MainRoom.snapshot()
+	areUsersEqual := func(a []*User, b []*User) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if b[i] != a[i] {
+				return false
+			}
+		}
+		return true
+	}
+	go func() {
+		time.Sleep(time.Second * 60)
+		srv.allowTweet.Store(true)
+		if !areUsersEqual(srv.MainRoom.snapshot(), usersSnapshot) {
+			return
+		}
+		srv.Log.Println("Sending twitter update")
+		names := make([]string, 0, len(usersSnapshot))
+		for _, us := range usersSnapshot {
+			names = append(names, us.Name)
+		}
+		t, _, err := client.Statuses.Update("People on Devzat rn: "+stripansi.Strip(fmt.Sprint(names))+"\nJoin em with \"ssh devzat.hackclub.com\"\nUptime: "+printPrettyDuration(time.Since(srv.StartupTime)), nil)
+		if err != nil {
+			if !strings.Contains(err.Error(), "twitter: 187 Status is a duplicate.") {
+				srv.Log.Println("Twitter error:", err)
+			}
+			srv.Log.Println("Got twitter err", err)
+			return
+		}
+		srv.MainRoom.broadcast(Devbot, "https\\://twitter.com/"+t.User.ScreenName+"/status/"+t.IDStr)
+	}()
+}
+
+// newTwitterClient logs in to Twitter, returning nil if Twitter isn't configured or the login fails
+func (srv *Server) newTwitterClient(info *TwitterInfo) *twitter.Client {
+	if info == nil {
+		return nil
+	}
+
+	config := oauth1.NewConfig(info.ConsumerKey, info.ConsumerSecret)
+	token := oauth1.NewToken(info.AccessToken, info.AccessTokenSecret)
+	httpClient := config.Client(oauth1.NoContext, token)
+	client := twitter.NewClient(httpClient)
+	_, _, err := client.Accounts.VerifyCredentials(nil)
+	if err != nil {
+		srv.Log.Println("Twitter auth failed:", err)
+		return nil
+	}
+	return client
+}
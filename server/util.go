@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"bytes"
@@ -10,10 +10,8 @@ import (
 	"encoding/pem"
 	"fmt"
 	"image"
-	"io"
 	"math"
 	"math/rand"
-	"net/http"
 	"os"
 	"runtime/debug"
 	"strings"
@@ -22,8 +20,6 @@ import (
 
 	"github.com/acarl005/stripansi"
 	"github.com/caarlos0/sshmarshal"
-	"github.com/charmbracelet/glamour"
-	"github.com/charmbracelet/glamour/ansi"
 	"github.com/disintegration/imaging"
 	//"github.com/eliukblau/pixterm/pkg/ansimage"
 	"github.com/fatih/color"
@@ -32,19 +28,36 @@ import (
 	cryptoSSH "golang.org/x/crypto/ssh"
 )
 
-var (
-	Art  = getASCIIArt()
-	CMDs []*[]CMD // slice of pointers to slices of commands (this is so updates to sub-slices are reflected in the main slice even if append is used)
-)
+var CMDs []*[]CMD // slice of pointers to slices of commands (this is so updates to sub-slices are reflected in the main slice even if append is used)
 
 func init() {
 	CMDs = []*[]CMD{&MainCMDs, &RestCMDs, &SecretCMDs}
 }
 
-func getCMD(name string) (CMD, bool) {
-	for _, cmds := range CMDs {
+// mainCMDs returns the commands shown by cmds, including the plugin commands if plugins are enabled
+func (srv *Server) mainCMDs() []CMD {
+	if srv.Integrations().RPC == nil {
+		return MainCMDs
+	}
+	return append(append([]CMD(nil), MainCMDs...), RPCCMDs...)
+}
+
+// restCMDs returns the commands shown by cmds rest, including the plugin commands if plugins are enabled
+func (srv *Server) restCMDs() []CMD {
+	if srv.Integrations().RPC == nil {
+		return RestCMDs
+	}
+	return append(append([]CMD(nil), RestCMDs...), RPCCMDsRest...)
+}
+
+func (srv *Server) getCMD(name string) (CMD, bool) {
+	cmdLists := CMDs
+	if srv.Integrations().RPC != nil {
+		cmdLists = append(cmdLists[:len(cmdLists):len(cmdLists)], &RPCCMDs, &RPCCMDsRest)
+	}
+	for _, cmds := range cmdLists {
 		if cmds == nil {
-			Log.Println("CMD 中的 nil 分段") // should never happen
+			srv.Log.Println("CMD 中的 nil 分段") // should never happen
 			continue
 		}
 		for _, cmd := range *cmds {
@@ -56,11 +69,11 @@ func getCMD(name string) (CMD, bool) {
 	return CMD{}, false
 }
 
-func getASCIIArt() string {
+func (srv *Server) getASCIIArt() string {
 	sep := string(os.PathSeparator)
-	b, _ := os.ReadFile(Config.DataDir + sep + "art.txt")
+	b, _ := os.ReadFile(srv.Config().DataDir + sep + "art.txt")
 	if b == nil {
-		return "抱歉，没有找到任何艺术作品，请打你的开发者一巴掌，告诉他们添加一个 " + Config.DataDir + sep + "art.txt 文件"
+		return "抱歉，没有找到任何艺术作品，请打你的开发者一巴掌，告诉他们添加一个 " + srv.Config().DataDir + sep + "art.txt 文件"
 	}
 	return string(b)
 }
@@ -68,13 +81,16 @@ func getASCIIArt() string {
 func printUsersInRoom(r *Room) string {
 	names := ""
 	admins := ""
-	for _, us := range r.users {
+	for _, us := range r.snapshot() {
 		if auth(us) {
 			admins += us.Name + " "
 			continue
 		}
 		names += us.Name + " "
 	}
+	for _, name := range r.srv.remoteUsers(r.name) {
+		names += name + " "
+	}
 	if len(names) > 0 {
 		names = names[:len(names)-1] // cut extra space at the end
 	}
@@ -102,7 +118,7 @@ func autogenCommands(cmds []CMD) string {
 
 // check if a User is an admin
 func auth(u *User) bool {
-	_, ok := Config.Admins[u.id]
+	_, ok := u.srv.Config().Admins[u.id]
 	return ok
 }
 
@@ -116,9 +132,9 @@ func keepSessionAlive(s ssh.Session) {
 	}
 }
 
-func protectFromPanic() {
+func (srv *Server) protectFromPanic() {
 	if i := recover(); i != nil {
-		MainRoom.broadcast(Devbot, "给我打王果冻那小子一巴掌，服务器差点崩溃，也告诉他这个事: "+fmt.Sprint(i)+", stack: "+string(debug.Stack()))
+		srv.MainRoom.broadcast(Devbot, "给我打王果冻那小子一巴掌，服务器差点崩溃，也告诉他这个事: "+fmt.Sprint(i)+", stack: "+string(debug.Stack()))
 	}
 }
 
@@ -138,24 +154,29 @@ func cleanName(name string) string {
 	return s
 }
 
-func mdRender(a string, beforeMessageLen int, lineWidth int, imageCache map[string]image.Image) string {
-	glamourStyle := glamour.DarkStyleConfig
-	glamourStyle.Document.Color = nil
-	glamourStyle.Document.Margin = nil
-	glamourStyle.Image = ansi.StylePrimitive{Format: "\n<img>{{.text}}</img>\n"}
-	glamourStyle.ImageText.Format = "Image: {{.text}}"
-	glamourStyle.Table.StyleBlock.StylePrimitive.Prefix = "\x1b[0m" // ansi reset: hack to stop space in front of table from being erased
-	r, _ := glamour.NewTermRenderer(glamour.WithEmoji(), glamour.WithStyles(glamourStyle), glamour.WithWordWrap(lineWidth-beforeMessageLen), glamour.WithPreservedNewLines())
-	md, err := r.Render(a)
+// mdRender renders markdown, reusing the result if the same message was recently rendered for the same width.
+// pending lists the images that are still being fetched and were replaced with a placeholder.
+func (srv *Server) mdRender(a string, beforeMessageLen int, lineWidth int, showImages bool) (md string, pending []string) {
+	key := renderKey{a, beforeMessageLen, lineWidth, showImages}
+	if md, ok := srv.renders.get(key); ok {
+		return md, nil
+	}
+	md, err := renderMarkdown(a, lineWidth-beforeMessageLen)
 	if err != nil {
-		MainRoom.broadcast(Devbot, err.Error())
-		return ""
+		srv.MainRoom.broadcast(Devbot, err.Error())
+		return "", nil
+	}
+	md = addLeftPad(strings.TrimSuffix(srv.replaceImgs(md, lineWidth, showImages, &pending), "\n"), beforeMessageLen)
+	if len(pending) == 0 { // don't keep the placeholders around once the images are ready
+		srv.renders.add(key, md)
 	}
-	md = addLeftPad(strings.TrimSuffix(replaceImgs(md, lineWidth, imageCache), "\n"), beforeMessageLen)
-	return md
+	return md, pending
 }
 
-func replaceImgs(md string, width int, cache map[string]image.Image) string {
+// replaceImgs renders the images in md, or replaces them with their links if showImages is false
+// or they can't be shown. Images that haven't been fetched yet are fetched in the background, replaced
+// with a placeholder, and added to pending.
+func (srv *Server) replaceImgs(md string, width int, showImages bool, pending *[]string) string {
 	if !strings.Contains(md, "<img>") {
 		return md
 	}
@@ -169,36 +190,26 @@ func replaceImgs(md string, width int, cache map[string]image.Image) string {
 	imgText := md[imgStart:imgEnd]
 	imgText = strings.ReplaceAll(strings.ReplaceAll(strings.TrimSpace(imgText), "\n", ""), " ", "")
 
-	if img, ok := cache[imgText]; ok {
-		imgText = imgRender(img, width/2)
-		return replaceImgs(md[:start]+imgText+md[end+6:], width, cache)
+	if !showImages {
+		return srv.replaceImgs(md[:start]+imgText+md[end+6:], width, showImages, pending)
 	}
 
-	client := http.Client{Timeout: 5 * time.Second}
-	res, err := client.Get(imgText)
-	if err != nil {
-		return replaceImgs(md[:start]+imgText+" (获取图像时出错)"+md[end+6:], width, cache)
+	if err := srv.checkImage(imgText); err != nil {
+		return srv.replaceImgs(md[:start]+imgText+" ("+err.Error()+")"+md[end+6:], width, showImages, pending)
 	}
-	if res.StatusCode != http.StatusOK {
-		return replaceImgs(md[:start]+imgText+"(error: http: "+http.StatusText(res.StatusCode)+")"+md[end+6:], width, cache)
-	}
-	limitReader := io.LimitReader(res.Body, 30*1024*1024) // 30 megabyte limit
-	// https://github.com/golang/go/issues/12512#issuecomment-137981217
-	header := new(bytes.Buffer)
-	config, _, err := image.DecodeConfig(io.TeeReader(limitReader, header))
-	if err != nil || config.Width > 4032*2 || config.Height > 3024*2 {
-		return replaceImgs(md[:start]+imgText+" (无效或太大而无法渲染)"+md[end+6:], width, cache)
+
+	img, err, ok := srv.images.get(imgText)
+	if !ok {
+		srv.images.fetch(imgText, nil)
+		*pending = append(*pending, imgText)
+		return srv.replaceImgs(md[:start]+imgText+" (正在加载图像...)"+md[end+6:], width, showImages, pending)
 	}
-	img, _, err := image.Decode(io.MultiReader(header, limitReader))
 	if err != nil {
-		return replaceImgs(md[:start]+imgText+" (错误解码图像)"+md[end+6:], width, cache)
-	}
-	if cache != nil {
-		cache[imgText] = img
+		return srv.replaceImgs(md[:start]+imgText+" ("+err.Error()+")"+md[end+6:], width, showImages, pending)
 	}
 	imgText = imgRender(img, width/2)
 
-	return replaceImgs(md[:start]+imgText+md[end+6:], width, cache)
+	return srv.replaceImgs(md[:start]+imgText+md[end+6:], width, showImages, pending)
 }
 
 func imgRender(img image.Image, width int) string {
@@ -226,48 +237,79 @@ func addLeftPad(a string, pad int) string {
 
 // Returns true and the User with the same name if the username is taken, false and nil otherwise
 func userDuplicate(r *Room, a string) (*User, bool) {
-	for i := range r.users {
-		if stripansi.Strip(r.users[i].Name) == stripansi.Strip(a) {
-			return r.users[i], true
+	for _, us := range r.snapshot() {
+		if stripansi.Strip(us.Name) == stripansi.Strip(a) {
+			return us, true
 		}
 	}
 	return nil, false
 }
 
-func saveBans() {
-	f, err := os.Create(Config.DataDir + string(os.PathSeparator) + "bans.json")
+func (srv *Server) saveBans() {
+	f, err := os.Create(srv.Config().DataDir + string(os.PathSeparator) + "bans.json")
 	if err != nil {
-		Log.Println(err)
+		srv.Log.Println(err)
 		return
 	}
 	defer f.Close()
 	j := json.NewEncoder(f)
 	j.SetIndent("", "   ")
-	err = j.Encode(Bans)
+	srv.bansMutex.RLock()
+	err = j.Encode(srv.Bans)
+	srv.bansMutex.RUnlock()
 	if err != nil {
-		MainRoom.broadcast(Devbot, "error 保存封禁: "+err.Error())
-		Log.Println(err)
+		srv.MainRoom.broadcast(Devbot, "error 保存封禁: "+err.Error())
+		srv.Log.Println(err)
 		return
 	}
 }
 
-func readBans() {
-	f, err := os.Open(Config.DataDir + string(os.PathSeparator) + "bans.json")
+func (srv *Server) readBans() {
+	f, err := os.Open(srv.Config().DataDir + string(os.PathSeparator) + "bans.json")
 	if err != nil {
 		if !os.IsNotExist(err) {
-			Log.Println(err)
+			srv.Log.Println(err)
 		}
 		return
 	}
 	defer f.Close()
-	err = json.NewDecoder(f).Decode(&Bans)
+	srv.bansMutex.Lock()
+	err = json.NewDecoder(f).Decode(&srv.Bans)
+	srv.bansMutex.Unlock()
 	if err != nil {
-		MainRoom.broadcast(Devbot, "error 加载封禁: "+err.Error())
-		Log.Println(err)
+		srv.MainRoom.broadcast(Devbot, "error 加载封禁: "+err.Error())
+		srv.Log.Println(err)
 		return
 	}
 }
 
+// sweepExpiredBans periodically removes bans whose duration has passed and saves the bans file if any were removed.
+func (srv *Server) sweepExpiredBans() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-srv.done:
+			return
+		}
+		removed := 0
+		srv.bansMutex.Lock()
+		for i := 0; i < len(srv.Bans); i++ {
+			if srv.Bans[i].expired() {
+				srv.Log.Println("封禁已过期: " + srv.Bans[i].ID + " [" + srv.Bans[i].Addr + "]")
+				srv.Bans = append(srv.Bans[:i], srv.Bans[i+1:]...)
+				i--
+				removed++
+			}
+		}
+		srv.bansMutex.Unlock()
+		if removed > 0 {
+			srv.saveBans()
+		}
+	}
+}
+
 func findUserByName(r *Room, name string) (*User, bool) {
 	r.usersMutex.RLock()
 	defer r.usersMutex.RUnlock()
@@ -441,39 +483,39 @@ func fmtTime(u *User, lastStamp time.Time) string {
 }
 
 // Check if the private key is there and if it is not, try to create it.
-func checkKey(keyPath string) {
+func (srv *Server) checkKey(keyPath string) {
 	_, err := os.Stat(keyPath)
 	if err == nil {
 		// Key exists, everything is fine and dandy.
 		return
 	}
 	if !os.IsNotExist(err) { // the error is not a not-exist error. i.e. the file exists but there's some other problem with it
-		Log.Printf("检查 SSH 密钥时出错 [%v]: %v\n", keyPath, err)
+		srv.Log.Printf("检查 SSH 密钥时出错 [%v]: %v\n", keyPath, err)
 		return
 	}
 
-	Log.Printf("生成新的 SSH 服务器私钥 %v\n", keyPath)
+	srv.Log.Printf("生成新的 SSH 服务器私钥 %v\n", keyPath)
 	privkey, pubkey, err := genKey()
 	if err != nil {
-		Log.Printf("生成密钥对时出错: %v\n", err)
+		srv.Log.Printf("生成密钥对时出错: %v\n", err)
 		return
 	}
 	privkeyFile, err := os.Create(keyPath)
 	if err != nil {
-		Log.Printf("为私钥创建文件时出错: %v\n", err)
+		srv.Log.Printf("为私钥创建文件时出错: %v\n", err)
 		return
 	}
 	defer privkeyFile.Close()
 	blk, err := sshmarshal.MarshalPrivateKey(privkey, "")
 	if err != nil {
-		Log.Printf("封送私钥时出错: %v\n", err)
+		srv.Log.Printf("封送私钥时出错: %v\n", err)
 		return
 	}
 	if err := pem.Encode(privkeyFile, blk); err != nil {
-		Log.Printf("对私钥进行编码时出错: %v\n", err)
+		srv.Log.Printf("对私钥进行编码时出错: %v\n", err)
 		return
 	}
-	Log.Println("已成功生成密钥!\n虽然公钥对于服务器操作不是必需的，但保存它可能很有用:\n" + color.YellowString(string(cryptoSSH.MarshalAuthorizedKey(pubkey))))
+	srv.Log.Println("已成功生成密钥!\n虽然公钥对于服务器操作不是必需的，但保存它可能很有用:\n" + color.YellowString(string(cryptoSSH.MarshalAuthorizedKey(pubkey))))
 }
 
 func genKey() (ed25519.PrivateKey, ssh.PublicKey, error) {